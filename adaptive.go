@@ -0,0 +1,287 @@
+package vpcflow
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	defaultAdaptiveMaxConcurrency = 64
+	defaultAdaptiveInterval       = time.Second
+	defaultAdaptiveBackoff        = 0.5
+	defaultAdaptiveLatency        = 2.0
+)
+
+// DownloadObserver is implemented by a Lock that adjusts to the outcome of
+// the downloads it guards. The PrefetchFileManager and DiskFileManager
+// report each download to their Lock, before unlocking it, if it is a
+// DownloadObserver.
+type DownloadObserver interface {
+	// ObserveDownload records a download of the given number of bytes
+	// that took the given time, or that failed with err.
+	ObserveDownload(bytes int64, latency time.Duration, err error)
+}
+
+// AdaptiveLimiter implements the sync.Locker interface with a limit on
+// concurrent holders that adapts to the observed downloads in the style of
+// AIMD congestion control. Downloads are measured over windows of Interval.
+// At the end of each window in which the limit was reached, the limit is
+// raised by one if throughput did not fall compared to the previous window.
+// The limit is multiplied by Backoff when a download is throttled or when
+// the latency of a window, measured as the time spent per byte downloaded
+// so that large and small files compare fairly, exceeds LatencyTolerance
+// times the usual latency. At most one decrease is applied per Interval so
+// that a burst of failures from concurrent downloads counts once.
+//
+// The limiter learns only of the downloads that are reported to
+// ObserveDownload. Requests that are retried by a RetryS3API succeed or
+// fail as one download, so throttling that is retried is reported by also
+// calling ObserveDownload from the OnRetry of the RetryPolicy.
+type AdaptiveLimiter struct {
+	// MinConcurrency is the lowest limit and the limit at start. If not
+	// set then 1 is used.
+	MinConcurrency int
+	// MaxConcurrency is the highest limit. If not set then 64 is used.
+	MaxConcurrency int
+	// Interval is the length of each measurement window. If not set
+	// then one second is used.
+	Interval time.Duration
+	// Backoff is the factor by which the limit is multiplied when it is
+	// decreased. If not set then 0.5 is used.
+	Backoff float64
+	// LatencyTolerance is the growth in mean latency, as a multiple of
+	// the usual latency, that decreases the limit. If not set then 2
+	// is used.
+	LatencyTolerance float64
+	// IsThrottle classifies errors that decrease the limit. If not set
+	// then IsThrottleError is used.
+	IsThrottle func(error) bool
+
+	once         sync.Once
+	lock         sync.Mutex
+	cond         *sync.Cond
+	now          func() time.Time
+	min          int
+	max          int
+	interval     time.Duration
+	backoff      float64
+	tolerance    float64
+	isThrottle   func(error) bool
+	limit        int
+	active       int
+	saturated    bool
+	windowStart  time.Time
+	windowBytes  int64
+	windowTime   time.Duration
+	lastDecrease time.Time
+	throughput   float64
+	// latency is the usual time, in seconds, spent per byte.
+	latency float64
+}
+
+func (l *AdaptiveLimiter) init() {
+	l.cond = sync.NewCond(&l.lock)
+	l.min = l.MinConcurrency
+	if l.min < 1 {
+		l.min = 1
+	}
+	l.max = l.MaxConcurrency
+	if l.max < 1 {
+		l.max = defaultAdaptiveMaxConcurrency
+	}
+	if l.max < l.min {
+		l.max = l.min
+	}
+	l.interval = l.Interval
+	if l.interval <= 0 {
+		l.interval = defaultAdaptiveInterval
+	}
+	l.backoff = l.Backoff
+	if l.backoff <= 0 || l.backoff >= 1 {
+		l.backoff = defaultAdaptiveBackoff
+	}
+	l.tolerance = l.LatencyTolerance
+	if l.tolerance <= 1 {
+		l.tolerance = defaultAdaptiveLatency
+	}
+	l.isThrottle = l.IsThrottle
+	if l.isThrottle == nil {
+		l.isThrottle = IsThrottleError
+	}
+	if l.now == nil {
+		l.now = time.Now
+	}
+	l.limit = l.min
+	l.windowStart = l.now()
+}
+
+// Lock blocks until the number of holders is under the current limit.
+func (l *AdaptiveLimiter) Lock() {
+	l.once.Do(l.init)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active = l.active + 1
+	if l.active >= l.limit {
+		l.saturated = true
+	}
+}
+
+// Unlock releases a hold on the limiter.
+func (l *AdaptiveLimiter) Unlock() {
+	l.once.Do(l.init)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.active = l.active - 1
+	l.cond.Signal()
+}
+
+// Concurrency returns the current limit on concurrent holders.
+func (l *AdaptiveLimiter) Concurrency() int {
+	l.once.Do(l.init)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// Throughput returns the bytes per second downloaded in the most recent
+// complete window.
+func (l *AdaptiveLimiter) Throughput() float64 {
+	l.once.Do(l.init)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.throughput
+}
+
+// ObserveDownload records a download and adjusts the limit at the end of
+// each window or when the download was throttled.
+func (l *AdaptiveLimiter) ObserveDownload(bytes int64, latency time.Duration, err error) {
+	l.once.Do(l.init)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var now = l.now()
+	if err != nil {
+		if l.isThrottle(err) {
+			l.decrease(now)
+		}
+		return
+	}
+	l.windowBytes = l.windowBytes + bytes
+	l.windowTime = l.windowTime + latency
+	var elapsed = now.Sub(l.windowStart)
+	if elapsed < l.interval {
+		return
+	}
+
+	var throughput = float64(l.windowBytes) / elapsed.Seconds()
+	// Windows without content have no latency to compare.
+	var perByte float64
+	if l.windowBytes > 0 {
+		perByte = l.windowTime.Seconds() / float64(l.windowBytes)
+	}
+	if l.latency > 0 && perByte > l.latency*l.tolerance {
+		l.decrease(now)
+		l.learnLatency(perByte)
+		l.resetWindow(now)
+		return
+	}
+	if l.saturated && throughput >= l.throughput && l.limit < l.max {
+		l.limit = l.limit + 1
+		l.cond.Broadcast()
+	}
+	l.throughput = throughput
+	l.learnLatency(perByte)
+	l.resetWindow(now)
+}
+
+// learnLatency moves the usual latency toward that of a window. Lower
+// latency is adopted at once while higher latency is adopted gradually
+// so that a lasting change does not decrease the limit forever.
+func (l *AdaptiveLimiter) learnLatency(perByte float64) {
+	if perByte <= 0 {
+		return
+	}
+	if l.latency == 0 || perByte < l.latency {
+		l.latency = perByte
+		return
+	}
+	l.latency = l.latency + (perByte-l.latency)/8
+}
+
+func (l *AdaptiveLimiter) decrease(now time.Time) {
+	if !l.lastDecrease.IsZero() && now.Sub(l.lastDecrease) < l.interval {
+		return
+	}
+	l.lastDecrease = now
+	l.limit = int(float64(l.limit) * l.backoff)
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+	// Throughput at the lower limit is compared only with later
+	// windows at that limit.
+	l.throughput = 0
+	l.resetWindow(now)
+}
+
+func (l *AdaptiveLimiter) resetWindow(now time.Time) {
+	l.windowStart = now
+	l.windowBytes = 0
+	l.windowTime = 0
+	l.saturated = l.active >= l.limit
+}
+
+// IsThrottleError reports whether an error indicates that requests are
+// being throttled. This includes AWS throttling error codes and responses
+// with a 503 or 429 status, such as the SlowDown error of S3. The final
+// error of a RetryError is inspected.
+func IsThrottleError(err error) bool {
+	if rerr, ok := err.(*RetryError); ok {
+		err = rerr.Err
+	}
+	if err == nil {
+		return false
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		if rerr.StatusCode() == 503 || rerr.StatusCode() == 429 {
+			return true
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "SlowDown" {
+		return true
+	}
+	return request.IsErrorThrottle(err)
+}
+
+// NewAdaptivePrefetchPolicy is a variant of NewPrefetchPolicy that limits
+// concurrent downloads with the given AdaptiveLimiter rather than a fixed
+// size Semaphore. The limiter may be shared between policies and may be
+// inspected while they run.
+func NewAdaptivePrefetchPolicy(q s3iface.S3API, maxBytes int64, limiter *AdaptiveLimiter) func(BucketIterator) FileManager {
+	return NewAdaptivePrefetchPolicyWithContext(context.Background(), q, maxBytes, limiter)
+}
+
+// NewAdaptivePrefetchPolicyWithContext is a variant of
+// NewAdaptivePrefetchPolicy that stops prefetching when the context is
+// cancelled.
+func NewAdaptivePrefetchPolicyWithContext(ctx context.Context, q s3iface.S3API, maxBytes int64, limiter *AdaptiveLimiter) func(BucketIterator) FileManager {
+	return func(iter BucketIterator) FileManager {
+		var fm = &PrefetchFileManager{
+			Context:        ctx,
+			Lock:           limiter,
+			MaxBytes:       maxBytes,
+			Queue:          q,
+			Ready:          make(chan io.Reader, 1024),
+			BucketIterator: iter,
+		}
+		fm.start()
+		return fm
+	}
+}
@@ -0,0 +1,229 @@
+package vpcflow
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter(min int, max int) (*AdaptiveLimiter, *testClock) {
+	var clock = &testClock{t: time.Unix(0, 0)}
+	var l = &AdaptiveLimiter{MinConcurrency: min, MaxConcurrency: max, Interval: time.Second}
+	l.now = clock.now
+	l.once.Do(l.init)
+	return l, clock
+}
+
+func TestAdaptiveLimiterIncrease(t *testing.T) {
+	var l, clock = newTestLimiter(1, 3)
+	assert.Equal(t, 1, l.Concurrency())
+
+	// Windows in which the limit is reached and throughput holds
+	// raise the limit.
+	for _, expected := range []int{2, 3} {
+		for x := 0; x < l.Concurrency(); x = x + 1 {
+			l.Lock()
+		}
+		clock.advance(time.Second)
+		for x := 0; x < l.Concurrency(); x = x + 1 {
+			l.Unlock()
+		}
+		l.ObserveDownload(1000*int64(expected), 10*time.Millisecond, nil)
+		assert.Equal(t, expected, l.Concurrency())
+		assert.Equal(t, float64(1000*expected), l.Throughput())
+	}
+
+	// The limit does not pass the maximum.
+	l.Lock()
+	l.Lock()
+	l.Lock()
+	clock.advance(time.Second)
+	l.ObserveDownload(10000, 10*time.Millisecond, nil)
+	assert.Equal(t, 3, l.Concurrency())
+	l.Unlock()
+	l.Unlock()
+	l.Unlock()
+
+	// Throughput that falls, or a limit that is not reached, holds the
+	// limit where it is.
+	l, clock = newTestLimiter(1, 10)
+	l.Lock()
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, 10*time.Millisecond, nil)
+	l.Unlock()
+	assert.Equal(t, 2, l.Concurrency())
+	l.Lock()
+	l.Lock()
+	clock.advance(time.Second)
+	l.Unlock()
+	l.Unlock()
+	l.ObserveDownload(500, 10*time.Millisecond, nil)
+	assert.Equal(t, 2, l.Concurrency())
+	l.Lock()
+	clock.advance(time.Second)
+	l.ObserveDownload(2000, 10*time.Millisecond, nil)
+	l.Unlock()
+	assert.Equal(t, 2, l.Concurrency())
+}
+
+func TestAdaptiveLimiterDecrease(t *testing.T) {
+	var l, clock = newTestLimiter(1, 16)
+	l.limit = 8
+
+	l.ObserveDownload(0, 0, errors.New("not throttled"))
+	assert.Equal(t, 8, l.Concurrency())
+	l.ObserveDownload(0, 0, errTransient)
+	assert.Equal(t, 4, l.Concurrency())
+	// A burst of throttling counts once.
+	l.ObserveDownload(0, 0, errTransient)
+	assert.Equal(t, 4, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(0, 0, &RetryError{Attempts: 3, Err: errTransient})
+	assert.Equal(t, 2, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(0, 0, errTransient)
+	clock.advance(time.Second)
+	l.ObserveDownload(0, 0, errTransient)
+	assert.Equal(t, 1, l.Concurrency())
+
+	// Latency growth beyond the tolerance decreases the limit.
+	l.limit = 8
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, 10*time.Millisecond, nil)
+	assert.Equal(t, 8, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, 15*time.Millisecond, nil)
+	assert.Equal(t, 8, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, 50*time.Millisecond, nil)
+	assert.Equal(t, 4, l.Concurrency())
+
+	// Latency is compared per byte so that larger files taking longer
+	// is not taken as congestion.
+	clock.advance(time.Second)
+	l.ObserveDownload(100000, 2*time.Second, nil)
+	assert.Equal(t, 4, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, 10*time.Millisecond, nil)
+	clock.advance(time.Second)
+	l.ObserveDownload(100000, time.Second, nil)
+	assert.Equal(t, 4, l.Concurrency())
+	clock.advance(time.Second)
+	l.ObserveDownload(100, 10*time.Millisecond, nil)
+	assert.Equal(t, 2, l.Concurrency())
+}
+
+func TestAdaptiveLimiterKeepsSettings(t *testing.T) {
+	var l = &AdaptiveLimiter{}
+	assert.Equal(t, 1, l.Concurrency())
+	assert.Equal(t, &AdaptiveLimiter{}, &AdaptiveLimiter{
+		MinConcurrency:   l.MinConcurrency,
+		MaxConcurrency:   l.MaxConcurrency,
+		Interval:         l.Interval,
+		Backoff:          l.Backoff,
+		LatencyTolerance: l.LatencyTolerance,
+	}, "defaults were written to the settings")
+	assert.Nil(t, l.IsThrottle)
+	assert.Equal(t, defaultAdaptiveMaxConcurrency, l.max)
+}
+
+func TestAdaptiveLimiterLockWaitsForLimit(t *testing.T) {
+	var l, clock = newTestLimiter(1, 2)
+	l.Lock()
+	var locked = make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock was acquired beyond the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Raising the limit admits the waiter.
+	clock.advance(time.Second)
+	l.ObserveDownload(1000, time.Millisecond, nil)
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not admitted when the limit was raised")
+	}
+	l.Unlock()
+	l.Unlock()
+}
+
+func TestIsThrottleError(t *testing.T) {
+	tc := []struct {
+		Name     string
+		Err      error
+		Expected bool
+	}{
+		{Name: "nil", Err: nil},
+		{Name: "plain", Err: errors.New("")},
+		{Name: "slowdown", Err: awserr.New("SlowDown", "", nil), Expected: true},
+		{Name: "throttling", Err: awserr.New("Throttling", "", nil), Expected: true},
+		{Name: "503", Err: errTransient, Expected: true},
+		{Name: "429", Err: awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), Expected: true},
+		{Name: "500", Err: awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "")},
+		{Name: "retried", Err: &RetryError{Attempts: 2, Err: errTransient}, Expected: true},
+		{Name: "retried-nil", Err: &RetryError{Attempts: 2}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, IsThrottleError(tt.Err))
+		})
+	}
+}
+
+func TestNewAdaptivePrefetchPolicy(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var content = gzipString("content")
+	var queue = NewMockS3API(ctrl)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(aws.Context, *s3.GetObjectInput, ...interface{}) (*s3.GetObjectOutput, error) {
+			time.Sleep(time.Millisecond)
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	).Times(3)
+	var iter = NewMockBucketIterator(ctrl)
+	iter.EXPECT().Iterate().Return(true).Times(3)
+	iter.EXPECT().Current().Return(LogFile{Key: "file", Size: int64(len(content))}).Times(3)
+	iter.EXPECT().Iterate().Return(false)
+	iter.EXPECT().Close().Return(nil).Times(2)
+
+	var limiter = &AdaptiveLimiter{MaxConcurrency: 4, Interval: time.Nanosecond}
+	var r = &BucketIteratorReader{
+		BucketIterator: iter,
+		FetchPolicy:    NewAdaptivePrefetchPolicy(queue, 1<<20, limiter),
+	}
+	var text, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "contentcontentcontent", string(text))
+	assert.Nil(t, r.Close())
+	assert.True(t, limiter.Throughput() > 0)
+	assert.True(t, limiter.Concurrency() > 1)
+}
@@ -1,10 +1,9 @@
 package vpcflow
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"strings"
-	"time"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -12,9 +11,43 @@ import (
 )
 
 // BucketStateIterator holds the current state of the iterator.
+//
+// Object keys are parsed using the KeyParser, or a KeyLayout with
+// no prefix if the parser is not set. Keys that cannot be parsed
+// are handled according to the KeyErrorPolicy.
+//
+// If StartAfter is set then listing begins with the first key that
+// follows it. This is used to resume from a Checkpoint.
+//
+// The iterator is an Acknowledger. The FileManagers of this package
+// acknowledge each file when it is returned with Put, the readers of this
+// package acknowledge each file that they skip under a ReadErrorPolicy, and
+// a consumer that reads files itself must call Ack once a file is processed.
+// If TrackAcks is set then a Checkpoint only moves past a file once it and
+// every file listed before it are acknowledged, so a checkpoint taken while
+// files are still being fetched or read never skips them. Each listed key is
+// held until it is acknowledged. Without TrackAcks, Ack does nothing and the
+// Checkpoint stays at StartAfter. Ack and Checkpoint may be called from other
+// goroutines than Iterate.
+//
+// If Context is set then it is used for every request to S3 and
+// iteration stops with the error of the context once it is done.
+//
+// Each file produced is reported to the Observer, or to that of the
+// Context if the Observer is not set.
 type BucketStateIterator struct {
+	Context               context.Context
 	Bucket                string
 	Prefix                string
+	StartAfter            string
+	TrackAcks             bool
+	KeyParser             KeyParser
+	KeyErrorPolicy        KeyErrorPolicy
+	Observer              Observer
+	lock                  sync.Mutex
+	lastKey               string
+	listed                []string
+	acked                 map[string]bool
 	nextContinuationToken *string
 	currentListPosition   int
 	currentLogFileList    []LogFile
@@ -29,7 +62,25 @@ type BucketStateIterator struct {
 // been iterated over or an error is encountered attempting
 // to fetch records.
 func (iter *BucketStateIterator) Iterate() bool {
+	return iter.iterate(iter.Context)
+}
+
+// IterateWithContext is a variant of Iterate that also stops when ctx is
+// done. Listing requests are made with ctx in place of the Context of the
+// iterator.
+func (iter *BucketStateIterator) IterateWithContext(ctx context.Context) bool {
+	return iter.iterate(ctx)
+}
 
+func (iter *BucketStateIterator) iterate(ctx context.Context) bool {
+	for _, c := range []context.Context{iter.Context, ctx} {
+		if c != nil && c.Err() != nil {
+			if iter.error == nil {
+				iter.error = c.Err()
+			}
+			return false
+		}
+	}
 	for (iter.currentListPosition >= len(iter.currentLogFileList)-1) && !iter.isDone {
 		// we're at the end of the currentLogFileList,
 		// lets reset our list and list position and get the next page of results from the bucket
@@ -40,7 +91,14 @@ func (iter *BucketStateIterator) Iterate() bool {
 			ContinuationToken: iter.nextContinuationToken,
 			Prefix:            aws.String(iter.Prefix),
 		}
-		result, err := iter.Queue.ListObjectsV2(input)
+		if iter.StartAfter != "" {
+			input.StartAfter = aws.String(iter.StartAfter)
+		}
+		result, err := iter.listObjects(ctx, input)
+		if err != nil && ctx != nil && ctx.Err() != nil {
+			iter.error = ctx.Err()
+			return false
+		}
 		if err != nil {
 			iter.error = fmt.Errorf("error getting log file metadata. %s", err)
 			return false
@@ -50,9 +108,12 @@ func (iter *BucketStateIterator) Iterate() bool {
 				continue
 			}
 
-			logfile, err := parseLogFile(c, iter.Bucket)
+			logfile, err := parseLogFile(iter.KeyParser, c, iter.Bucket)
 			if err != nil {
-				iter.error = fmt.Errorf("error parsing logfile name. %s", err)
+				if iter.KeyErrorPolicy == SkipOnKeyError {
+					continue
+				}
+				iter.error = err
 				return false
 			}
 			iter.currentLogFileList = append(iter.currentLogFileList, logfile)
@@ -61,7 +122,72 @@ func (iter *BucketStateIterator) Iterate() bool {
 		iter.isDone = !(result.IsTruncated != nil && *result.IsTruncated)
 	}
 	iter.currentListPosition++
-	return !iter.isExausted()
+	if iter.isExausted() {
+		return false
+	}
+	if iter.TrackAcks {
+		iter.lock.Lock()
+		iter.listed = append(iter.listed, iter.currentLogFileList[iter.currentListPosition].Key)
+		iter.lock.Unlock()
+	}
+	observerOf(iter.Observer, iter.Context).ObserveListed(iter.currentLogFileList[iter.currentListPosition])
+	return true
+}
+
+func (iter *BucketStateIterator) listObjects(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if ctx != nil {
+		return iter.Queue.ListObjectsV2WithContext(ctx, input)
+	}
+	return iter.Queue.ListObjectsV2(input)
+}
+
+// iterateWithContext advances the iterator with ctx if it is a
+// ContextBucketIterator.
+func iterateWithContext(ctx context.Context, iter BucketIterator) bool {
+	if ci, ok := iter.(ContextBucketIterator); ok {
+		return ci.IterateWithContext(ctx)
+	}
+	return iter.Iterate()
+}
+
+// Ack marks a listed LogFile as processed and advances the checkpoint over
+// every file, in the order they were listed, that has been acknowledged.
+// Files that are not awaiting an acknowledgement are ignored.
+func (iter *BucketStateIterator) Ack(lf LogFile) error {
+	iter.lock.Lock()
+	defer iter.lock.Unlock()
+	// Keys are listed in order so a key outside of those awaiting an
+	// acknowledgement was either acknowledged already or never listed.
+	if len(iter.listed) < 1 || lf.Key < iter.listed[0] || lf.Key > iter.listed[len(iter.listed)-1] {
+		return nil
+	}
+	if iter.acked == nil {
+		iter.acked = make(map[string]bool)
+	}
+	iter.acked[lf.Key] = true
+	for len(iter.listed) > 0 && iter.acked[iter.listed[0]] {
+		delete(iter.acked, iter.listed[0])
+		iter.lastKey = iter.listed[0]
+		iter.listed = iter.listed[1:]
+	}
+	return nil
+}
+
+// Checkpoint records the position of the iterator. An iterator
+// created from the checkpoint will begin with the first file that
+// has not been acknowledged along with every file listed after it.
+func (iter *BucketStateIterator) Checkpoint() Checkpoint {
+	iter.lock.Lock()
+	var lastKey = iter.lastKey
+	if lastKey == "" {
+		lastKey = iter.StartAfter
+	}
+	iter.lock.Unlock()
+	return Checkpoint{
+		Bucket:  iter.Bucket,
+		Prefix:  iter.Prefix,
+		LastKey: lastKey,
+	}
 }
 
 // Current gets the current value of the iterator.
@@ -74,7 +200,7 @@ func (iter *BucketStateIterator) Current() LogFile {
 
 // Close cleans up any resources used by the iterator and
 // returns an error, if any, that caused iterations to stop.
-func (iter BucketStateIterator) Close() error {
+func (iter *BucketStateIterator) Close() error {
 	iter.currentLogFileList = nil
 	iter.currentListPosition = 0
 	iter.isDone = true
@@ -82,33 +208,217 @@ func (iter BucketStateIterator) Close() error {
 	return iter.error
 }
 
-func (iter BucketStateIterator) isExausted() bool {
+func (iter *BucketStateIterator) isExausted() bool {
 	return iter.isDone && iter.currentListPosition >= len(iter.currentLogFileList)
 }
 
+// multiIteratorBuffer is the number of results buffered for each
+// iterator of a MultiBucketIterator. This matches the maximum page
+// size of ListObjectsV2.
+const multiIteratorBuffer = 1000
+
+// MultiBucketIterator combines any number of BucketIterators into a
+// single iterator. Up to MaxConcurrent of the iterators are drained in
+// the background at a time while results are emitted in the order the
+// iterators are given. Iteration stops at the first iterator that
+// fails.
+//
+// The iterator is an Acknowledger that passes each acknowledgement to the
+// iterator that produced the file, if it is an Acknowledger.
+type MultiBucketIterator struct {
+	Iterators     []BucketIterator
+	MaxConcurrent int
+
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	results  []chan LogFile
+	errs     []error
+	done     chan struct{}
+	wg       sync.WaitGroup
+	position int
+	current  LogFile
+	isDone   bool
+	error    error
+	ackLock  sync.Mutex
+	pending  map[int]*pendingAcks
+}
+
+// pendingAcks is the range of keys produced by an Acknowledger that are
+// awaiting an acknowledgement. Keys are compared to the range, rather than
+// being held, because each iterator produces its keys in order.
+type pendingAcks struct {
+	ack   Acknowledger
+	first string
+	last  string
+	count int
+}
+
+func (iter *MultiBucketIterator) init() {
+	iter.done = make(chan struct{})
+	iter.ctx, iter.cancel = context.WithCancel(context.Background())
+	iter.results = make([]chan LogFile, len(iter.Iterators))
+	iter.errs = make([]error, len(iter.Iterators))
+	for idx := range iter.results {
+		iter.results[idx] = make(chan LogFile, multiIteratorBuffer)
+	}
+	var maxConcurrent = iter.MaxConcurrent
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	var sem = make(chan interface{}, maxConcurrent)
+	iter.wg.Add(1)
+	go func() {
+		defer iter.wg.Done()
+		// Iterators are started strictly in order so that the one
+		// currently being consumed always holds a slot.
+		for idx, it := range iter.Iterators {
+			select {
+			case sem <- nil:
+			case <-iter.done:
+				return
+			}
+			iter.wg.Add(1)
+			go iter.drain(idx, it, sem)
+		}
+	}()
+}
+
+func (iter *MultiBucketIterator) drain(idx int, it BucketIterator, sem chan interface{}) {
+	defer iter.wg.Done()
+	defer func() { <-sem }()
+	defer close(iter.results[idx])
+	// Listing is abandoned when the MultiBucketIterator is closed.
+	for iterateWithContext(iter.ctx, it) {
+		select {
+		case iter.results[idx] <- it.Current():
+		case <-iter.done:
+			_ = it.Close()
+			return
+		}
+	}
+	iter.errs[idx] = it.Close()
+}
+
+// Iterate pushes the cursor one record forward such that
+// the current value is fetched when calling Current().
+// This method should return false after all records have
+// been iterated over or an error is encountered attempting
+// to fetch records.
+func (iter *MultiBucketIterator) Iterate() bool {
+	return iter.IterateWithContext(context.Background())
+}
+
+// IterateWithContext is a variant of Iterate that stops with the error
+// of the context if it is done before the next result is available.
+func (iter *MultiBucketIterator) IterateWithContext(ctx context.Context) bool {
+	iter.once.Do(iter.init)
+	for !iter.isDone && iter.position < len(iter.results) {
+		var lf LogFile
+		var ok bool
+		select {
+		case lf, ok = <-iter.results[iter.position]:
+		case <-ctx.Done():
+			iter.error = ctx.Err()
+			iter.isDone = true
+			iter.current = LogFile{}
+			return false
+		}
+		if ok {
+			iter.current = lf
+			iter.track(lf)
+			return true
+		}
+		iter.error = iter.errs[iter.position]
+		iter.isDone = iter.error != nil
+		iter.position = iter.position + 1
+	}
+	iter.isDone = true
+	iter.current = LogFile{}
+	return false
+}
+
+// track records that the current file awaits an acknowledgement if the
+// iterator that produced it is an Acknowledger.
+func (iter *MultiBucketIterator) track(lf LogFile) {
+	var ack, ok = iter.Iterators[iter.position].(Acknowledger)
+	if !ok {
+		return
+	}
+	iter.ackLock.Lock()
+	defer iter.ackLock.Unlock()
+	if iter.pending == nil {
+		iter.pending = make(map[int]*pendingAcks)
+	}
+	var p, found = iter.pending[iter.position]
+	if !found {
+		p = &pendingAcks{ack: ack, first: lf.Key}
+		iter.pending[iter.position] = p
+	}
+	p.last = lf.Key
+	p.count = p.count + 1
+}
+
+// Ack passes the acknowledgement of a file to the iterator that produced
+// it. Files that are not awaiting an acknowledgement are ignored.
+func (iter *MultiBucketIterator) Ack(lf LogFile) error {
+	iter.ackLock.Lock()
+	var ack Acknowledger
+	for idx, p := range iter.pending {
+		if lf.Key < p.first || lf.Key > p.last {
+			continue
+		}
+		ack = p.ack
+		p.count = p.count - 1
+		if p.count < 1 {
+			delete(iter.pending, idx)
+		}
+		break
+	}
+	iter.ackLock.Unlock()
+	if ack == nil {
+		return nil
+	}
+	return ack.Ack(lf)
+}
+
+// Current gets the current value of the iterator.
+func (iter *MultiBucketIterator) Current() LogFile {
+	return iter.current
+}
+
+// Close stops any background listing and returns the error, if any,
+// that caused iterations to stop.
+func (iter *MultiBucketIterator) Close() error {
+	iter.once.Do(func() {
+		iter.done = make(chan struct{})
+		iter.ctx, iter.cancel = context.WithCancel(context.Background())
+	})
+	iter.isDone = true
+	select {
+	case <-iter.done:
+	default:
+		close(iter.done)
+	}
+	iter.cancel()
+	iter.wg.Wait()
+	return iter.error
+}
+
 // parseLogFile takes in an s3.Object and converts it into and returns a vpcflow.LogFile.
-func parseLogFile(content *s3.Object, bucket string) (LogFile, error) {
-	var logfile LogFile
-	logfile.Bucket = bucket
-	// most of what we need can be extracted from the *s3.Object.Key, which has this format:
-	// <aws_account_id>_vpcflowlogs_<region>_<flow_log_id>_<timestamp>_<hash>.log.gz
-	// example: AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz
-	var key = *content.Key
-	logfile.Key = key
-	var keyElements = strings.Split(key, "/")
-	var logFileName = keyElements[len(keyElements)-1]
-	var logFileNameElements = strings.Split(logFileName, "_")
-	logfile.Account = logFileNameElements[0]
-	logfile.Region = logFileNameElements[2]
-	var form = "20060102T1504Z"
-	var timestamp, err = time.Parse(form, logFileNameElements[4])
+// Most of what we need can be extracted from the *s3.Object.Key. See KeyLayout for the
+// supported formats. The default layout is used when the parser is nil.
+func parseLogFile(parser KeyParser, content *s3.Object, bucket string) (LogFile, error) {
+	if parser == nil {
+		parser = KeyLayout{}
+	}
+	var logfile, err = parser.ParseKey(aws.StringValue(content.Key))
 	if err != nil {
-		return LogFile{}, errors.New("timestamp could not be parsed from log file name. " + err.Error())
+		return LogFile{}, err
 	}
-	logfile.Timestamp = timestamp
-	logfile.FlowLogID = logFileNameElements[3]
-	logfile.Hash = strings.Split(logFileNameElements[5], ".")[0]
-
-	logfile.Size = *content.Size
+	logfile.Bucket = bucket
+	logfile.Size = aws.Int64Value(content.Size)
+	logfile.LastModified = aws.TimeValue(content.LastModified)
+	logfile.StorageClass = aws.StringValue(content.StorageClass)
 	return logfile, nil
 }
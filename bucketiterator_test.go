@@ -1,6 +1,7 @@
 package vpcflow
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"testing"
@@ -274,22 +275,27 @@ func TestIterateWithFileSurroundedByPagesOfDirs(t *testing.T) {
 func TestParseLogFileMetadata(t *testing.T) {
 	var key = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"
 	var size = int64(100)
+	var modified = time.Date(2018, 10, 17, 00, 35, 00, 00, time.UTC)
 	var input = s3.Object{
-		Key:  &key,
-		Size: &size,
+		Key:          &key,
+		Size:         &size,
+		LastModified: &modified,
+		StorageClass: aws.String(s3.ObjectStorageClassStandardIa),
 	}
 	var expectedLogFile = LogFile{
-		Bucket:    "testbucket",
-		Key:       key,
-		Account:   "123456789012",
-		Region:    "us-west-2",
-		Timestamp: time.Date(2018, 10, 17, 00, 30, 00, 00, time.UTC),
-		FlowLogID: "fl-00123456789abcdef",
-		Hash:      "0a1b2c3d",
-		Size:      int64(100),
+		Bucket:       "testbucket",
+		Key:          key,
+		Account:      "123456789012",
+		Region:       "us-west-2",
+		Timestamp:    time.Date(2018, 10, 17, 00, 30, 00, 00, time.UTC),
+		FlowLogID:    "fl-00123456789abcdef",
+		Hash:         "0a1b2c3d",
+		Size:         int64(100),
+		LastModified: modified,
+		StorageClass: "STANDARD_IA",
 	}
 
-	var logFile, err = parseLogFile(&input, "testbucket")
+	var logFile, err = parseLogFile(nil, &input, "testbucket")
 
 	assert.NoError(t, err, "there shouldn't be an error here")
 	assert.Equal(t, expectedLogFile, logFile, "logFiles match")
@@ -313,7 +319,7 @@ func TestParseLogFileMetadataWithNoDirs(t *testing.T) {
 		Size:      int64(100),
 	}
 
-	var logFile, err = parseLogFile(&input, "testbucket")
+	var logFile, err = parseLogFile(nil, &input, "testbucket")
 
 	assert.NoError(t, err, "error parsing key with no path")
 	assert.Equal(t, expectedLogFile, logFile, "logFiles match")
@@ -327,9 +333,10 @@ func TestParseLogFileMetadataWithSillyTimestamp(t *testing.T) {
 		Size: &size,
 	}
 
-	var _, err = parseLogFile(&input, "testbucket")
+	var _, err = parseLogFile(nil, &input, "testbucket")
 
-	assert.EqualError(t, err, "timestamp could not be parsed from log file name. parsing time \"20181917T0030Z\": month out of range")
+	assert.IsType(t, &KeyError{}, err)
+	assert.Equal(t, "timestamp could not be parsed from log file name. parsing time \"20181917T0030Z\": month out of range", err.(*KeyError).Reason)
 }
 
 func TestCurrent(t *testing.T) {
@@ -490,9 +497,65 @@ func TestCloseWithErrorParsingLogFileName(t *testing.T) {
 
 	queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&output, nil)
 
-	var errorString = "error parsing logfile name. timestamp could not be parsed from log file name. parsing time \"2018notatimeT0030Z\": month out of range"
+	// The wording of the parsing error depends on the Go version.
+	var _, parseErr = time.Parse("20060102T1504Z", "2018notatimeT0030Z")
+	var errorString = "error parsing logfile name " + key + ". timestamp could not be parsed from log file name. " + parseErr.Error()
+	assert.Equal(t, false, bi.Iterate())
+	var err = bi.Close()
+	assert.EqualError(t, err, errorString)
+	assert.IsType(t, &KeyError{}, err)
+	assert.Equal(t, key, err.(*KeyError).Key)
+}
+
+func TestIterateSkipsInvalidKeys(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var bi = BucketStateIterator{
+		Bucket:         "testbucket",
+		Queue:          queue,
+		KeyErrorPolicy: SkipOnKeyError,
+	}
+	var output = s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/"), Size: aws.Int64(100)},
+			{Key: aws.String("AWSLogs/123456789012/CloudTrail/us-west-2/2018/10/17/123456789012_CloudTrail_us-west-2_20181017T0030Z_0a1b2c3d.json.gz"), Size: aws.Int64(100)},
+			{Key: aws.String("123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"), Size: aws.Int64(100)},
+		},
+	}
+
+	queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&output, nil)
+
+	assert.Equal(t, true, bi.Iterate())
+	assert.Equal(t, "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz", bi.Current().Key)
 	assert.Equal(t, false, bi.Iterate())
-	assert.Equal(t, errors.New(errorString), bi.Close())
+	assert.Nil(t, bi.Close())
+}
+
+func TestIterateWithContext(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var bi = BucketStateIterator{
+		Context: ctx,
+		Bucket:  "testbucket",
+		Queue:   queue,
+	}
+	var output = s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"), Size: aws.Int64(100)},
+			{Key: aws.String("123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3e.log.gz"), Size: aws.Int64(100)},
+		},
+	}
+
+	queue.EXPECT().ListObjectsV2WithContext(ctx, gomock.Any()).Return(&output, nil)
+
+	assert.Equal(t, true, bi.Iterate())
+	cancel()
+	assert.Equal(t, false, bi.Iterate(), "iteration continued after the context was cancelled")
+	assert.Equal(t, context.Canceled, bi.Close())
 }
 
 func BenchmarkParseLogFile(b *testing.B) {
@@ -503,7 +566,7 @@ func BenchmarkParseLogFile(b *testing.B) {
 	bucket := "vpcflow"
 	b.ResetTimer()
 	for n := 0; n < b.N; n = n + 1 {
-		_, err := parseLogFile(obj, bucket)
+		_, err := parseLogFile(nil, obj, bucket)
 		if err != nil {
 			b.Fatal(err.Error())
 		}
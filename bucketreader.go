@@ -3,9 +3,9 @@ package vpcflow
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -49,12 +49,39 @@ type FileManager interface {
 	Put(io.Reader)
 }
 
+// ContextFileManager is a FileManager that can abandon a call to Get
+// when a context is cancelled. The BucketIteratorReader uses this
+// variant when it is given a Context.
+type ContextFileManager interface {
+	FileManager
+	// GetWithContext is a variant of Get that returns the error of
+	// the context if it is done before a reader is available.
+	GetWithContext(context.Context) (io.Reader, error)
+}
+
+// SourceFileManager is a FileManager that can report the LogFile from
+// which each of its readers was fetched.
+type SourceFileManager interface {
+	FileManager
+	// Source returns the LogFile of a reader produced by Get. It
+	// returns false if the reader was not produced by the manager or
+	// has already been Put.
+	Source(io.Reader) (LogFile, bool)
+}
+
 // PrefetchFileManager implements the FileManager interface by
 // eagerly fetching content in the background to maximize the
 // chances of having a reader ready whenever a consumer asks for
 // one. Typically, this is created with the NewPrefetchPolicy
 // method and used as the FetchPolicy for the BucketIteratorReader.
+//
+// Calling Close, or cancelling the Context, stops prefetching and
+// abandons any downloads in progress.
 type PrefetchFileManager struct {
+	// Context, if set, bounds the lifetime of the background work.
+	// Downloads are made with this context and are abandoned when it
+	// is cancelled.
+	Context context.Context
 	// Queue is any implemenation of the S3API and will be used
 	// to download the individual object contents.
 	Queue s3iface.S3API
@@ -76,6 +103,14 @@ type PrefetchFileManager struct {
 	// limit the prefetching will stop until the buffer is drained
 	// enough to contain the next file.
 	//
+	// Each file is charged for the memory it holds until it is Put.
+	// That is the downloaded object plus the working memory needed
+	// to decode it: the decompression window of a gzip file, which
+	// is decompressed as it is read rather than all at once, or the
+	// largest uncompressed row group of a Parquet file. Space is
+	// reserved for an estimate when a download begins and the charge
+	// is corrected once the file is opened.
+	//
 	// One exception to this is when the buffer is empty and the next
 	// file is still larger, on its own, than the max bytes. In this
 	// case, the prefetcher will still download the file but will then
@@ -88,13 +123,35 @@ type PrefetchFileManager struct {
 	// while awaiting consumption. This channel may be given a buffer
 	// size or be blocking.
 	Ready chan io.Reader
+	// Ordered, if set, places files on Ready in the order that they
+	// were produced by the BucketIterator rather than in the order
+	// their downloads complete. Downloads still run concurrently but
+	// a file that completes early is held until those before it have
+	// been placed. The error of a file that fails is reported in the
+	// file's place and the error of the BucketIterator follows all
+	// of the files. As with unordered delivery, Get returns errors
+	// ahead of any files that are already waiting on Ready.
+	Ordered bool
+	// Observer, if set, receives the outcome of each download and the
+	// changes to the files and memory held by the manager. If not set
+	// then the Observer of the Context, if any, is used.
+	Observer Observer
 
+	observer   Observer
 	wg         sync.WaitGroup
+	memory     sync.Mutex
+	space      *sync.Cond
 	prefetched int64
 	errs       chan error
-	sizes      sync.Map
+	acks       ackErrors
+	files      sync.Map
 	downloader *s3manager.Downloader
 	once       sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+	state      sync.Mutex
+	closed     bool
+	running    sync.WaitGroup
 }
 
 // Get a prefetched file. If prefetch is lagging behind then
@@ -102,7 +159,17 @@ type PrefetchFileManager struct {
 // error was encountered since the last call to Get then it
 // is returned.
 func (f *PrefetchFileManager) Get() (io.Reader, error) {
+	return f.GetWithContext(context.Background())
+}
+
+// GetWithContext is a variant of Get that returns early with the
+// error of the context, or that of the manager's own Context, if
+// either is done while waiting for a file.
+func (f *PrefetchFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
 	f.once.Do(f.init)
+	if e := f.acks.take(); e != nil {
+		return nil, e
+	}
 	select {
 	case e := <-f.errs:
 		return nil, e
@@ -113,41 +180,227 @@ func (f *PrefetchFileManager) Get() (io.Reader, error) {
 		return nil, e
 	case r := <-f.Ready:
 		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done():
+		return nil, f.ctx.Err()
 	}
 }
 
-// Put returns a file to the manager for cleanup.
+// Close stops prefetching and waits for all background work to end.
+// Files that were already prefetched are discarded.
+func (f *PrefetchFileManager) Close() error {
+	f.once.Do(f.init)
+	f.state.Lock()
+	f.closed = true
+	f.state.Unlock()
+	if f.cancel != nil {
+		f.cancel()
+	}
+	f.running.Wait()
+	return nil
+}
+
+// done is the channel that closes when the manager is stopped. It is
+// nil, and so never ready, if the manager has not been initialized.
+func (f *PrefetchFileManager) done() <-chan struct{} {
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Done()
+}
+
+// sendErr reports an error to the consumer unless the manager is
+// stopped first.
+func (f *PrefetchFileManager) sendErr(e error) {
+	select {
+	case f.errs <- e:
+	case <-f.done():
+	}
+}
+
+// prefetchedFile is the source of a prefetched reader and the memory
+// charged for it.
+type prefetchedFile struct {
+	logFile LogFile
+	size    int64
+}
+
+// Source returns the LogFile from which a prefetched reader was fetched.
+func (f *PrefetchFileManager) Source(r io.Reader) (LogFile, bool) {
+	var pf, ok = f.files.Load(r)
+	if !ok {
+		return LogFile{}, false
+	}
+	return pf.(prefetchedFile).logFile, true
+}
+
+// Put returns a file to the manager for cleanup. If the BucketIterator
+// is an Acknowledger then the file is acknowledged as consumed and an
+// error doing so is returned by the next Get.
 func (f *PrefetchFileManager) Put(r io.Reader) {
-	var size, _ = f.sizes.Load(r)
-	f.sizes.Delete(r)
-	_ = atomic.AddInt64(&f.prefetched, -size.(int64))
+	var v, ok = f.files.Load(r)
+	if !ok {
+		return
+	}
+	f.files.Delete(r)
+	var pf = v.(prefetchedFile)
+	f.charge(-1, -pf.size)
+	f.acks.ack(f.BucketIterator, pf.logFile)
+}
+
+// gzipReaderSize approximates the memory held by a gzip reader for its
+// decompression window and decoding tables.
+const gzipReaderSize = 48 * 1024
+
+// estimateSize is the memory expected to be held by a file before it
+// is downloaded. The row group sizes of Parquet files are not known
+// until the file is opened.
+func estimateSize(lf LogFile) int64 {
+	if isParquet(lf.Key) {
+		return lf.Size
+	}
+	return lf.Size + gzipReaderSize
+}
+
+// readerSize is the memory held by an open file of the given
+// downloaded size.
+func readerSize(r io.Reader, downloaded int64) int64 {
+	switch reader := r.(type) {
+	case *parquetReader:
+		return downloaded + reader.rowGroupSize
+	case *gzip.Reader:
+		return downloaded + gzipReaderSize
+	}
+	return downloaded
+}
+
+// reserve waits until the memory charged for prefetched files leaves
+// room for size bytes and then charges them. As with MaxBytes, a file
+// is always admitted when nothing else is charged. It returns false if
+// the manager is stopped first.
+func (f *PrefetchFileManager) reserve(size int64) bool {
+	f.memory.Lock()
+	defer f.memory.Unlock()
+	for f.prefetched != 0 && f.prefetched+size > f.MaxBytes && f.ctx.Err() == nil {
+		f.space.Wait()
+	}
+	if f.ctx.Err() != nil {
+		return false
+	}
+	f.prefetched = f.prefetched + size
+	f.observer.ObserveBuffer(1, size)
+	return true
+}
+
+// charge adjusts the memory charged for prefetched files, and the number
+// of files, and wakes the prefetch loop if space was freed.
+func (f *PrefetchFileManager) charge(files int, size int64) {
+	f.memory.Lock()
+	defer f.memory.Unlock()
+	f.prefetched = f.prefetched + size
+	f.observer.ObserveBuffer(files, size)
+	if size < 0 {
+		f.space.Broadcast()
+	}
 }
 
 func (f *PrefetchFileManager) prefetchFile(lf LogFile) {
+	defer f.wg.Done()
+	var r, size, e = f.fetch(lf)
+	f.deliver(lf, r, size, e)
+}
+
+// prefetchFileInOrder is a variant of prefetchFile that delivers the
+// file only once the file before it, which closes prev, is delivered.
+// The download lock is not held while waiting so that earlier files
+// are never blocked by later ones.
+func (f *PrefetchFileManager) prefetchFileInOrder(lf LogFile, prev <-chan struct{}, delivered chan<- struct{}) {
+	defer f.wg.Done()
+	defer close(delivered)
+	var r, size, e = f.fetch(lf)
+	select {
+	case <-prev:
+	case <-f.done():
+		if r != nil {
+			f.charge(-1, -size)
+		}
+		return
+	}
+	f.deliver(lf, r, size, e)
+}
+
+// fetch downloads and opens a file for which space was reserved. The
+// reservation is replaced by the memory held by the open file, which
+// is returned as its size. Both the reader and the error are nil if
+// the manager was stopped before the download began.
+func (f *PrefetchFileManager) fetch(lf LogFile) (io.Reader, int64, error) {
+	var r, downloaded, e = f.download(lf)
+	if r == nil {
+		f.charge(-1, -estimateSize(lf))
+		return nil, 0, e
+	}
+	var size = readerSize(r, downloaded)
+	f.charge(0, size-estimateSize(lf))
+	return r, size, nil
+}
+
+func (f *PrefetchFileManager) download(lf LogFile) (io.Reader, int64, error) {
 	f.Lock.Lock()
 	defer f.Lock.Unlock()
-	defer f.wg.Done()
+	if f.ctx.Err() != nil {
+		return nil, 0, nil
+	}
 
 	var fileBuff = make([]byte, 0, int(lf.Size))
 	var awsBuff = aws.NewWriteAtBuffer(fileBuff)
-	var _, e = f.downloader.Download(awsBuff, &s3.GetObjectInput{
+	var start = time.Now()
+	var n, e = f.downloader.DownloadWithContext(f.ctx, awsBuff, &s3.GetObjectInput{
 		Key:    aws.String(lf.Key),
 		Bucket: aws.String(lf.Bucket),
 	})
+	var latency = time.Since(start)
+	if f.ctx.Err() == nil {
+		if observer, ok := f.Lock.(DownloadObserver); ok {
+			observer.ObserveDownload(n, latency, e)
+		}
+		f.observer.ObserveFetch(lf, n, latency, e)
+	}
 	if e != nil {
-		f.errs <- e
-		return
+		return nil, 0, e
 	}
 
+	// Parquet files are compressed internally and are converted
+	// to text lines so that consumers need not know the difference.
+	var content = awsBuff.Bytes()
 	var result io.Reader
-	var finalBuff = bytes.NewBuffer(awsBuff.Bytes())
-	result, e = gzip.NewReader(finalBuff)
+	if isParquet(lf.Key) {
+		result, e = NewParquetReader(bytes.NewReader(content))
+	} else {
+		result, e = gzip.NewReader(bytes.NewBuffer(content))
+	}
+	if e != nil {
+		return nil, 0, e
+	}
+	return result, int64(cap(content)), nil
+}
+
+// deliver places a fetched file on Ready or reports its error.
+func (f *PrefetchFileManager) deliver(lf LogFile, r io.Reader, size int64, e error) {
 	if e != nil {
-		f.errs <- e
+		f.sendErr(&LogFileError{LogFile: lf, Err: e})
+		return
+	}
+	if r == nil {
 		return
 	}
-	f.sizes.Store(result, lf.Size)
-	f.Ready <- result
+	f.files.Store(r, prefetchedFile{logFile: lf, size: size})
+	select {
+	case f.Ready <- r:
+	case <-f.done():
+		f.files.Delete(r)
+		f.charge(-1, -size)
+	}
 }
 
 func (f *PrefetchFileManager) init() {
@@ -155,13 +408,62 @@ func (f *PrefetchFileManager) init() {
 		d.Concurrency = 1
 	})
 	f.errs = make(chan error, cap(f.Ready))
+	var parent = f.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	f.ctx, f.cancel = context.WithCancel(parent)
+	f.space = sync.NewCond(&f.memory)
+	f.observer = observerOf(f.Observer, f.Context)
+}
+
+// start runs Prefetch in the background. The loop is registered before
+// it is launched so that a Close that follows immediately still waits
+// for it to exit.
+func (f *PrefetchFileManager) start() {
+	f.once.Do(f.init)
+	f.running.Add(1)
+	go func() {
+		defer f.running.Done()
+		f.Prefetch()
+	}()
 }
 
 // Prefetch starts a loop that consumes from the attached BucketIterator
 // and attempts to load that content before it is needed.
 func (f *PrefetchFileManager) Prefetch() {
 	f.once.Do(f.init)
-	for f.BucketIterator.Iterate() {
+	// Registering under the lock ensures that Close either waits for
+	// this loop or that the loop sees the manager is closed.
+	f.state.Lock()
+	if f.closed {
+		f.state.Unlock()
+		_ = f.BucketIterator.Close()
+		close(f.Ready)
+		return
+	}
+	f.running.Add(1)
+	f.state.Unlock()
+	defer f.running.Done()
+
+	// Waiting for space ends when the manager is stopped.
+	var exited = make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-f.ctx.Done():
+			f.memory.Lock()
+			f.space.Broadcast()
+			f.memory.Unlock()
+		case <-exited:
+		}
+	}()
+
+	// In ordered mode each file waits on the delivery of the one
+	// before it. The first file has nothing to wait on.
+	var prev = make(chan struct{})
+	close(prev)
+	for f.ctx.Err() == nil && iterateWithContext(f.ctx, f.BucketIterator) {
 		var curr = f.BucketIterator.Current()
 		// Files of zero size don't have content to download so we drop
 		// them here if they made it. This is commonly due to directories
@@ -169,18 +471,24 @@ func (f *PrefetchFileManager) Prefetch() {
 		if curr.Size == 0 {
 			continue
 		}
-		var prefetched = atomic.LoadInt64(&f.prefetched)
-		for curr.Size+prefetched > f.MaxBytes && prefetched != 0 {
-			time.Sleep(250 * time.Microsecond) // TODO: better waiting pattern.
-			prefetched = atomic.LoadInt64(&f.prefetched)
+		if !f.reserve(estimateSize(curr)) {
+			break
 		}
-		_ = atomic.AddInt64(&f.prefetched, curr.Size)
 		f.wg.Add(1)
+		if f.Ordered {
+			var delivered = make(chan struct{})
+			go f.prefetchFileInOrder(curr, prev, delivered)
+			prev = delivered
+			continue
+		}
 		go f.prefetchFile(curr)
 	}
 	var e = f.BucketIterator.Close()
+	if f.Ordered {
+		f.wg.Wait()
+	}
 	if e != nil {
-		f.errs <- e
+		f.sendErr(e)
 	}
 	f.wg.Wait()
 	close(f.Ready)
@@ -192,16 +500,42 @@ func (f *PrefetchFileManager) Prefetch() {
 // dramatically speed up reading but must be tuned to the correct
 // concurrency and memory limits of a system.
 func NewPrefetchPolicy(q s3iface.S3API, maxBytes int64, maxConcurrent int) func(BucketIterator) FileManager {
+	return NewPrefetchPolicyWithContext(context.Background(), q, maxBytes, maxConcurrent)
+}
+
+// NewPrefetchPolicyWithContext is a variant of NewPrefetchPolicy that
+// stops prefetching when the context is cancelled.
+func NewPrefetchPolicyWithContext(ctx context.Context, q s3iface.S3API, maxBytes int64, maxConcurrent int) func(BucketIterator) FileManager {
+	return newPrefetchPolicy(ctx, q, maxBytes, maxConcurrent, false)
+}
+
+// NewOrderedPrefetchPolicy is a variant of NewPrefetchPolicy that
+// produces files in the order of the BucketIterator. See the Ordered
+// option of the PrefetchFileManager.
+func NewOrderedPrefetchPolicy(q s3iface.S3API, maxBytes int64, maxConcurrent int) func(BucketIterator) FileManager {
+	return NewOrderedPrefetchPolicyWithContext(context.Background(), q, maxBytes, maxConcurrent)
+}
+
+// NewOrderedPrefetchPolicyWithContext is a variant of
+// NewOrderedPrefetchPolicy that stops prefetching when the context
+// is cancelled.
+func NewOrderedPrefetchPolicyWithContext(ctx context.Context, q s3iface.S3API, maxBytes int64, maxConcurrent int) func(BucketIterator) FileManager {
+	return newPrefetchPolicy(ctx, q, maxBytes, maxConcurrent, true)
+}
+
+func newPrefetchPolicy(ctx context.Context, q s3iface.S3API, maxBytes int64, maxConcurrent int, ordered bool) func(BucketIterator) FileManager {
 	return func(iter BucketIterator) FileManager {
 		var sem = &Semaphore{C: make(chan interface{}, maxConcurrent)}
 		var fm = &PrefetchFileManager{
+			Context:        ctx,
 			Lock:           sem,
 			MaxBytes:       maxBytes,
 			Queue:          q,
 			Ready:          make(chan io.Reader, 1024),
 			BucketIterator: iter,
+			Ordered:        ordered,
 		}
-		go fm.Prefetch()
+		fm.start()
 		return fm
 	}
 }
@@ -210,48 +544,65 @@ func NewPrefetchPolicy(q s3iface.S3API, maxBytes int64, maxConcurrent int) func(
 // BucketIterator interfaces into an io.ReaderCloser that acts
 // as a continuous stream of data from all the files returned
 // by the interator.
+//
+// If Context is set then reads return the error of the context once it
+// is done, including reads that are waiting on a ContextFileManager.
+// Closing the reader also closes the FileManager if it is an io.Closer
+// so that no background work outlives the reader.
+//
+// Each call to Read returns data from a single file. If the FileManager
+// is a SourceFileManager then Source reports the LogFile of that data and
+// errors encountered while reading a file are returned as a *LogFileError.
+//
+// With a ReadErrorPolicy other than FailOnReadError, files that cannot be
+// fetched or read are skipped and reading continues with the next file.
+// Content of a file that was returned before its error is not taken back,
+// so a partial last line may run into the first line of the next file. The
+// BucketRecordIterator parses each file on its own and does not have this
+// limitation. Errors of the BucketIterator and of the Context are always
+// returned.
+//
+// Skipped files are acknowledged, like files that are read to the end, so
+// a checkpoint moves past them and SQS does not redeliver them. Files that
+// fail under FailOnReadError are never acknowledged. An error acknowledging
+// a file is returned by the next Read as an *AckError whatever the policy.
+//
+// The time spent waiting on the FileManager for each file and the errors
+// of each file are reported to the Observer, or to that of the Context if
+// the Observer is not set.
 type BucketIteratorReader struct {
-	BucketIterator BucketIterator
-	FetchPolicy    func(BucketIterator) FileManager
+	Context         context.Context
+	BucketIterator  BucketIterator
+	FetchPolicy     func(BucketIterator) FileManager
+	ReadErrorPolicy ReadErrorPolicy
+	// OnReadError, if set, is called with each error that is skipped.
+	OnReadError func(*LogFileError)
+	Observer    Observer
 
 	initialized bool
+	observer    Observer
 	policy      FileManager
+	acks        ackErrors
 	current     io.Reader
+	source      LogFile
+	hasSource   bool
 	exhausted   bool
 }
 
 // Read from files produced by the iterator as though they are
 // one, continuous file.
 func (r *BucketIteratorReader) Read(b []byte) (int, error) {
-	if !r.initialized {
-		r.policy = r.FetchPolicy(r.BucketIterator)
-		r.initialized = true
-	}
 	for {
-		// Once empty, this reader cannot be read from anymore.
-		if r.exhausted {
-			return 0, io.EOF
-		}
-		if r.current == nil {
-			var current, err = r.policy.Get()
-			if err != nil {
-				return 0, err
+		var ok, err = r.next()
+		if !ok {
+			if r.skipFetch(err) {
+				continue
 			}
-			r.current = current
-		}
-		// Reading nil from the channel is our best signal that
-		// the channel is closed so we exit with io.EOF to indicate
-		// that all content have been consumed. This _does_ place
-		// a requirement on producers to the ready channel that
-		// they must never write nil.
-		if r.current == nil {
-			r.exhausted = true
-			return 0, io.EOF
+			return 0, err
 		}
 		var n, e = r.current.Read(b)
 		if e == io.EOF {
-			r.policy.Put(r.current)
-			r.current = nil
+			r.release()
 			// There are some cases where .Read() can return the EOF
 			// marker but _also_ data read from the stream. To account
 			// for this, we need to check if any bytes were read before
@@ -264,15 +615,129 @@ func (r *BucketIteratorReader) Read(b []byte) (int, error) {
 			}
 			continue
 		}
+		if e == nil {
+			return n, nil
+		}
+		var lfErr = &LogFileError{LogFile: r.source, Err: e}
+		r.observer.ObserveReadError(lfErr)
+		if r.skip(lfErr) {
+			r.release()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if r.hasSource {
+			return n, lfErr
+		}
 		return n, e
 	}
 }
 
+// skip reports whether an error is skipped under the ReadErrorPolicy and
+// passes skipped errors to OnReadError. Errors are not skipped once the
+// Context is done since they are likely caused by the cancellation.
+func (r *BucketIteratorReader) skip(e *LogFileError) bool {
+	if r.ReadErrorPolicy == FailOnReadError || (r.Context != nil && r.Context.Err() != nil) {
+		return false
+	}
+	if r.OnReadError != nil {
+		r.OnReadError(e)
+	}
+	return true
+}
+
+// skipFetch reports whether the error of a file that could not be fetched
+// is skipped. A skipped file is acknowledged, as it would be by Put had it
+// been fetched, if the BucketIterator is an Acknowledger.
+func (r *BucketIteratorReader) skipFetch(err error) bool {
+	var lfErr, ok = err.(*LogFileError)
+	if !ok || !r.skip(lfErr) {
+		return false
+	}
+	r.acks.ack(r.BucketIterator, lfErr.LogFile)
+	return true
+}
+
+// Source returns the LogFile from which the most recent Read returned
+// data. It returns false if nothing has been read or if the FileManager
+// is not a SourceFileManager.
+func (r *BucketIteratorReader) Source() (LogFile, bool) {
+	return r.source, r.hasSource
+}
+
+// next ensures that there is a current file to read from. It returns
+// false, with io.EOF or the error that stopped the reader, if there
+// are no more files.
+func (r *BucketIteratorReader) next() (bool, error) {
+	if !r.initialized {
+		r.policy = r.FetchPolicy(r.BucketIterator)
+		r.observer = observerOf(r.Observer, r.Context)
+		r.initialized = true
+	}
+	if e := r.acks.take(); e != nil {
+		return false, e
+	}
+	// Once empty, this reader cannot be read from anymore.
+	if r.exhausted {
+		return false, io.EOF
+	}
+	if r.Context != nil && r.Context.Err() != nil {
+		return false, r.Context.Err()
+	}
+	if r.current != nil {
+		return true, nil
+	}
+	var start = time.Now()
+	var current, err = r.get()
+	r.observer.ObserveWait(time.Since(start))
+	if err != nil {
+		if lfErr, ok := err.(*LogFileError); ok {
+			r.observer.ObserveReadError(lfErr)
+		}
+		return false, err
+	}
+	// Reading nil from the channel is our best signal that
+	// the channel is closed so we exit with io.EOF to indicate
+	// that all content have been consumed. This _does_ place
+	// a requirement on producers to the ready channel that
+	// they must never write nil.
+	if current == nil {
+		r.exhausted = true
+		return false, io.EOF
+	}
+	r.current = current
+	r.source, r.hasSource = LogFile{}, false
+	if sfm, ok := r.policy.(SourceFileManager); ok {
+		r.source, r.hasSource = sfm.Source(current)
+	}
+	return true, nil
+}
+
+// release returns the current file to the FileManager. The source of
+// the file is kept until the next file is read.
+func (r *BucketIteratorReader) release() {
+	r.policy.Put(r.current)
+	r.current = nil
+}
+
+func (r *BucketIteratorReader) get() (io.Reader, error) {
+	if r.Context != nil {
+		if cm, ok := r.policy.(ContextFileManager); ok {
+			return cm.GetWithContext(r.Context)
+		}
+	}
+	return r.policy.Get()
+}
+
 // Close the reader and the underlying BucketIterator.
 // The reader may not be used again after calling Close().
 func (r *BucketIteratorReader) Close() error {
 	// Set exhausted to ensure future reads return
 	// io.EOF.
 	r.exhausted = true
+	if c, ok := r.policy.(io.Closer); ok {
+		_ = c.Close()
+	}
 	return r.BucketIterator.Close()
 }
@@ -2,9 +2,13 @@ package vpcflow
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -294,7 +298,9 @@ func TestPrefetchFileManagerPrefetch(t *testing.T) {
 		31, 139, 8, 0, 0, 0, 0, 0, 0, 255, 98, 24, 5, 163, 96, 20, 12, 123, 0,
 		8, 0, 0, 255, 255, 128, 23, 11, 6, 232, 3, 0, 0,
 	}
-	var maxBytes = int64(10 * len(gzipBody))
+	// Each file is charged for its content and for the working memory
+	// of its gzip reader.
+	var maxBytes = int64(10 * (len(gzipBody) + gzipReaderSize))
 	var lf = LogFile{Size: int64(len(gzipBody)), Key: "file", Bucket: "bucket"}
 	var ready = make(chan io.Reader, 100)
 	var fm = &PrefetchFileManager{
@@ -364,3 +370,366 @@ WAITLOOP:
 		assert.FailNow(t, "prefetch never completed and exited")
 	}
 }
+
+func TestPrefetchFileManagerGetWithContext(t *testing.T) {
+	var fm = &PrefetchFileManager{Ready: make(chan io.Reader)}
+	var ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+	var r, e = fm.GetWithContext(ctx)
+	assert.Nil(t, r)
+	assert.Equal(t, context.Canceled, e)
+}
+
+func TestPrefetchFileManagerClose(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var queue = NewMockS3API(ctrl)
+	var iter = &endlessBucketIterator{}
+	// Downloads block until they are cancelled so that closing must
+	// abandon them for the prefetcher to exit.
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx aws.Context, _ *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).AnyTimes()
+	var fm = NewPrefetchPolicy(queue, 1024, 2)(iter).(*PrefetchFileManager)
+
+	var done = make(chan interface{})
+	go func() {
+		assert.Nil(t, fm.Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not stop prefetching")
+	}
+	iter.mu.Lock()
+	assert.True(t, iter.closed, "prefetch did not close the iterator")
+	iter.mu.Unlock()
+	for range fm.Ready {
+	}
+}
+
+func TestBucketIteratorReaderWithContext(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var queue = NewMockS3API(ctrl)
+	var iter = &endlessBucketIterator{}
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx aws.Context, _ *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).AnyTimes()
+	var ctx, cancel = context.WithCancel(context.Background())
+	var r = &BucketIteratorReader{
+		Context:        ctx,
+		BucketIterator: iter,
+		FetchPolicy:    NewPrefetchPolicy(queue, 1024, 2),
+	}
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+	var _, e = r.Read(make([]byte, 10))
+	assert.Equal(t, context.Canceled, e)
+	_, e = r.Read(make([]byte, 10))
+	assert.Equal(t, context.Canceled, e)
+
+	var done = make(chan interface{})
+	go func() {
+		assert.Nil(t, r.Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not stop prefetching")
+	}
+	_, e = r.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, e)
+}
+
+func TestNewPrefetchPolicyWithContext(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var fm = NewPrefetchPolicyWithContext(ctx, nil, 1024, 2)(&endlessBucketIterator{})
+	var r, e = fm.Get()
+	assert.Nil(t, r)
+	assert.Equal(t, context.Canceled, e)
+	assert.Nil(t, fm.(io.Closer).Close())
+}
+
+func TestNewPrefetchPolicyWithContextCancelsListing(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var queue = NewMockS3API(ctrl)
+	var listing = make(chan struct{})
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx aws.Context, _ *s3.ListObjectsV2Input, _ ...interface{}) (*s3.ListObjectsV2Output, error) {
+			close(listing)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	)
+	var ctx, cancel = context.WithCancel(context.Background())
+	var bucketIter = &BucketStateIterator{Bucket: "bucket", Queue: queue}
+	var iter = &BucketFilter{
+		Filter:         LogFileTimeFilter{},
+		BucketIterator: bucketIter,
+	}
+	var fm = NewPrefetchPolicyWithContext(ctx, queue, 1024, 2)(iter)
+	<-listing
+	cancel()
+
+	var done = make(chan interface{})
+	go func() {
+		var r, _ = fm.Get()
+		assert.Nil(t, r)
+		assert.Nil(t, fm.(io.Closer).Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "cancel did not stop the listing")
+	}
+	assert.Equal(t, context.Canceled, bucketIter.Close())
+}
+
+func TestPrefetchFileManagerOrdered(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var lastStarted = make(chan struct{})
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			var key = aws.StringValue(input.Key)
+			switch key {
+			case "a":
+				// The first file completes after the others have started.
+				<-lastStarted
+				time.Sleep(10 * time.Millisecond)
+			case "missing":
+				return nil, errors.New(s3.ErrCodeNoSuchKey)
+			case "d":
+				close(lastStarted)
+			}
+			var content = gzipString(key)
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	).Times(5)
+	var iter = NewMockBucketIterator(ctrl)
+	var listErr = errors.New("")
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "a", Size: 10}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "b", Size: 10}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "missing", Size: 10}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "c", Size: 10}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "d", Size: 10}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(listErr),
+	)
+
+	var fm = &PrefetchFileManager{
+		Queue:          queue,
+		BucketIterator: iter,
+		Lock:           &Semaphore{C: make(chan interface{}, 5)},
+		MaxBytes:       1 << 20,
+		Ready:          make(chan io.Reader),
+		Ordered:        true,
+	}
+	fm.start()
+	defer fm.Close()
+	for _, expected := range []string{"a", "b", "", "c", "d", ""} {
+		var r, err = fm.Get()
+		if expected == "" {
+			assert.Nil(t, r)
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		var text, _ = ioutil.ReadAll(r)
+		assert.Equal(t, expected, string(text))
+		fm.Put(r)
+	}
+	var r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+}
+
+func TestPrefetchFileManagerMemoryAccounting(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var parquet = newTestParquetFile(t, testParquetRows...)
+	var objects = map[string][]byte{
+		"a.log.gz":      gzipString("a"),
+		"b.log.parquet": parquet,
+	}
+	var queue = NewMockS3API(ctrl)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			var content, ok = objects[aws.StringValue(input.Key)]
+			if !ok {
+				return nil, errors.New(s3.ErrCodeNoSuchKey)
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	).Times(3)
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "a.log.gz", Size: int64(len(objects["a.log.gz"]))}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "missing.log.gz", Size: 10}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Key: "b.log.parquet", Size: int64(len(parquet))}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(nil),
+	)
+	var fm = &PrefetchFileManager{
+		Queue:          queue,
+		BucketIterator: iter,
+		Lock:           &sync.Mutex{},
+		MaxBytes:       1 << 20,
+		Ready:          make(chan io.Reader, 10),
+		Ordered:        true,
+	}
+	fm.start()
+	defer fm.Close()
+	var charged = func() int64 {
+		fm.memory.Lock()
+		defer fm.memory.Unlock()
+		return fm.prefetched
+	}
+
+	var gz, err = fm.Get()
+	assert.Nil(t, err)
+	_, err = fm.Get()
+	assert.NotNil(t, err)
+	pq, err := fm.Get()
+	assert.Nil(t, err)
+	assert.True(t, pq.(*parquetReader).rowGroupSize > 0)
+	// The failed download holds no memory.
+	assert.Equal(t, int64(len(objects["a.log.gz"])+gzipReaderSize)+int64(len(parquet))+pq.(*parquetReader).rowGroupSize, charged())
+	fm.Put(gz)
+	fm.Put(pq)
+	assert.Equal(t, int64(0), charged())
+}
+
+func TestPrefetchFileManagerCloseWhileWaitingForSpace(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var content = gzipString("content")
+	var queue = NewMockS3API(ctrl)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: aws.Int64(int64(len(content))),
+	}, nil)
+	var lf = LogFile{Key: "file", Size: int64(len(content))}
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(lf),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(lf),
+		iter.EXPECT().Close().Return(nil),
+	)
+	var fm = &PrefetchFileManager{
+		Queue:          queue,
+		BucketIterator: iter,
+		Lock:           &sync.Mutex{},
+		MaxBytes:       1,
+		Ready:          make(chan io.Reader, 10),
+	}
+	fm.start()
+	// The second file waits for the first to be Put.
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	var closed = make(chan error)
+	go func() {
+		closed <- fm.Close()
+	}()
+	select {
+	case err = <-closed:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "prefetch did not stop while waiting for space")
+	}
+}
+
+func TestBucketIteratorReaderSkipFile(t *testing.T) {
+	var root, keys = writeCorruptTree(t)
+	defer os.RemoveAll(root)
+
+	var collector ErrorCollector
+	var r = &BucketIteratorReader{
+		BucketIterator:  &DirectoryBucketIterator{Root: root},
+		FetchPolicy:     NewLocalFilePolicy(),
+		ReadErrorPolicy: SkipFileOnReadError,
+		OnReadError:     collector.Collect,
+	}
+	var text, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(text), "2 123456789010 eni-a "))
+	assert.True(t, strings.HasSuffix(string(text), "2 123456789010 eni-e 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK\n"))
+	assert.Nil(t, r.Close())
+	var files = collector.Files()
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, keys["b"], files[0].Key)
+		assert.Equal(t, keys["c"], files[1].Key)
+	}
+
+	r = &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewLocalFilePolicy(),
+	}
+	_, err = ioutil.ReadAll(r)
+	assert.IsType(t, &LogFileError{}, err)
+	assert.Nil(t, r.Close())
+}
+
+func TestBucketIteratorReaderAckError(t *testing.T) {
+	var name = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz"
+	var root = writeTestTree(t, map[string]string{name: "a\n"})
+	defer os.RemoveAll(root)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte("not gzip"), 0600))
+
+	var ackErr = errors.New("ack failed")
+	var iter = &ackingBucketIterator{BucketIterator: &DirectoryBucketIterator{Root: root}, err: ackErr}
+	var r = &BucketIteratorReader{
+		BucketIterator:  iter,
+		FetchPolicy:     NewLocalFilePolicy(),
+		ReadErrorPolicy: SkipFileOnReadError,
+	}
+	// The skipped file is acknowledged and the failure is returned.
+	var _, err = r.Read(make([]byte, 10))
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, name, err.(*AckError).LogFile.Key)
+		assert.Equal(t, ackErr, err.(*AckError).Err)
+	}
+	assert.Equal(t, []string{name}, iter.acked)
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, r.Close())
+}
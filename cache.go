@@ -0,0 +1,532 @@
+package vpcflow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheTempPrefix marks files in the cache directory that are still
+// being written.
+const cacheTempPrefix = ".tmp-"
+
+// FileCache is a directory of the decompressed content of log files that
+// persists between runs. Entries are addressed by the Bucket, Key, and Hash
+// of each LogFile so that an object is only downloaded once for as long as
+// it remains in the cache. The cache is shared safely between managers in
+// the same process.
+type FileCache struct {
+	// Dir is the cache directory and is created if it does not exist.
+	Dir string
+	// MaxBytes limits the total size of the cache. The least recently
+	// used entries are removed first when it is exceeded. Entries left by
+	// a previous run are ordered by the time they were added until they
+	// are used again. If not set then the size is not limited.
+	MaxBytes int64
+	// MaxAge is how long an entry is kept after it was added. Expired
+	// entries are not served and are removed when they are looked up or
+	// when the cache is pruned. If not set then entries do not expire.
+	MaxAge time.Duration
+
+	hits    int64
+	misses  int64
+	once    sync.Once
+	err     error
+	lock    sync.Mutex
+	pinned  map[string]int
+	entries map[string]*cacheEntry
+	total   int64
+	swept   time.Time
+}
+
+// cacheEntry is the index record of a cached file. The time it was added
+// is the modification time of the file.
+type cacheEntry struct {
+	size  int64
+	added time.Time
+	used  time.Time
+}
+
+func (c *FileCache) init() {
+	c.pinned = make(map[string]int)
+	c.entries = make(map[string]*cacheEntry)
+	c.swept = time.Now()
+	if c.err = os.MkdirAll(c.Dir, 0700); c.err != nil {
+		return
+	}
+	// The directory is read once to index the entries of previous runs.
+	var infos, e = ioutil.ReadDir(c.Dir)
+	if e != nil {
+		c.err = e
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), cacheTempPrefix) {
+			continue
+		}
+		c.index(filepath.Join(c.Dir, info.Name()), info)
+	}
+}
+
+// Hits returns the number of files that were served from the cache.
+func (c *FileCache) Hits() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// Misses returns the number of files that were not found in the cache.
+func (c *FileCache) Misses() int64 {
+	return atomic.LoadInt64(&c.misses)
+}
+
+func (c *FileCache) path(lf LogFile) string {
+	var sum = sha256.Sum256([]byte(lf.Bucket + "\x00" + lf.Key + "\x00" + lf.Hash))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *FileCache) expired(entry *cacheEntry) bool {
+	return c.MaxAge > 0 && time.Since(entry.added) > c.MaxAge
+}
+
+// index records a file of the cache directory, replacing any previous
+// record of the same path.
+func (c *FileCache) index(path string, info os.FileInfo) *cacheEntry {
+	c.unindex(path)
+	var entry = &cacheEntry{size: info.Size(), added: info.ModTime(), used: info.ModTime()}
+	c.entries[path] = entry
+	c.total = c.total + entry.size
+	return entry
+}
+
+func (c *FileCache) unindex(path string) {
+	if entry, ok := c.entries[path]; ok {
+		delete(c.entries, path)
+		c.total = c.total - entry.size
+	}
+}
+
+// remove deletes an entry from the index and from the directory.
+func (c *FileCache) remove(path string) error {
+	c.unindex(path)
+	if e := os.Remove(path); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return nil
+}
+
+// lookup reports whether a file is cached. Cached files are pinned such
+// that they are not removed until they are unpinned, and are marked as
+// used for the ordering of removals.
+func (c *FileCache) lookup(lf LogFile) bool {
+	c.once.Do(c.init)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var path = c.path(lf)
+	var info, e = os.Stat(path)
+	if e != nil {
+		c.unindex(path)
+		atomic.AddInt64(&c.misses, 1)
+		return false
+	}
+	var entry, ok = c.entries[path]
+	if !ok || entry.size != info.Size() || !entry.added.Equal(info.ModTime()) {
+		// The file was changed outside of this cache.
+		entry = c.index(path, info)
+	}
+	if c.expired(entry) && c.pinned[path] < 1 {
+		_ = c.remove(path)
+		atomic.AddInt64(&c.misses, 1)
+		return false
+	}
+	entry.used = time.Now()
+	c.pinned[path] = c.pinned[path] + 1
+	atomic.AddInt64(&c.hits, 1)
+	return true
+}
+
+func (c *FileCache) unpin(lf LogFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var path = c.path(lf)
+	c.pinned[path] = c.pinned[path] - 1
+	if c.pinned[path] < 1 {
+		delete(c.pinned, path)
+	}
+}
+
+// create opens a temporary file in which to write a new entry.
+func (c *FileCache) create() (*os.File, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return ioutil.TempFile(c.Dir, cacheTempPrefix)
+}
+
+// commit adds a completed temporary file to the cache as the entry of
+// the LogFile. The cache is pruned once it exceeds MaxBytes, or at most
+// once per MaxAge to remove expired entries that are never looked up.
+func (c *FileCache) commit(lf LogFile, tmp string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var path = c.path(lf)
+	if e := os.Rename(tmp, path); e != nil {
+		_ = os.Remove(tmp)
+		return e
+	}
+	var info, e = os.Stat(path)
+	if e != nil {
+		return e
+	}
+	c.index(path, info).used = time.Now()
+	if (c.MaxBytes > 0 && c.total > c.MaxBytes) || (c.MaxAge > 0 && time.Since(c.swept) > c.MaxAge) {
+		return c.prune()
+	}
+	return nil
+}
+
+// prune removes expired entries and then removes the least recently used
+// entries until the cache is within MaxBytes. Pinned entries are not
+// removed.
+func (c *FileCache) prune() error {
+	c.swept = time.Now()
+	var paths = make([]string, 0, len(c.entries))
+	for path, entry := range c.entries {
+		if c.pinned[path] > 0 {
+			continue
+		}
+		if c.expired(entry) {
+			if e := c.remove(path); e != nil {
+				return e
+			}
+			continue
+		}
+		paths = append(paths, path)
+	}
+	if c.MaxBytes < 1 || c.total <= c.MaxBytes {
+		return nil
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return c.entries[paths[i]].used.Before(c.entries[paths[j]].used)
+	})
+	for _, path := range paths {
+		if c.total <= c.MaxBytes {
+			break
+		}
+		if e := c.remove(path); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// cacheHitBuffer is the number of cached files that may be set aside
+// while waiting to be served. This matches the Ready buffer of the
+// policies of this package.
+const cacheHitBuffer = 1024
+
+// cacheMissIterator passes only the files that are not cached to the
+// FileManager that downloads them. Cached files are set aside to be
+// served by the CachingFileManager. Once cacheHitBuffer files are set
+// aside, iteration waits for them to be served.
+type cacheMissIterator struct {
+	BucketIterator
+	cache *FileCache
+	hits  chan LogFile
+	done  chan struct{}
+}
+
+func (iter *cacheMissIterator) Iterate() bool {
+	return iter.IterateWithContext(context.Background())
+}
+
+func (iter *cacheMissIterator) IterateWithContext(ctx context.Context) bool {
+	for iterateWithContext(ctx, iter.BucketIterator) {
+		var lf = iter.BucketIterator.Current()
+		// Files of zero size are left for the FileManager to drop.
+		if lf.Size == 0 || !iter.cache.lookup(lf) {
+			return true
+		}
+		select {
+		case iter.hits <- lf:
+		case <-ctx.Done():
+			iter.cache.unpin(lf)
+			return false
+		case <-iter.done:
+			iter.cache.unpin(lf)
+			return false
+		}
+	}
+	return false
+}
+
+// Ack passes acknowledgements of downloaded files to the source.
+func (iter *cacheMissIterator) Ack(lf LogFile) error {
+	if ack, ok := iter.BucketIterator.(Acknowledger); ok {
+		return ack.Ack(lf)
+	}
+	return nil
+}
+
+// cachedFile is a reader of a cache entry.
+type cachedFile struct {
+	*os.File
+	logFile LogFile
+}
+
+// cachingReader copies a downloaded file into the cache as it is read.
+type cachingReader struct {
+	io.Reader
+	logFile LogFile
+	file    *os.File
+	err     error
+	eof     bool
+}
+
+func (r *cachingReader) Read(b []byte) (int, error) {
+	var n, e = r.Reader.Read(b)
+	if n > 0 && r.err == nil {
+		_, r.err = r.file.Write(b[:n])
+	}
+	if e == io.EOF {
+		r.eof = true
+	}
+	return n, e
+}
+
+// CachingFileManager implements the FileManager interface by serving files
+// from a FileCache when they are present and fetching the rest with the
+// FileManager produced by the FetchPolicy. Files that are fetched are added
+// to the cache once they have been read to the end. Only the files of a
+// FetchPolicy that produces a SourceFileManager, such as those of this
+// package, are added to the cache.
+//
+// Cached files are found while the fetching manager iterates over the files
+// that it needs, so they are served in between the fetched files rather
+// than in the order of the BucketIterator. A Get that returns a cached file
+// while a fetch is in progress leaves the fetch to complete in the
+// background and its result is returned by a later Get.
+type CachingFileManager struct {
+	Cache          *FileCache
+	BucketIterator BucketIterator
+	FetchPolicy    func(BucketIterator) FileManager
+
+	once     sync.Once
+	misses   *cacheMissIterator
+	manager  FileManager
+	fetching chan fetchResult
+	closed   sync.Once
+	acks     ackErrors
+}
+
+// fetchResult is the outcome of a Get of the fetching manager.
+type fetchResult struct {
+	r io.Reader
+	e error
+}
+
+func (f *CachingFileManager) init() {
+	f.misses = &cacheMissIterator{
+		BucketIterator: f.BucketIterator,
+		cache:          f.Cache,
+		hits:           make(chan LogFile, cacheHitBuffer),
+		done:           make(chan struct{}),
+	}
+	f.manager = f.FetchPolicy(f.misses)
+}
+
+// Get a reader for the next file from the cache or, if no cached file is
+// waiting, from the fetching manager.
+func (f *CachingFileManager) Get() (io.Reader, error) {
+	return f.GetWithContext(context.Background())
+}
+
+// GetWithContext is a variant of Get that passes the context to the
+// fetching manager if it is a ContextFileManager.
+func (f *CachingFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
+	f.once.Do(f.init)
+	return f.get(ctx)
+}
+
+// fetch gets the next file of the fetching manager. The context is
+// cancelled when the CachingFileManager is closed.
+func (f *CachingFileManager) fetch(ctx context.Context) (io.Reader, error) {
+	if cfm, ok := f.manager.(ContextFileManager); ok {
+		return cfm.GetWithContext(ctx)
+	}
+	return f.manager.Get()
+}
+
+// get serves a cached file or the result of the fetching manager,
+// whichever is ready first. The fetch runs in the background so that
+// cached files found by the fetching manager are served while it waits
+// on a download, and so that the iteration is never blocked on a full
+// buffer of cached files.
+func (f *CachingFileManager) get(ctx context.Context) (io.Reader, error) {
+	if e := f.acks.take(); e != nil {
+		return nil, e
+	}
+	select {
+	case lf := <-f.misses.hits:
+		return f.openHit(lf)
+	default:
+	}
+	if f.fetching == nil {
+		var fetching = make(chan fetchResult, 1)
+		var fetchCtx, cancel = context.WithCancel(ctx)
+		go func() {
+			defer cancel()
+			go func() {
+				select {
+				case <-f.misses.done:
+					cancel()
+				case <-fetchCtx.Done():
+				}
+			}()
+			var r, e = f.fetch(fetchCtx)
+			fetching <- fetchResult{r: r, e: e}
+		}()
+		f.fetching = fetching
+	}
+	select {
+	case lf := <-f.misses.hits:
+		return f.openHit(lf)
+	case result := <-f.fetching:
+		f.fetching = nil
+		if result.r != nil {
+			return f.cacheMiss(result.r), nil
+		}
+		if result.e != nil {
+			return nil, result.e
+		}
+	}
+	// Cached files may have been found while the fetching manager
+	// reached the end of the iterator.
+	select {
+	case lf := <-f.misses.hits:
+		return f.openHit(lf)
+	default:
+		return nil, nil
+	}
+}
+
+func (f *CachingFileManager) openHit(lf LogFile) (io.Reader, error) {
+	var file, e = os.Open(f.Cache.path(lf))
+	if e != nil {
+		f.Cache.unpin(lf)
+		return nil, &LogFileError{LogFile: lf, Err: e}
+	}
+	return &cachedFile{File: file, logFile: lf}, nil
+}
+
+// Source returns the LogFile from which a reader was served, whether it
+// came from the cache or from the fetching manager.
+func (f *CachingFileManager) Source(r io.Reader) (LogFile, bool) {
+	f.once.Do(f.init)
+	switch file := r.(type) {
+	case *cachedFile:
+		return file.logFile, true
+	case *cachingReader:
+		return file.logFile, true
+	}
+	if sfm, ok := f.manager.(SourceFileManager); ok {
+		return sfm.Source(r)
+	}
+	return LogFile{}, false
+}
+
+func (f *CachingFileManager) cacheMiss(r io.Reader) io.Reader {
+	var sfm, ok = f.manager.(SourceFileManager)
+	if !ok {
+		return r
+	}
+	lf, ok := sfm.Source(r)
+	if !ok {
+		return r
+	}
+	// Caching is best effort so the file is still served if it
+	// cannot be added to the cache.
+	var file, e = f.Cache.create()
+	if e != nil {
+		return r
+	}
+	return &cachingReader{Reader: r, logFile: lf, file: file}
+}
+
+// Put returns a consumed reader. Cached files are closed and acknowledged
+// if the BucketIterator is an Acknowledger, with an error doing so returned
+// by the next Get. Fetched files that were read to
+// the end are added to the cache before they are returned to the fetching
+// manager.
+func (f *CachingFileManager) Put(r io.Reader) {
+	f.once.Do(f.init)
+	switch file := r.(type) {
+	case *cachedFile:
+		_ = file.Close()
+		f.Cache.unpin(file.logFile)
+		f.acks.ack(f.BucketIterator, file.logFile)
+	case *cachingReader:
+		var e = file.file.Close()
+		if file.eof && file.err == nil && e == nil {
+			_ = f.Cache.commit(file.logFile, file.file.Name())
+		} else {
+			_ = os.Remove(file.file.Name())
+		}
+		f.manager.Put(file.Reader)
+	default:
+		f.manager.Put(r)
+	}
+}
+
+// Close closes the fetching manager, if it is an io.Closer, and releases
+// any cached files that were not served. A fetch in progress is cancelled
+// first if the fetching manager is a ContextFileManager.
+func (f *CachingFileManager) Close() error {
+	f.once.Do(f.init)
+	// Closing done stops the iteration of the fetching manager and
+	// cancels a fetch left running by Get. The fetch is then waited on
+	// so that the fetching manager is not closed while in use.
+	f.closed.Do(func() { close(f.misses.done) })
+	if f.fetching != nil {
+		var result = <-f.fetching
+		f.fetching = nil
+		if closer, ok := result.r.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+	var e error
+	if closer, ok := f.manager.(io.Closer); ok {
+		e = closer.Close()
+	}
+	for {
+		select {
+		case lf := <-f.misses.hits:
+			f.Cache.unpin(lf)
+			continue
+		default:
+		}
+		break
+	}
+	return e
+}
+
+// NewCachePolicy implements the signature required for the
+// BucketIteratorReader.FetchPolicy by wrapping another policy such
+// that files in the cache are served without being fetched.
+func NewCachePolicy(cache *FileCache, policy func(BucketIterator) FileManager) func(BucketIterator) FileManager {
+	return func(iter BucketIterator) FileManager {
+		return &CachingFileManager{
+			Cache:          cache,
+			BucketIterator: iter,
+			FetchPolicy:    policy,
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package vpcflow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readLines(t *testing.T, r *BucketIteratorReader) []string {
+	var text, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	var lines = strings.Split(strings.TrimSpace(string(text)), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func cacheEntries(t *testing.T, dir string) []string {
+	var infos, err = ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestCachingFileManager(t *testing.T) {
+	var name = func(hash string) string {
+		return testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_" + hash + ".log.gz"
+	}
+	var root = writeTestTree(t, map[string]string{
+		name("a"): "a\n",
+		name("b"): "b\n",
+	})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+
+	var lines = readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	})
+	assert.Equal(t, []string{"a", "b"}, lines)
+	assert.Equal(t, int64(0), cache.Hits())
+	assert.Equal(t, int64(2), cache.Misses())
+	assert.Len(t, cacheEntries(t, dir), 2)
+
+	// Cached files must not be read from the source again.
+	for _, hash := range []string{"a", "b"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name(hash))), []byte("not gzip"), 0600))
+	}
+	var added = writeTestTree(t, map[string]string{name("c"): "c\n"})
+	defer os.RemoveAll(added)
+	assert.Nil(t, os.Rename(filepath.Join(added, filepath.FromSlash(name("c"))), filepath.Join(root, filepath.FromSlash(name("c")))))
+
+	lines = readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	})
+	assert.Equal(t, []string{"a", "b", "c"}, lines)
+	assert.Equal(t, int64(2), cache.Hits())
+	assert.Equal(t, int64(3), cache.Misses())
+	assert.Len(t, cacheEntries(t, dir), 3)
+}
+
+func TestCachingFileManagerPartialRead(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "content\n",
+	})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+
+	var fm = NewCachePolicy(cache, NewLocalFilePolicy())(&DirectoryBucketIterator{Root: root})
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	var b = make([]byte, 3)
+	_, err = r.Read(b)
+	assert.Nil(t, err)
+	fm.Put(r)
+	assert.Empty(t, cacheEntries(t, dir), "partially read file was cached")
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+	assert.Nil(t, fm.(*CachingFileManager).Close())
+}
+
+func TestFileCachePrune(t *testing.T) {
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir, MaxBytes: 2, MaxAge: time.Hour}
+	var add = func(hash string, age time.Duration) LogFile {
+		var lf = LogFile{Bucket: "bucket", Key: "key", Hash: hash}
+		var file, err = cache.create()
+		assert.Nil(t, err)
+		_, _ = file.WriteString("x")
+		_ = file.Close()
+		var modified = time.Now().Add(-age)
+		assert.Nil(t, os.Chtimes(file.Name(), modified, modified))
+		assert.Nil(t, cache.commit(lf, file.Name()))
+		return lf
+	}
+	var cached = func(lf LogFile) bool {
+		var _, err = os.Stat(cache.path(lf))
+		return err == nil
+	}
+
+	var a = add("a", 3*time.Minute)
+	var b = add("b", 2*time.Minute)
+	assert.True(t, cache.lookup(a))
+	var c = add("c", time.Minute)
+	// The oldest entry is pinned so the next oldest is removed.
+	assert.True(t, cached(a))
+	assert.False(t, cached(b))
+	assert.True(t, cached(c))
+	cache.unpin(a)
+	var d = add("d", 0)
+	assert.False(t, cached(a))
+	assert.True(t, cached(c))
+	assert.True(t, cached(d))
+
+	var expired = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(cache.path(c), expired, expired))
+	assert.False(t, cache.lookup(c))
+	assert.False(t, cached(c))
+	assert.True(t, cache.lookup(d))
+	assert.Equal(t, int64(2), cache.Hits())
+	assert.Equal(t, int64(1), cache.Misses())
+}
+
+func TestFileCacheLeastRecentlyUsed(t *testing.T) {
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir, MaxBytes: 2, MaxAge: time.Hour}
+	var add = func(c *FileCache, hash string, age time.Duration) LogFile {
+		var lf = LogFile{Bucket: "bucket", Key: "key", Hash: hash}
+		var file, err = c.create()
+		assert.Nil(t, err)
+		_, _ = file.WriteString("x")
+		_ = file.Close()
+		var modified = time.Now().Add(-age)
+		assert.Nil(t, os.Chtimes(file.Name(), modified, modified))
+		assert.Nil(t, c.commit(lf, file.Name()))
+		return lf
+	}
+	var cached = func(lf LogFile) bool {
+		var _, err = os.Stat(cache.path(lf))
+		return err == nil
+	}
+
+	var a = add(cache, "a", 3*time.Minute)
+	var b = add(cache, "b", 2*time.Minute)
+	// Using the oldest entry makes the other the least recently used.
+	assert.True(t, cache.lookup(a))
+	cache.unpin(a)
+	var c = add(cache, "c", 0)
+	assert.True(t, cached(a))
+	assert.False(t, cached(b))
+	assert.True(t, cached(c))
+
+	// Entries left by a previous run are indexed in the order they were
+	// added and expired entries are kept until the cache is pruned.
+	var expired = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(cache.path(a), expired, expired))
+	var next = &FileCache{Dir: dir, MaxBytes: 3, MaxAge: time.Hour}
+	var d = add(next, "d", time.Minute)
+	assert.True(t, cached(a), "cache was pruned while within its limits")
+	assert.Equal(t, int64(3), next.total)
+	var e = add(next, "e", 0)
+	assert.False(t, cached(a))
+	assert.True(t, cached(c))
+	assert.True(t, cached(d))
+	assert.True(t, cached(e))
+	assert.Equal(t, int64(3), next.total)
+}
+
+func TestCachingFileManagerSource(t *testing.T) {
+	var name = func(hash string) string {
+		return testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_" + hash + ".log.gz"
+	}
+	var line = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var root = writeTestTree(t, map[string]string{name("a"): line})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+	var records = func() map[string]int {
+		var iter = &BucketRecordIterator{
+			BucketIterator: &DirectoryBucketIterator{Root: root},
+			FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+		}
+		var sources = make(map[string]int)
+		for iter.Iterate() {
+			var lf, ok = iter.CurrentLogFile()
+			assert.True(t, ok, "record was not attributed to a file")
+			sources[lf.Key] = sources[lf.Key] + 1
+		}
+		assert.Nil(t, iter.Close())
+		return sources
+	}
+
+	assert.Equal(t, map[string]int{name("a"): 1}, records())
+	var added = writeTestTree(t, map[string]string{name("b"): line + line})
+	defer os.RemoveAll(added)
+	assert.Nil(t, os.Rename(filepath.Join(added, filepath.FromSlash(name("b"))), filepath.Join(root, filepath.FromSlash(name("b")))))
+	// The first file is served from the cache and the second is fetched.
+	assert.Equal(t, map[string]int{name("a"): 1, name("b"): 2}, records())
+	assert.Equal(t, int64(1), cache.Hits())
+	assert.Equal(t, int64(2), cache.Misses())
+}
+
+// failingFileManager exhausts its iterator and then fails.
+type failingFileManager struct {
+	iter BucketIterator
+	err  error
+}
+
+func (f *failingFileManager) Get() (io.Reader, error) {
+	for f.iter.Iterate() {
+	}
+	return nil, f.err
+}
+
+func (f *failingFileManager) Put(r io.Reader) {}
+
+func TestCachingFileManagerFetchError(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "a\n",
+	})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+	assert.Equal(t, []string{"a"}, readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	}))
+
+	var fetchErr = errors.New("fetch failed")
+	var fm = NewCachePolicy(cache, func(iter BucketIterator) FileManager {
+		return &failingFileManager{iter: iter, err: fetchErr}
+	})(&DirectoryBucketIterator{Root: root})
+	// Both the fetch error and the cached file must be returned.
+	var served, failed bool
+	for attempt := 0; attempt < 3 && !(served && failed); attempt = attempt + 1 {
+		var r, err = fm.Get()
+		if err != nil {
+			assert.Equal(t, fetchErr, err)
+			failed = true
+			continue
+		}
+		if r != nil {
+			var text, err = ioutil.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, "a\n", string(text))
+			fm.Put(r)
+			served = true
+		}
+	}
+	assert.True(t, failed, "fetch error was not returned")
+	assert.True(t, served, "cached file was not served")
+	assert.Nil(t, fm.(*CachingFileManager).Close())
+	assert.Empty(t, cache.pinned)
+}
+
+// blockingFileManager exhausts its iterator and then waits for its
+// context to be done.
+type blockingFileManager struct {
+	iter BucketIterator
+}
+
+func (f *blockingFileManager) Get() (io.Reader, error) {
+	return f.GetWithContext(context.Background())
+}
+
+func (f *blockingFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
+	for iterateWithContext(ctx, f.iter) {
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *blockingFileManager) Put(r io.Reader) {}
+
+func TestCachingFileManagerCloseCancelsFetch(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "a\n",
+	})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+	assert.Equal(t, []string{"a"}, readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	}))
+
+	var fm = NewCachePolicy(cache, func(iter BucketIterator) FileManager {
+		return &blockingFileManager{iter: iter}
+	})(&DirectoryBucketIterator{Root: root})
+	// The cached file is served while the fetch waits.
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	fm.Put(r)
+
+	var done = make(chan interface{})
+	go func() {
+		assert.Nil(t, fm.(*CachingFileManager).Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not cancel the fetch")
+	}
+	assert.Empty(t, cache.pinned)
+}
+
+func TestCachingFileManagerAckError(t *testing.T) {
+	var name = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz"
+	var root = writeTestTree(t, map[string]string{name: "a\n"})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+	assert.Equal(t, []string{"a"}, readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	}))
+
+	var ackErr = errors.New("ack failed")
+	var iter = &ackingBucketIterator{BucketIterator: &DirectoryBucketIterator{Root: root}, err: ackErr}
+	var fm = NewCachePolicy(cache, NewLocalFilePolicy())(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	assert.IsType(t, &cachedFile{}, r)
+	fm.Put(r)
+	assert.Equal(t, []string{name}, iter.acked)
+	// The failed acknowledgement of the cached file is returned by the
+	// next Get.
+	_, err = fm.Get()
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, ackErr, err.(*AckError).Err)
+	}
+	assert.Nil(t, fm.(*CachingFileManager).Close())
+}
+
+func TestCacheMissIteratorBounded(t *testing.T) {
+	var name = func(hash string) string {
+		return testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_" + hash + ".log.gz"
+	}
+	var root = writeTestTree(t, map[string]string{
+		name("a"): "a\n",
+		name("b"): "b\n",
+	})
+	defer os.RemoveAll(root)
+	var dir, _ = ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+	var cache = &FileCache{Dir: dir}
+	assert.Equal(t, []string{"a", "b"}, readLines(t, &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewCachePolicy(cache, NewLocalFilePolicy()),
+	}))
+
+	var iter = &cacheMissIterator{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		cache:          cache,
+		hits:           make(chan LogFile, 1),
+		done:           make(chan struct{}),
+	}
+	var result = make(chan bool)
+	go func() { result <- iter.Iterate() }()
+	select {
+	case <-result:
+		t.Fatal("iteration did not wait for the cached files to be served")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Len(t, iter.hits, 1)
+	close(iter.done)
+	assert.False(t, <-result)
+	cache.unpin(<-iter.hits)
+	assert.Empty(t, cache.pinned)
+}
@@ -0,0 +1,100 @@
+package vpcflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Checkpoint is the exportable position of a BucketStateIterator.
+// Because S3 lists keys in lexicographic order, the last key that
+// was processed is enough to resume listing from the same place.
+type Checkpoint struct {
+	// Bucket is the S3 bucket being iterated.
+	Bucket string `json:"bucket"`
+	// Prefix is the prefix of the iterated keys.
+	Prefix string `json:"prefix"`
+	// LastKey is the key of the last LogFile that was processed.
+	LastKey string `json:"lastKey"`
+}
+
+// CheckpointStore persists a Checkpoint between runs of a job.
+type CheckpointStore interface {
+	// Load the most recently saved checkpoint. A zero value Checkpoint
+	// and a nil error are returned if nothing has been saved.
+	Load() (Checkpoint, error)
+	// Save a checkpoint, replacing any previously saved.
+	Save(Checkpoint) error
+}
+
+// FileCheckpointStore implements the CheckpointStore interface by
+// keeping a checkpoint as JSON in a local file.
+type FileCheckpointStore struct {
+	Path string
+}
+
+// Load reads the checkpoint from the file.
+func (s FileCheckpointStore) Load() (Checkpoint, error) {
+	var cp Checkpoint
+	var b, err = ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err = json.Unmarshal(b, &cp); err != nil {
+		return Checkpoint{}, fmt.Errorf("error reading checkpoint %s. %s", s.Path, err)
+	}
+	return cp, nil
+}
+
+// Save writes the checkpoint to the file. The content is written to a
+// temporary file first and then renamed so that a crash during Save does
+// not leave a partial checkpoint behind.
+func (s FileCheckpointStore) Save(cp Checkpoint) error {
+	var b, err = json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// NewResumedBucketIterator creates a BucketStateIterator that begins after
+// the checkpoint loaded from the store and tracks acknowledgements so that
+// its Checkpoint may be saved. If the store is empty then the
+// iterator begins at the start of the prefix. An error is returned if the
+// saved checkpoint belongs to a different bucket or prefix.
+func NewResumedBucketIterator(q s3iface.S3API, bucket string, prefix string, store CheckpointStore) (*BucketStateIterator, error) {
+	var cp, err = store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if cp.LastKey != "" && (cp.Bucket != bucket || cp.Prefix != prefix) {
+		return nil, fmt.Errorf("checkpoint for %s/%s cannot resume %s/%s", cp.Bucket, cp.Prefix, bucket, prefix)
+	}
+	return &BucketStateIterator{
+		Bucket:     bucket,
+		Prefix:     prefix,
+		Queue:      q,
+		StartAfter: cp.LastKey,
+		TrackAcks:  true,
+	}, nil
+}
@@ -0,0 +1,257 @@
+package vpcflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "vpcflow")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var store = FileCheckpointStore{Path: filepath.Join(dir, "checkpoint.json")}
+
+	cp, err := store.Load()
+	assert.Nil(t, err, "missing checkpoint should not be an error")
+	assert.Equal(t, Checkpoint{}, cp)
+
+	var expected = Checkpoint{Bucket: "testbucket", Prefix: "AWSLogs/", LastKey: "AWSLogs/key"}
+	assert.Nil(t, store.Save(expected))
+	cp, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, cp)
+
+	expected.LastKey = "AWSLogs/key2"
+	assert.Nil(t, store.Save(expected))
+	cp, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, cp)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary files were left behind")
+}
+
+func TestFileCheckpointStoreCorrupt(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "vpcflow")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var store = FileCheckpointStore{Path: filepath.Join(dir, "checkpoint.json")}
+	assert.Nil(t, ioutil.WriteFile(store.Path, []byte("{"), 0600))
+
+	_, err = store.Load()
+	assert.NotNil(t, err)
+}
+
+func TestBucketStateIteratorCheckpoint(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var bi = BucketStateIterator{
+		Bucket:    "testbucket",
+		Prefix:    "AWSLogs/",
+		Queue:     queue,
+		TrackAcks: true,
+	}
+	var key1 = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_1.log.gz"
+	var key2 = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_2.log.gz"
+	var output = s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String(key1), Size: aws.Int64(100)},
+			{Key: aws.String(key2), Size: aws.Int64(100)},
+		},
+	}
+
+	queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&output, nil)
+
+	assert.Equal(t, Checkpoint{Bucket: "testbucket", Prefix: "AWSLogs/"}, bi.Checkpoint())
+	assert.True(t, bi.Iterate())
+	var lf1 = bi.Current()
+	assert.Equal(t, "", bi.Checkpoint().LastKey, "listing a file should not advance the checkpoint")
+	assert.True(t, bi.Iterate())
+	var lf2 = bi.Current()
+	assert.False(t, bi.Iterate())
+	assert.Equal(t, "", bi.Checkpoint().LastKey)
+
+	assert.Nil(t, bi.Ack(lf2))
+	assert.Equal(t, "", bi.Checkpoint().LastKey, "checkpoint skipped an unacknowledged file")
+	assert.Nil(t, bi.Ack(lf1))
+	assert.Equal(t, key2, bi.Checkpoint().LastKey)
+	assert.Equal(t, key1, lf1.Key)
+}
+
+func TestBucketStateIteratorUntracked(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var bi = BucketStateIterator{Bucket: "testbucket", Prefix: "AWSLogs/", Queue: queue}
+	var key = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_1.log.gz"
+	queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&s3.ListObjectsV2Output{
+		Contents: []*s3.Object{{Key: aws.String(key), Size: aws.Int64(100)}},
+	}, nil)
+
+	// Keys are not held for iterators whose files are never acknowledged.
+	assert.True(t, bi.Iterate())
+	assert.Empty(t, bi.listed)
+	assert.Nil(t, bi.Ack(bi.Current()))
+	assert.Empty(t, bi.acked)
+	assert.Equal(t, "", bi.Checkpoint().LastKey)
+}
+
+func TestBucketStateIteratorCheckpointWhilePrefetching(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var body = gzipString("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n")
+	var keys []string
+	var contents []*s3.Object
+	for x := 0; x < 5; x = x + 1 {
+		var key = fmt.Sprintf("AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_%d.log.gz", x)
+		keys = append(keys, key)
+		contents = append(contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(body)))})
+	}
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).Return(&s3.ListObjectsV2Output{Contents: contents}, nil)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, _ *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: aws.Int64(int64(len(body))),
+			}, nil
+		},
+	).Times(len(keys))
+
+	var bi = &BucketStateIterator{Bucket: "testbucket", Prefix: "AWSLogs/", Queue: queue, TrackAcks: true}
+	var fm = NewOrderedPrefetchPolicy(queue, 1<<20, 5)(bi)
+	defer fm.(io.Closer).Close()
+
+	// Checkpoints are taken concurrently with the prefetch that lists and
+	// downloads files ahead of the consumer.
+	var stop = make(chan struct{})
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = bi.Checkpoint()
+			}
+		}
+	}()
+
+	var first, err = fm.Get()
+	assert.Nil(t, err)
+	// Give the prefetch time to list and fetch every remaining file.
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "", bi.Checkpoint().LastKey, "checkpoint advanced past a file that was not consumed")
+	fm.Put(first)
+	assert.Equal(t, keys[0], bi.Checkpoint().LastKey)
+	for x := 1; x < len(keys); x = x + 1 {
+		var r, e = fm.Get()
+		assert.Nil(t, e)
+		assert.Equal(t, keys[x-1], bi.Checkpoint().LastKey)
+		fm.Put(r)
+		assert.Equal(t, keys[x], bi.Checkpoint().LastKey)
+	}
+	close(stop)
+	<-done
+}
+
+func TestBucketStateIteratorCheckpointSkippedFiles(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var body = gzipString("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n")
+	var truncated = body[:len(body)-8]
+	var keys []string
+	var contents []*s3.Object
+	for x := 0; x < 3; x = x + 1 {
+		var key = fmt.Sprintf("AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_%d.log.gz", x)
+		keys = append(keys, key)
+		contents = append(contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(body)))})
+	}
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).Return(&s3.ListObjectsV2Output{Contents: contents}, nil)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+			switch aws.StringValue(input.Key) {
+			case keys[0]:
+				return nil, errors.New("")
+			case keys[1]:
+				return &s3.GetObjectOutput{
+					Body:          ioutil.NopCloser(bytes.NewReader(truncated)),
+					ContentLength: aws.Int64(int64(len(truncated))),
+				}, nil
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: aws.Int64(int64(len(body))),
+			}, nil
+		},
+	).Times(len(keys))
+
+	// Files that fail to download or read are acknowledged once they are
+	// skipped so that the checkpoint is not held back by them.
+	var bi = &BucketStateIterator{Bucket: "testbucket", Prefix: "AWSLogs/", Queue: queue, TrackAcks: true}
+	var collector ErrorCollector
+	var r = &BucketIteratorReader{
+		BucketIterator:  bi,
+		FetchPolicy:     NewOrderedPrefetchPolicy(queue, 1<<20, 1),
+		ReadErrorPolicy: SkipFileOnReadError,
+		OnReadError:     collector.Collect,
+	}
+	var _, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Len(t, collector.Files(), 2)
+	assert.Equal(t, keys[2], bi.Checkpoint().LastKey)
+}
+
+type memoryCheckpointStore struct {
+	cp Checkpoint
+}
+
+func (s *memoryCheckpointStore) Load() (Checkpoint, error) { return s.cp, nil }
+func (s *memoryCheckpointStore) Save(cp Checkpoint) error  { s.cp = cp; return nil }
+
+func TestNewResumedBucketIterator(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var lastKey = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_1.log.gz"
+	var nextKey = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_2.log.gz"
+	var store = &memoryCheckpointStore{cp: Checkpoint{Bucket: "testbucket", Prefix: "AWSLogs/", LastKey: lastKey}}
+
+	queue.EXPECT().ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:     aws.String("testbucket"),
+		Prefix:     aws.String("AWSLogs/"),
+		StartAfter: aws.String(lastKey),
+	}).Return(&s3.ListObjectsV2Output{
+		Contents: []*s3.Object{{Key: aws.String(nextKey), Size: aws.Int64(100)}},
+	}, nil)
+
+	var bi, err = NewResumedBucketIterator(queue, "testbucket", "AWSLogs/", store)
+	assert.Nil(t, err)
+	assert.True(t, bi.Iterate())
+	assert.Equal(t, nextKey, bi.Current().Key)
+	assert.Nil(t, bi.Ack(bi.Current()))
+	assert.Nil(t, store.Save(bi.Checkpoint()))
+	assert.Equal(t, nextKey, store.cp.LastKey)
+
+	_, err = NewResumedBucketIterator(queue, "otherbucket", "AWSLogs/", store)
+	assert.NotNil(t, err, "checkpoint from another bucket should not be used")
+	_, err = NewResumedBucketIterator(queue, "testbucket", "AWSLogs/", &memoryCheckpointStore{})
+	assert.Nil(t, err, "empty store should start from the beginning")
+}
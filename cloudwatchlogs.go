@@ -0,0 +1,118 @@
+package vpcflow
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// CloudWatchLogsReader implements io.ReadCloser by paging through the
+// events of a flow log published to CloudWatch Logs. Each event is one
+// flow log record so the content is the same stream of lines that the
+// BucketIteratorReader produces for files in S3 and may be given to the
+// ReaderDigester or DOTConverter.
+//
+// AWS names the log streams of a flow log after the network interface they
+// record. If InterfaceIDs is set then only the streams of those interfaces
+// are read, one interface at a time. Otherwise, all streams of the log group
+// are read. Start and End, if set, are an inclusive bound on the time at
+// which the events were captured.
+type CloudWatchLogsReader struct {
+	// Queue is any implementation of the CloudWatchLogsAPI.
+	Queue        cloudwatchlogsiface.CloudWatchLogsAPI
+	LogGroupName string
+	InterfaceIDs []string
+	Start        time.Time
+	End          time.Time
+	// Format is the log format of the flow log. CloudWatch Logs does
+	// not record the format with the events so a header line is written
+	// before the content if the format is not the DefaultFormat.
+	Format Format
+
+	initialized bool
+	exhausted   bool
+	prefixes    []*string
+	nextToken   *string
+	buffer      bytes.Buffer
+}
+
+// Read flow log lines from the log group.
+func (r *CloudWatchLogsReader) Read(b []byte) (int, error) {
+	if !r.initialized {
+		r.init()
+	}
+	for r.buffer.Len() < 1 {
+		if r.exhausted {
+			return 0, io.EOF
+		}
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buffer.Read(b)
+}
+
+func (r *CloudWatchLogsReader) init() {
+	r.initialized = true
+	r.prefixes = []*string{nil}
+	if len(r.InterfaceIDs) > 0 {
+		r.prefixes = r.prefixes[:0]
+		for _, eni := range r.InterfaceIDs {
+			r.prefixes = append(r.prefixes, aws.String(eni))
+		}
+	}
+	if len(r.Format) > 0 && !r.Format.Equal(DefaultFormat) {
+		_, _ = r.buffer.WriteString(r.Format.String() + "\n")
+	}
+}
+
+// fetch loads the next page of events into the buffer. Once the pages of
+// an interface are exhausted, it moves on to the next interface.
+func (r *CloudWatchLogsReader) fetch() error {
+	var input = &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:        aws.String(r.LogGroupName),
+		LogStreamNamePrefix: r.prefixes[0],
+		NextToken:           r.nextToken,
+	}
+	if !r.Start.IsZero() {
+		input.StartTime = aws.Int64(toMillis(r.Start))
+	}
+	if !r.End.IsZero() {
+		input.EndTime = aws.Int64(toMillis(r.End))
+	}
+	var result, err = r.Queue.FilterLogEvents(input)
+	if err != nil {
+		return fmt.Errorf("error getting log events. %s", err)
+	}
+	for _, event := range result.Events {
+		var message = strings.TrimRight(aws.StringValue(event.Message), "\n")
+		if message == "" {
+			continue
+		}
+		_, _ = r.buffer.WriteString(message + "\n")
+	}
+	r.nextToken = result.NextToken
+	if r.nextToken == nil {
+		r.prefixes = r.prefixes[1:]
+		r.exhausted = len(r.prefixes) < 1
+	}
+	return nil
+}
+
+// Close the reader. The reader may not be used again after calling Close().
+func (r *CloudWatchLogsReader) Close() error {
+	r.initialized = true
+	r.exhausted = true
+	r.buffer.Reset()
+	return nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,124 @@
+package vpcflow
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCloudWatchLogs serves pages of events keyed by the stream prefix
+// and records the input of every call.
+type fakeCloudWatchLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	pages  map[string][][]string
+	err    error
+	inputs []*cloudwatchlogs.FilterLogEventsInput
+}
+
+func (c *fakeCloudWatchLogs) FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	c.inputs = append(c.inputs, input)
+	if c.err != nil {
+		return nil, c.err
+	}
+	var pages = c.pages[aws.StringValue(input.LogStreamNamePrefix)]
+	var page = 0
+	if input.NextToken != nil {
+		page = len(aws.StringValue(input.NextToken))
+	}
+	var output = &cloudwatchlogs.FilterLogEventsOutput{}
+	for _, message := range pages[page] {
+		output.Events = append(output.Events, &cloudwatchlogs.FilteredLogEvent{Message: aws.String(message)})
+	}
+	if page+1 < len(pages) {
+		output.NextToken = aws.String(strings.Repeat("x", page+1))
+	}
+	return output, nil
+}
+
+var testCloudWatchLines = []string{
+	"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK",
+	"2 123456789010 eni-abc123de 172.31.9.69 172.31.9.12 49761 3389 6 20 4249 1418530010 1418530070 REJECT OK",
+	"2 123456789010 eni-1a2b3c4d - - - - - - - 1431280876 1431280934 - NODATA",
+}
+
+func TestCloudWatchLogsReader(t *testing.T) {
+	var queue = &fakeCloudWatchLogs{
+		pages: map[string][][]string{
+			"eni-abc123de": {{testCloudWatchLines[0]}, {}, {testCloudWatchLines[1] + "\n"}},
+			"eni-1a2b3c4d": {{testCloudWatchLines[2]}},
+		},
+	}
+	var start = time.Unix(1418530000, 0)
+	var end = time.Unix(1431280934, 500*int64(time.Millisecond))
+	var r = &CloudWatchLogsReader{
+		Queue:        queue,
+		LogGroupName: "flowlogs",
+		InterfaceIDs: []string{"eni-abc123de", "eni-1a2b3c4d"},
+		Start:        start,
+		End:          end,
+	}
+
+	var content, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join(testCloudWatchLines, "\n")+"\n", string(content))
+	assert.Nil(t, r.Close())
+
+	assert.Len(t, queue.inputs, 4)
+	for _, input := range queue.inputs {
+		assert.Equal(t, "flowlogs", aws.StringValue(input.LogGroupName))
+		assert.Equal(t, int64(1418530000000), aws.Int64Value(input.StartTime))
+		assert.Equal(t, int64(1431280934500), aws.Int64Value(input.EndTime))
+	}
+	assert.Equal(t, "eni-1a2b3c4d", aws.StringValue(queue.inputs[3].LogStreamNamePrefix))
+	assert.Nil(t, queue.inputs[3].NextToken)
+}
+
+func TestCloudWatchLogsReaderAllStreams(t *testing.T) {
+	var queue = &fakeCloudWatchLogs{
+		pages: map[string][][]string{"": {testCloudWatchLines}},
+	}
+	var format = Format{FieldVersion, FieldInterfaceID, FieldSrcAddr, FieldDstAddr, FieldSrcPort, FieldDstPort, FieldProtocol, FieldPackets, FieldBytes, FieldStart, FieldEnd, FieldAction, FieldLogStatus, FieldAccountID}
+	var r = &CloudWatchLogsReader{Queue: queue, LogGroupName: "flowlogs", Format: format}
+
+	var content, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, format.String()+"\n"+strings.Join(testCloudWatchLines, "\n")+"\n", string(content))
+	assert.Len(t, queue.inputs, 1)
+	assert.Nil(t, queue.inputs[0].LogStreamNamePrefix)
+	assert.Nil(t, queue.inputs[0].StartTime)
+	assert.Nil(t, queue.inputs[0].EndTime)
+}
+
+func TestCloudWatchLogsReaderError(t *testing.T) {
+	var r = &CloudWatchLogsReader{Queue: &fakeCloudWatchLogs{err: errors.New("")}, LogGroupName: "flowlogs"}
+	var _, err = r.Read(make([]byte, 10))
+	assert.NotNil(t, err)
+	assert.NotEqual(t, io.EOF, err)
+	assert.Nil(t, r.Close())
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCloudWatchLogsReaderDigest(t *testing.T) {
+	var queue = &fakeCloudWatchLogs{
+		pages: map[string][][]string{"": {testCloudWatchLines[:2], testCloudWatchLines[:2]}},
+	}
+	var d = &ReaderDigester{Reader: &CloudWatchLogsReader{Queue: queue, LogGroupName: "flowlogs"}}
+	var digest, err = d.Digest()
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(digest)
+	assert.Nil(t, err)
+	var lines = strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, line, " 40 8498 ")
+	}
+}
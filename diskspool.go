@@ -0,0 +1,515 @@
+package vpcflow
+
+import (
+	"compress/gzip"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// spoolEntry is an object stored in the spool directory. Entries are
+// pinned while they are downloading, waiting to be read, or being read.
+// Released entries are kept in least recently used order until evicted.
+// The ready channel is closed once the download has finished, after
+// which err is set if it failed.
+type spoolEntry struct {
+	id      string
+	path    string
+	size    int64
+	logFile LogFile
+	refs    int
+	element *list.Element
+	ready   chan struct{}
+	err     error
+}
+
+// spoolFile is a reader of the decompressed content of a spool entry.
+// The file is opened when it is handed to the consumer.
+type spoolFile struct {
+	io.Reader
+	file  *os.File
+	entry *spoolEntry
+}
+
+// DiskFileManager implements the FileManager interface by prefetching
+// objects into files in a spool directory rather than into memory. The
+// total size of the files is bounded by MaxBytes so that prefetching can
+// run far ahead of the consumer without the risk of running out of memory.
+//
+// Spooled files are only opened once they are returned by Get so that the
+// number of open files is bounded by the files being read rather than by
+// the files waiting in the spool. Put closes a file and releases it.
+// Released files remain on disk, and are used again if the same object is
+// produced by the iterator, until the space is needed for new objects. They
+// are then evicted in least recently used order. When the spool is full of
+// files that have not been consumed, prefetching waits for them to be
+// released. Close stops prefetching and removes every file in the spool.
+type DiskFileManager struct {
+	// Context, if set, bounds the lifetime of the background work.
+	Context context.Context
+	// Queue is any implemenation of the S3API and will be used
+	// to download the individual object contents.
+	Queue s3iface.S3API
+	// BucketIterator is the source from which the manager will
+	// pull when deciding what to prefetch.
+	BucketIterator BucketIterator
+	// Lock is used to control concurrency of downloads.
+	Lock sync.Locker
+	// Dir is the spool directory and is created if it does not exist.
+	// If it is not set then a temporary directory is created and is
+	// removed on Close.
+	Dir string
+	// MaxBytes is the size limit of the spool. As with the
+	// PrefetchFileManager, a single object larger than the limit is
+	// still fetched when the spool is otherwise empty.
+	MaxBytes int64
+	// Ready is the channel on which spooled files are placed while
+	// awaiting consumption.
+	Ready chan io.Reader
+	// Observer, if set, receives the outcome of each download and the
+	// changes to the files and disk space held by the manager. If not
+	// set then the Observer of the Context, if any, is used.
+	Observer Observer
+
+	observer   Observer
+	once       sync.Once
+	initErr    error
+	dir        string
+	ownDir     bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	errs       chan error
+	acks       ackErrors
+	downloader *s3manager.Downloader
+	wg         sync.WaitGroup
+	running    sync.WaitGroup
+	lock       sync.Mutex
+	cond       *sync.Cond
+	closed     bool
+	used       int64
+	entries    map[string]*spoolEntry
+	released   *list.List
+}
+
+func (f *DiskFileManager) init() {
+	f.errs = make(chan error, cap(f.Ready)+1)
+	f.entries = make(map[string]*spoolEntry)
+	f.released = list.New()
+	f.cond = sync.NewCond(&f.lock)
+	var parent = f.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	f.ctx, f.cancel = context.WithCancel(parent)
+	f.observer = observerOf(f.Observer, f.Context)
+	f.downloader = s3manager.NewDownloaderWithClient(f.Queue, func(d *s3manager.Downloader) {
+		d.Concurrency = 1
+	})
+	f.dir = f.Dir
+	if f.dir == "" {
+		f.dir, f.initErr = ioutil.TempDir("", "vpcflow")
+		f.ownDir = true
+	} else {
+		f.initErr = os.MkdirAll(f.dir, 0700)
+	}
+}
+
+// Get a spooled file. If prefetch is lagging behind then this call
+// will block until a file is available. If any error was encountered
+// since the last call to Get then it is returned.
+func (f *DiskFileManager) Get() (io.Reader, error) {
+	return f.GetWithContext(context.Background())
+}
+
+// GetWithContext is a variant of Get that returns early with the error
+// of the context if it is done while waiting for a file.
+func (f *DiskFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
+	f.once.Do(f.init)
+	if e := f.acks.take(); e != nil {
+		return nil, e
+	}
+	select {
+	case e := <-f.errs:
+		return nil, e
+	default:
+	}
+	select {
+	case e := <-f.errs:
+		return nil, e
+	case r := <-f.Ready:
+		return f.open(r)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	}
+}
+
+// open prepares a spooled file for reading as it is handed to the
+// consumer. Files that cannot be opened are removed from the spool.
+func (f *DiskFileManager) open(r io.Reader) (io.Reader, error) {
+	var sf, ok = r.(*spoolFile)
+	if !ok {
+		return r, nil
+	}
+	if e := sf.open(); e != nil {
+		f.remove(sf.entry)
+		f.release(sf.entry)
+		return nil, &LogFileError{LogFile: sf.entry.logFile, Err: e}
+	}
+	return sf, nil
+}
+
+// Source returns the LogFile from which a spooled reader was fetched.
+func (f *DiskFileManager) Source(r io.Reader) (LogFile, bool) {
+	var sf, ok = r.(*spoolFile)
+	if !ok {
+		return LogFile{}, false
+	}
+	return sf.entry.logFile, true
+}
+
+// Put closes a file that has been consumed and releases it for eviction.
+// If the BucketIterator is an Acknowledger then the file is acknowledged
+// as consumed and an error doing so is returned by the next Get.
+func (f *DiskFileManager) Put(r io.Reader) {
+	var sf, ok = r.(*spoolFile)
+	if !ok {
+		return
+	}
+	if sf.file != nil {
+		_ = sf.file.Close()
+	}
+	f.release(sf.entry)
+	f.acks.ack(f.BucketIterator, sf.entry.logFile)
+}
+
+// release unpins an entry and, once no reader holds it, makes it the
+// most recently used of the entries that may be evicted.
+func (f *DiskFileManager) release(entry *spoolEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry.refs = entry.refs - 1
+	if entry.refs > 0 {
+		return
+	}
+	if f.entries[entry.id] != entry {
+		// The entry was removed or the spool was closed while the
+		// file was being read.
+		return
+	}
+	entry.element = f.released.PushFront(entry)
+	f.cond.Broadcast()
+}
+
+// remove deletes the file of an entry and frees its space. Readers
+// that still hold the entry release it as usual.
+func (f *DiskFileManager) remove(entry *spoolEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.evict(entry)
+}
+
+// evict deletes the file of an entry and frees its space. The lock must
+// be held.
+func (f *DiskFileManager) evict(entry *spoolEntry) {
+	if f.entries[entry.id] != entry {
+		return
+	}
+	delete(f.entries, entry.id)
+	if entry.element != nil {
+		f.released.Remove(entry.element)
+		entry.element = nil
+	}
+	f.used = f.used - entry.size
+	f.observer.ObserveBuffer(-1, -entry.size)
+	f.cond.Broadcast()
+	if entry.path != "" {
+		_ = os.Remove(entry.path)
+	}
+}
+
+// Close stops prefetching, waits for all background work to end, and
+// removes the spooled files.
+func (f *DiskFileManager) Close() error {
+	f.once.Do(f.init)
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	f.cancel()
+	f.running.Wait()
+	for {
+		select {
+		case _, ok := <-f.Ready:
+			if ok {
+				continue
+			}
+		default:
+		}
+		break
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// Files that are still being read remain readable after they are
+	// removed until the reader closes them.
+	f.observer.ObserveBuffer(-len(f.entries), -f.used)
+	for id, entry := range f.entries {
+		delete(f.entries, id)
+		if entry.path != "" {
+			_ = os.Remove(entry.path)
+		}
+	}
+	f.released.Init()
+	f.used = 0
+	if f.ownDir {
+		return os.RemoveAll(f.dir)
+	}
+	return nil
+}
+
+func (f *DiskFileManager) sendErr(e error) {
+	select {
+	case f.errs <- e:
+	case <-f.ctx.Done():
+	}
+}
+
+func (f *DiskFileManager) send(entry *spoolEntry) {
+	select {
+	case f.Ready <- &spoolFile{entry: entry}:
+	case <-f.ctx.Done():
+		f.release(entry)
+	}
+}
+
+func (sf *spoolFile) open() error {
+	var file, e = os.Open(sf.entry.path)
+	if e != nil {
+		return e
+	}
+	var result io.Reader
+	if isParquet(sf.entry.logFile.Key) {
+		result, e = NewParquetReader(file)
+	} else {
+		result, e = gzip.NewReader(file)
+	}
+	if e != nil {
+		_ = file.Close()
+		return e
+	}
+	sf.Reader = result
+	sf.file = file
+	return nil
+}
+
+// sendWhenReady delivers an entry once its download has finished.
+func (f *DiskFileManager) sendWhenReady(entry *spoolEntry) {
+	defer f.wg.Done()
+	select {
+	case <-entry.ready:
+	case <-f.ctx.Done():
+		f.release(entry)
+		return
+	}
+	if entry.err != nil {
+		// The download of the entry failed so the file is reported in
+		// the same way as it was for the download that was reused.
+		f.release(entry)
+		if f.ctx.Err() == nil {
+			f.sendErr(&LogFileError{LogFile: entry.logFile, Err: entry.err})
+		}
+		return
+	}
+	f.send(entry)
+}
+
+// reuse pins an existing entry for the object, if there is one.
+func (f *DiskFileManager) reuse(id string) *spoolEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var entry, ok = f.entries[id]
+	if !ok {
+		return nil
+	}
+	if entry.element != nil {
+		f.released.Remove(entry.element)
+		entry.element = nil
+	}
+	entry.refs = entry.refs + 1
+	return entry
+}
+
+// reserve waits until there is room in the spool for the file, evicting
+// released files as needed, and then adds a pinned entry for it. It
+// returns nil if the manager is stopped first.
+func (f *DiskFileManager) reserve(lf LogFile, id string) *spoolEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for f.ctx.Err() == nil && f.used != 0 && f.used+lf.Size > f.MaxBytes {
+		var oldest = f.released.Back()
+		if oldest == nil {
+			f.cond.Wait()
+			continue
+		}
+		f.evict(oldest.Value.(*spoolEntry))
+	}
+	if f.ctx.Err() != nil {
+		return nil
+	}
+	f.used = f.used + lf.Size
+	var entry = &spoolEntry{id: id, size: lf.Size, logFile: lf, refs: 1, ready: make(chan struct{})}
+	f.entries[id] = entry
+	f.observer.ObserveBuffer(1, lf.Size)
+	return entry
+}
+
+// discard drops an entry whose download failed.
+func (f *DiskFileManager) discard(entry *spoolEntry, e error) {
+	f.lock.Lock()
+	entry.err = e
+	f.evict(entry)
+	entry.refs = entry.refs - 1
+	f.lock.Unlock()
+	close(entry.ready)
+}
+
+func (f *DiskFileManager) spoolFile(entry *spoolEntry) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	defer f.wg.Done()
+	if e := f.ctx.Err(); e != nil {
+		f.discard(entry, e)
+		return
+	}
+
+	var file, e = ioutil.TempFile(f.dir, "spool")
+	if e != nil {
+		f.discard(entry, e)
+		f.sendErr(&LogFileError{LogFile: entry.logFile, Err: e})
+		return
+	}
+	f.lock.Lock()
+	entry.path = file.Name()
+	f.lock.Unlock()
+	var start = time.Now()
+	n, e := f.downloader.DownloadWithContext(f.ctx, file, &s3.GetObjectInput{
+		Key:    aws.String(entry.logFile.Key),
+		Bucket: aws.String(entry.logFile.Bucket),
+	})
+	var latency = time.Since(start)
+	if f.ctx.Err() == nil {
+		if observer, ok := f.Lock.(DownloadObserver); ok {
+			observer.ObserveDownload(n, latency, e)
+		}
+		f.observer.ObserveFetch(entry.logFile, n, latency, e)
+	}
+	var closeErr = file.Close()
+	if e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		f.discard(entry, e)
+		f.sendErr(&LogFileError{LogFile: entry.logFile, Err: e})
+		return
+	}
+	close(entry.ready)
+	f.send(entry)
+}
+
+// Prefetch starts a loop that consumes from the attached BucketIterator
+// and spools that content before it is needed.
+func (f *DiskFileManager) Prefetch() {
+	f.once.Do(f.init)
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		_ = f.BucketIterator.Close()
+		close(f.Ready)
+		return
+	}
+	f.running.Add(1)
+	f.lock.Unlock()
+	defer f.running.Done()
+
+	// Waiting for space ends when the manager is stopped. The waker
+	// exits with the loop so that it does not outlive the iteration.
+	var exited = make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-f.ctx.Done():
+			f.lock.Lock()
+			f.cond.Broadcast()
+			f.lock.Unlock()
+		case <-exited:
+		}
+	}()
+
+	if f.initErr != nil {
+		f.sendErr(f.initErr)
+	}
+	for f.initErr == nil && f.ctx.Err() == nil && iterateWithContext(f.ctx, f.BucketIterator) {
+		var curr = f.BucketIterator.Current()
+		if curr.Size == 0 {
+			continue
+		}
+		var id = curr.Bucket + "/" + curr.Key
+		if entry := f.reuse(id); entry != nil {
+			f.wg.Add(1)
+			go f.sendWhenReady(entry)
+			continue
+		}
+		var entry = f.reserve(curr, id)
+		if entry == nil {
+			break
+		}
+		f.wg.Add(1)
+		go f.spoolFile(entry)
+	}
+	var e = f.BucketIterator.Close()
+	if e != nil {
+		f.sendErr(e)
+	}
+	f.wg.Wait()
+	close(f.Ready)
+}
+
+// start runs Prefetch in the background such that a Close that follows
+// immediately still waits for it to exit.
+func (f *DiskFileManager) start() {
+	f.once.Do(f.init)
+	f.running.Add(1)
+	go func() {
+		defer f.running.Done()
+		f.Prefetch()
+	}()
+}
+
+// NewDiskSpoolPolicy implements the signature required for the
+// BucketIteratorReader.FetchPolicy by producing a FileManager that
+// prefetches content into files in dir, using at most maxBytes of disk.
+// If dir is empty then a temporary directory is used.
+func NewDiskSpoolPolicy(q s3iface.S3API, dir string, maxBytes int64, maxConcurrent int) func(BucketIterator) FileManager {
+	return func(iter BucketIterator) FileManager {
+		var fm = &DiskFileManager{
+			Queue:          q,
+			BucketIterator: iter,
+			Lock:           &Semaphore{C: make(chan interface{}, maxConcurrent)},
+			Dir:            dir,
+			MaxBytes:       maxBytes,
+			Ready:          make(chan io.Reader, 1024),
+		}
+		fm.start()
+		return fm
+	}
+}
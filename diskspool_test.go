@@ -0,0 +1,337 @@
+package vpcflow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// spoolObjects answers the downloads of the DiskFileManager from the
+// given content and counts the downloads of each key. The number of
+// files in dir is recorded at each download so that the spool size
+// can be checked.
+func spoolObjects(queue *MockS3API, objects map[string][]byte, dir string, downloads map[string]int, spooled *[]int) *gomock.Call {
+	var lock sync.Mutex
+	return queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			var key = aws.StringValue(input.Key)
+			downloads[key] = downloads[key] + 1
+			var files, _ = ioutil.ReadDir(dir)
+			*spooled = append(*spooled, len(files))
+			var content, ok = objects[key]
+			if !ok {
+				return nil, errors.New(s3.ErrCodeNoSuchKey)
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	)
+}
+
+func TestDiskFileManager(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var dir, _ = ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	var content = strings.Repeat("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n", 100)
+	var compressed = gzipString(content)
+	var parquet = newTestParquetFile(t, testParquetRows...)
+	var size = int64(len(parquet))
+	var objects = map[string][]byte{
+		"a.log.gz":      compressed,
+		"b.log.parquet": parquet,
+		"c.log.gz":      compressed,
+	}
+	var downloads = make(map[string]int)
+	var spooled []int
+	var queue = NewMockS3API(ctrl)
+	spoolObjects(queue, objects, dir, downloads, &spooled).AnyTimes()
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a.log.gz", Size: size}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "empty"}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "b.log.parquet", Size: size}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a.log.gz", Size: size}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "c.log.gz", Size: size}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(nil),
+		iter.EXPECT().Close().Return(nil),
+	)
+
+	var r = &BucketIteratorReader{
+		BucketIterator: iter,
+		FetchPolicy:    NewDiskSpoolPolicy(queue, dir, 2*size, 2),
+	}
+	var text, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	// Files are delivered in the order their downloads complete.
+	assert.Len(t, text, 3*len(content)+len(testParquetText))
+	assert.Equal(t, 1, strings.Count(string(text), testParquetText))
+	assert.Equal(t, 3*strings.Count(content, "\n"), strings.Count(strings.Replace(string(text), testParquetText, "", 1), "\n"))
+	assert.Nil(t, r.Close())
+
+	assert.Equal(t, map[string]int{"a.log.gz": 1, "b.log.parquet": 1, "c.log.gz": 1}, downloads)
+	for _, n := range spooled {
+		assert.True(t, n <= 2, "%d files spooled", n)
+	}
+	var files, _ = ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestDiskFileManagerEviction(t *testing.T) {
+	var fm = &DiskFileManager{MaxBytes: 3}
+	fm.once.Do(fm.init)
+	var spool = func(key string) *spoolEntry {
+		var entry = fm.reserve(LogFile{Bucket: "bucket", Key: key, Size: 1}, key)
+		assert.NotNil(t, entry)
+		var file, _ = ioutil.TempFile(fm.dir, "spool")
+		_ = file.Close()
+		entry.path = file.Name()
+		close(entry.ready)
+		return entry
+	}
+	var exists = func(entry *spoolEntry) bool {
+		var _, err = os.Stat(entry.path)
+		return err == nil
+	}
+
+	var a, b, c = spool("a"), spool("b"), spool("c")
+	fm.Put(&spoolFile{entry: a})
+	fm.Put(&spoolFile{entry: b})
+	fm.Put(&spoolFile{entry: c})
+	assert.True(t, exists(a), "released file was removed before its space was needed")
+	// Using a makes b the least recently used.
+	assert.Equal(t, a, fm.reuse("a"))
+	fm.release(a)
+
+	var d = spool("d")
+	assert.False(t, exists(b))
+	assert.Nil(t, fm.reuse("b"))
+	assert.True(t, exists(a))
+	assert.True(t, exists(c))
+	var e = spool("e")
+	assert.False(t, exists(c))
+	assert.True(t, exists(a))
+	assert.Equal(t, int64(3), fm.used)
+
+	// Pinned files are never evicted so prefetching waits for a release.
+	assert.Equal(t, a, fm.reuse("a"))
+	var reserved = make(chan *spoolEntry)
+	go func() {
+		reserved <- fm.reserve(LogFile{Bucket: "bucket", Key: "f", Size: 1}, "f")
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("reserved space while the spool was full of pinned files")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fm.Put(&spoolFile{entry: d})
+	assert.NotNil(t, <-reserved)
+	assert.False(t, exists(d))
+	assert.True(t, exists(a))
+	assert.True(t, exists(e))
+
+	// Waiting for space ends when the manager is closed.
+	go func() {
+		reserved <- fm.reserve(LogFile{Bucket: "bucket", Key: "g", Size: 1}, "g")
+	}()
+	var path = filepath.Dir(a.path)
+	assert.Nil(t, fm.Close())
+	assert.Nil(t, <-reserved)
+	assert.False(t, exists(a))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "temporary spool directory was not removed")
+}
+
+func TestDiskFileManagerOpensOnGet(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var content = gzipString("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n")
+	var objects = map[string][]byte{"a": content, "b": content, "c": content}
+	var downloads = make(map[string]int)
+	var spooled []int
+	var queue = NewMockS3API(ctrl)
+	var iter = NewMockBucketIterator(ctrl)
+	var fm = &DiskFileManager{
+		Queue:          queue,
+		BucketIterator: iter,
+		Lock:           &Semaphore{C: make(chan interface{}, 3)},
+		MaxBytes:       1024,
+		Ready:          make(chan io.Reader, 3),
+	}
+	fm.once.Do(fm.init)
+	spoolObjects(queue, objects, fm.dir, downloads, &spooled).Times(3)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a", Size: int64(len(content))}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "b", Size: int64(len(content))}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "c", Size: int64(len(content))}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(nil),
+	)
+	// Prefetch returns without Close once the iterator is exhausted and
+	// every file is spooled.
+	fm.Prefetch()
+	assert.Len(t, fm.Ready, 3)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	assert.NotNil(t, r.(*spoolFile).file)
+	for x := 0; x < 2; x = x + 1 {
+		var waiting = <-fm.Ready
+		assert.Nil(t, waiting.(*spoolFile).file, "spooled file was opened before Get")
+		fm.Put(waiting)
+	}
+	var line, _ = ioutil.ReadAll(r)
+	assert.Contains(t, string(line), "ACCEPT OK")
+	fm.Put(r)
+	var files, _ = ioutil.ReadDir(fm.dir)
+	assert.Len(t, files, 3, "released files were removed before their space was needed")
+	assert.Nil(t, fm.Close())
+	_, err = os.Stat(fm.dir)
+	assert.True(t, os.IsNotExist(err), "spooled files were not removed on Close")
+}
+
+func TestDiskFileManagerErrors(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var dir, _ = ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	var downloads = make(map[string]int)
+	var spooled []int
+	var queue = NewMockS3API(ctrl)
+	spoolObjects(queue, map[string][]byte{"bad": []byte("not gzip")}, dir, downloads, &spooled).AnyTimes()
+	var iter = NewMockBucketIterator(ctrl)
+	var listErr = errors.New("")
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "missing", Size: 8}),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "bad", Size: 8}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(listErr),
+	)
+
+	var fm = NewDiskSpoolPolicy(queue, dir, 1024, 1)(iter)
+	var errs []error
+	for {
+		var r, err = fm.Get()
+		if r == nil && err == nil {
+			break
+		}
+		assert.Nil(t, r)
+		errs = append(errs, err)
+	}
+	assert.Len(t, errs, 3)
+	assert.Contains(t, errs, listErr)
+	assert.Nil(t, fm.(*DiskFileManager).Close())
+	var files, _ = ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestDiskFileManagerReusedFailure(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var dir, _ = ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	var queue = NewMockS3API(ctrl)
+	var listed = make(chan struct{})
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, _ *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			<-listed
+			return nil, errors.New(s3.ErrCodeNoSuchKey)
+		},
+	).AnyTimes()
+	var iter = NewMockBucketIterator(ctrl)
+	var lf = LogFile{Bucket: "bucket", Key: "missing", Size: 8}
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(lf),
+		// The second listing of the object reuses the download in progress.
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(lf),
+		iter.EXPECT().Iterate().DoAndReturn(func() bool {
+			close(listed)
+			return false
+		}),
+		iter.EXPECT().Close().Return(nil),
+	)
+
+	var fm = NewDiskSpoolPolicy(queue, dir, 1024, 1)(iter)
+	var errs []error
+	for {
+		var r, err = fm.Get()
+		if r == nil && err == nil {
+			break
+		}
+		assert.Nil(t, r)
+		errs = append(errs, err)
+	}
+	// Both listings of the object are reported.
+	if assert.Len(t, errs, 2) {
+		for _, err := range errs {
+			if assert.IsType(t, &LogFileError{}, err) {
+				assert.Equal(t, lf, err.(*LogFileError).LogFile)
+			}
+		}
+	}
+	assert.Nil(t, fm.(*DiskFileManager).Close())
+}
+
+func TestDiskFileManagerAckError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var dir, _ = ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	var content = gzipString("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n")
+	var downloads = make(map[string]int)
+	var spooled []int
+	var queue = NewMockS3API(ctrl)
+	spoolObjects(queue, map[string][]byte{"a": content}, dir, downloads, &spooled)
+	var mock = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		mock.EXPECT().Iterate().Return(true),
+		mock.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a", Size: int64(len(content))}),
+		mock.EXPECT().Iterate().Return(false),
+		mock.EXPECT().Close().Return(nil),
+	)
+	var ackErr = errors.New("ack failed")
+	var iter = &ackingBucketIterator{BucketIterator: mock, err: ackErr}
+
+	var fm = NewDiskSpoolPolicy(queue, dir, 1024, 1)(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	fm.Put(r)
+	assert.Equal(t, []string{"a"}, iter.acked)
+	// The failed acknowledgement is returned by the next Get.
+	_, err = fm.Get()
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, ackErr, err.(*AckError).Err)
+	}
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+	assert.Nil(t, fm.(*DiskFileManager).Close())
+}
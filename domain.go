@@ -1,6 +1,10 @@
 package vpcflow
 
-import "time"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 // LogFile is a structured representation of a VPC Flow
 // log file. It should contain enough data that a consumer
@@ -22,6 +26,10 @@ type LogFile struct {
 	Hash string
 	// Size of the file containing the logs.
 	Size int64
+	// LastModified is the time the object was last written, if known.
+	LastModified time.Time
+	// StorageClass is the S3 storage class of the object, if known.
+	StorageClass string
 }
 
 // BucketIterator scans an S3 bucket and converts AWS API responses
@@ -39,3 +47,124 @@ type BucketIterator interface {
 	// returns an error, if any, that caused iterations to stop.
 	Close() error
 }
+
+// ContextBucketIterator is a BucketIterator that can abandon a call to
+// Iterate, such as one waiting on a listing request, when a context is
+// cancelled. The FileManagers of this package use this variant with the
+// context they are given.
+type ContextBucketIterator interface {
+	BucketIterator
+	// IterateWithContext is a variant of Iterate that stops with the
+	// error of the context once it is done.
+	IterateWithContext(context.Context) bool
+}
+
+// Acknowledger is implemented by BucketIterators that need to know
+// when a LogFile has been consumed, such as those fed by a message
+// queue that must not discard a notification until its file is read.
+type Acknowledger interface {
+	// Ack marks the LogFile as consumed.
+	Ack(LogFile) error
+}
+
+// FlowRecord is a structured representation of a single VPC Flow
+// log record. Fields that are reported as "-" by AWS, such as the
+// addresses and ports of a NODATA record, and fields that are not
+// part of the log format are left as zero values.
+type FlowRecord struct {
+	// Version is the VPC Flow Logs version of the record.
+	Version int
+	// AccountID is the AWS account ID for the flow log.
+	AccountID string
+	// InterfaceID is the ID of the network interface for which
+	// the traffic is recorded.
+	InterfaceID string
+	// SrcAddr is the source address of the traffic.
+	SrcAddr net.IP
+	// DstAddr is the destination address of the traffic.
+	DstAddr net.IP
+	// SrcPort is the source port of the traffic.
+	SrcPort int
+	// DstPort is the destination port of the traffic.
+	DstPort int
+	// Protocol is the IANA protocol number of the traffic.
+	Protocol int
+	// Packets is the number of packets transferred during the
+	// capture window.
+	Packets int64
+	// Bytes is the number of bytes transferred during the
+	// capture window.
+	Bytes int64
+	// Start is the time at which the first packet of the flow
+	// was received within the capture window.
+	Start time.Time
+	// End is the time at which the last packet of the flow
+	// was received within the capture window.
+	End time.Time
+	// Action is the action associated with the traffic. This
+	// is either ACCEPT or REJECT.
+	Action string
+	// LogStatus is the logging status of the flow log. This is
+	// one of OK, NODATA, or SKIPDATA.
+	LogStatus string
+	// VPCID is the ID of the VPC that contains the network interface.
+	VPCID string
+	// SubnetID is the ID of the subnet that contains the network
+	// interface.
+	SubnetID string
+	// InstanceID is the ID of the instance associated with the network
+	// interface, if the instance is owned by the account.
+	InstanceID string
+	// TCPFlags is the bitmask of TCP flags observed during the capture
+	// window.
+	TCPFlags int
+	// Type is the type of traffic. This is one of IPv4, IPv6, or EFA.
+	Type string
+	// PktSrcAddr is the packet-level source address of the traffic.
+	PktSrcAddr net.IP
+	// PktDstAddr is the packet-level destination address of the traffic.
+	PktDstAddr net.IP
+	// Region is the region that contains the network interface.
+	Region string
+	// AZID is the ID of the Availability Zone that contains the
+	// network interface.
+	AZID string
+	// SublocationType is the type of sublocation, such as wavelength,
+	// outpost, or localzone, that contains the network interface.
+	SublocationType string
+	// SublocationID is the ID of the sublocation that contains the
+	// network interface.
+	SublocationID string
+	// PktSrcAWSService is the name of the AWS service that owns the
+	// packet-level source address.
+	PktSrcAWSService string
+	// PktDstAWSService is the name of the AWS service that owns the
+	// packet-level destination address.
+	PktDstAWSService string
+	// FlowDirection is the direction of the flow with respect to the
+	// network interface. This is either ingress or egress.
+	FlowDirection string
+	// TrafficPath is the path that egress traffic takes to the
+	// destination.
+	TrafficPath int
+
+	// zeroTCPFlags is set when a tcp-flags value of 0 was read from a
+	// log line so that it is told apart from a missing value.
+	zeroTCPFlags bool
+}
+
+// RecordIterator scans VPC Flow log content and converts each
+// line to a FlowRecord.
+type RecordIterator interface {
+	// Iterate pushes the cursor one record forward such that
+	// the current value is fetched when calling Current().
+	// This method should return false after all records have
+	// been iterated over or an error is encountered attempting
+	// to parse records.
+	Iterate() bool
+	// Get the current value of the iterator.
+	Current() FlowRecord
+	// Close cleans up any resources used by the iterator and
+	// returns an error, if any, that caused iterations to stop.
+	Close() error
+}
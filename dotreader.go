@@ -1,7 +1,6 @@
 package vpcflow
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -11,16 +10,31 @@ import (
 	"gonum.org/v1/gonum/graph/formats/dot/ast"
 )
 
-var edgeLabels = map[int]string{
-	idxAccountID:   "accountID",
-	idxInterfaceID: "eniID",
-	idxSrcPort:     "srcPort",
-	idxDstPort:     "dstPort",
-	idxProtocol:    "protocol",
-	idxPackets:     "packets",
-	idxBytes:       "bytes",
-	idxStart:       "start",
-	idxEnd:         "end",
+var edgeLabels = map[string]string{
+	FieldAccountID:        "accountID",
+	FieldInterfaceID:      "eniID",
+	FieldSrcPort:          "srcPort",
+	FieldDstPort:          "dstPort",
+	FieldProtocol:         "protocol",
+	FieldPackets:          "packets",
+	FieldBytes:            "bytes",
+	FieldStart:            "start",
+	FieldEnd:              "end",
+	FieldVPCID:            "vpcID",
+	FieldSubnetID:         "subnetID",
+	FieldInstanceID:       "instanceID",
+	FieldTCPFlags:         "tcpFlags",
+	FieldType:             "type",
+	FieldPktSrcAddr:       "pktSrcAddr",
+	FieldPktDstAddr:       "pktDstAddr",
+	FieldRegion:           "region",
+	FieldAZID:             "azID",
+	FieldSublocationType:  "sublocationType",
+	FieldSublocationID:    "sublocationID",
+	FieldPktSrcAWSService: "pktSrcAWSService",
+	FieldPktDstAWSService: "pktDstAWSService",
+	FieldFlowDirection:    "flowDirection",
+	FieldTrafficPath:      "trafficPath",
 }
 
 const namespace = "govpc_"
@@ -31,33 +45,41 @@ type Converter func(io.ReadCloser) (io.ReadCloser, error)
 // DOTConverter takes in as input a sinle AWS VPC Flow Log file, or a digest of  VPC Flow Logs, and converts the data into a DOT graph.DOTConverter.
 // The input ReadCloser will be closed after conversion, the caller should close the output ReadCloser when done reading.
 func DOTConverter(r io.ReadCloser) (io.ReadCloser, error) {
-	reader := bufio.NewReader(r)
-	defer r.Close()
+	return convertDOT(r, nil)
+}
+
+// NewDOTConverter produces a Converter like DOTConverter that parses any lines appearing before the first
+// header line of the input using the given format. Every field of the format is added as an edge annotation.
+func NewDOTConverter(format Format) Converter {
+	return func(r io.ReadCloser) (io.ReadCloser, error) {
+		return convertDOT(r, format)
+	}
+}
+
+func convertDOT(r io.ReadCloser, format Format) (io.ReadCloser, error) {
+	iter := &ReaderRecordIterator{Reader: r, Format: format}
 	g := &ast.Graph{Directed: true}
 	nodeStmts := make(map[string]ast.Stmt) // dedupe node statements
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF && len(line) < 1 {
-			break
-		}
-		if err != nil && err != io.EOF {
-			return nil, err
+	for iter.Iterate() {
+		record := iter.Current()
+		if record.LogStatus != "" && !strings.EqualFold(record.LogStatus, "ok") {
+			continue
 		}
-		attrs := strings.Split(line, " ")
-		logStatus := strings.ToLower(strings.TrimSpace(attrs[idxLogStatus]))
-		if attrs[idxVersion] != "2" || logStatus != "ok" {
+		if record.SrcAddr == nil || record.DstAddr == nil {
 			continue
 		}
+		format := iter.CurrentFormat()
+		attrs := record.attrs(format)
 
-		src := createNode(attrs[idxSrcAddr], nodeStmts)
-		dst := createNode(attrs[idxDstAddr], nodeStmts)
+		src := createNode(record.SrcAddr.String(), nodeStmts)
+		dst := createNode(record.DstAddr.String(), nodeStmts)
 
 		// build up the edge label for rendering, and also add each of the annotations individually
 		// so that they may be parsed easily by downstream consumers
 		var prefix, label string
 		edgeAttrs := make([]*ast.Attr, 0, len(attrs))
 		for idx, attr := range attrs {
-			l, ok := edgeLabels[idx]
+			l, ok := edgeLabels[format[idx]]
 			if !ok {
 				continue
 			}
@@ -73,7 +95,7 @@ func DOTConverter(r io.ReadCloser) (io.ReadCloser, error) {
 			Key: "color",
 			Val: "green",
 		}
-		if strings.ToLower(attrs[idxAction]) == "reject" {
+		if strings.EqualFold(record.Action, "reject") {
 			color.Val = "red"
 		}
 		edgeAttrs = append(edgeAttrs, color, &ast.Attr{
@@ -86,6 +108,9 @@ func DOTConverter(r io.ReadCloser) (io.ReadCloser, error) {
 			Attrs: edgeAttrs,
 		})
 	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
 
 	nodes := make([]ast.Stmt, 0, len(nodeStmts))
 	for _, v := range nodeStmts {
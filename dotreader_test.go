@@ -55,6 +55,19 @@ func TestConvert(t *testing.T) {
 				`}`:                                   true,
 			},
 		},
+		{
+			Name: "custom_format",
+			Input: []byte(`version vpc-id srcaddr dstaddr dstport action log-status flow-direction
+5 vpc-abcdefab012345678 172.31.16.139 172.31.16.21 80 REJECT OK ingress
+5 vpc-abcdefab012345678 - - - - NODATA -`),
+			Expected: expectedDigest{
+				`digraph {`: true,
+				`n1723116139 -> n172311621 [govpc_vpcID="vpc-abcdefab012345678" govpc_dstPort="80" govpc_flowDirection="ingress" color=red label="vpcID=vpc-abcdefab012345678\ndstPort=80\nflowDirection=ingress"]`: true,
+				`n1723116139 [label="172.31.16.139"]`: true,
+				`n172311621 [label="172.31.16.21"]`:   true,
+				`}`:                                   true,
+			},
+		},
 		{
 			Name:  "no_data",
 			Input: []byte(``),
@@ -94,6 +107,15 @@ func (tr *trapReader) Read(_ []byte) (int, error) {
 	return 0, errors.New("oops")
 }
 
+func TestNewDOTConverter(t *testing.T) {
+	format, _ := ParseFormat("${srcaddr} ${dstaddr} ${subnet-id}")
+	input := ioutil.NopCloser(strings.NewReader("10.0.0.1 10.0.0.2 subnet-aaaaaaaa012345678\n"))
+	output, err := NewDOTConverter(format)(input)
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(output)
+	assert.Contains(t, string(content), `n10001 -> n10002 [govpc_subnetID="subnet-aaaaaaaa012345678" color=green label="subnetID=subnet-aaaaaaaa012345678"]`)
+}
+
 func TestReaderError(t *testing.T) {
 	_, err := DOTConverter(ioutil.NopCloser(&trapReader{}))
 	assert.NotNil(t, err)
@@ -0,0 +1,170 @@
+package vpcflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+)
+
+// LogFileFilterConfig declares a tree of LogFileFilters so that filters
+// can be loaded from configuration, such as JSON, rather than written in
+// code. Each node sets exactly one of its fields. For example:
+//
+//	{"and": [
+//	  {"region": ["us-west-2", "us-east-1"]},
+//	  {"time": {"start": "2018-10-17T00:00:00Z", "end": "2018-10-18T00:00:00Z"}},
+//	  {"not": {"storageClass": ["GLACIER", "DEEP_ARCHIVE"]}},
+//	  {"or": [{"keyGlob": "AWSLogs/123456789012/*/*/*/*/*/*"}, {"size": {"max": 1048576}}]}
+//	]}
+type LogFileFilterConfig struct {
+	// And passes files that pass all of the filters.
+	And []LogFileFilterConfig `json:"and,omitempty"`
+	// Or passes files that pass any of the filters.
+	Or []LogFileFilterConfig `json:"or,omitempty"`
+	// Not passes files that fail the filter.
+	Not *LogFileFilterConfig `json:"not,omitempty"`
+	// Time bounds the timestamp of the file name as a LogFileTimeFilter
+	// and requires both a start and an end.
+	Time *LogFileTimeRange `json:"time,omitempty"`
+	// Region lists the allowed regions.
+	Region []string `json:"region,omitempty"`
+	// Account lists the allowed accounts.
+	Account []string `json:"account,omitempty"`
+	// FlowLogID lists the allowed flow logs.
+	FlowLogID []string `json:"flowLogID,omitempty"`
+	// KeyGlob is a pattern that keys must match as a
+	// LogFileKeyGlobFilter.
+	KeyGlob string `json:"keyGlob,omitempty"`
+	// KeyRegexp is a regular expression that keys must contain a
+	// match of.
+	KeyRegexp string `json:"keyRegexp,omitempty"`
+	// Size bounds the size of the object.
+	Size *LogFileSizeRange `json:"size,omitempty"`
+	// LastModified bounds the modification time of the object as a
+	// LogFileLastModifiedFilter.
+	LastModified *LogFileTimeRange `json:"lastModified,omitempty"`
+	// StorageClass lists the allowed S3 storage classes.
+	StorageClass []string `json:"storageClass,omitempty"`
+}
+
+// LogFileTimeRange is an inclusive time range of a LogFileFilterConfig.
+// Times are written in RFC 3339 format.
+type LogFileTimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// LogFileSizeRange is an inclusive size range of a LogFileFilterConfig.
+type LogFileSizeRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+// ParseLogFileFilter builds a LogFileFilter from the JSON encoding of a
+// LogFileFilterConfig. Unknown fields are rejected so that mistakes in the
+// configuration are not silently ignored.
+func ParseLogFileFilter(data []byte) (LogFileFilter, error) {
+	var config LogFileFilterConfig
+	var decoder = json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing log file filter. %s", err)
+	}
+	var filter, err = config.Build()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing log file filter. %s", err)
+	}
+	return filter, nil
+}
+
+// Build converts the configuration into a LogFileFilter.
+func (c LogFileFilterConfig) Build() (LogFileFilter, error) {
+	var filters []LogFileFilter
+	var err error
+	var add = func(filter LogFileFilter, e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+		filters = append(filters, filter)
+	}
+	if c.And != nil {
+		add(buildLogFileFilters(c.And, func(f []LogFileFilter) LogFileFilter { return MultiLogFileFilter(f) }))
+	}
+	if c.Or != nil {
+		add(buildLogFileFilters(c.Or, func(f []LogFileFilter) LogFileFilter { return AnyLogFileFilter(f) }))
+	}
+	if c.Not != nil {
+		var filter, e = c.Not.Build()
+		add(NotLogFileFilter{Filter: filter}, e)
+	}
+	if c.Time != nil {
+		var e error
+		if c.Time.Start.IsZero() || c.Time.End.IsZero() {
+			e = fmt.Errorf("time requires a start and an end")
+		}
+		add(LogFileTimeFilter{Start: c.Time.Start, End: c.Time.End}, e)
+	}
+	if c.Region != nil {
+		add(LogFileRegionFilter{Region: stringSet(c.Region)}, nil)
+	}
+	if c.Account != nil {
+		add(LogFileAccountFilter{Account: stringSet(c.Account)}, nil)
+	}
+	if c.FlowLogID != nil {
+		add(LogFileFlowLogIDFilter{FlowLogID: stringSet(c.FlowLogID)}, nil)
+	}
+	if c.KeyGlob != "" {
+		// A malformed pattern is reported whatever the name matched.
+		var _, e = path.Match(c.KeyGlob, "")
+		if e != nil {
+			e = fmt.Errorf("invalid keyGlob. %s", e)
+		}
+		add(LogFileKeyGlobFilter{Pattern: c.KeyGlob}, e)
+	}
+	if c.KeyRegexp != "" {
+		var re, e = regexp.Compile(c.KeyRegexp)
+		if e != nil {
+			e = fmt.Errorf("invalid keyRegexp. %s", e)
+		}
+		add(LogFileKeyRegexpFilter{Regexp: re}, e)
+	}
+	if c.Size != nil {
+		add(LogFileSizeFilter{Min: c.Size.Min, Max: c.Size.Max}, nil)
+	}
+	if c.LastModified != nil {
+		add(LogFileLastModifiedFilter{Start: c.LastModified.Start, End: c.LastModified.End}, nil)
+	}
+	if c.StorageClass != nil {
+		add(LogFileStorageClassFilter{StorageClass: stringSet(c.StorageClass)}, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(filters) != 1 {
+		return nil, fmt.Errorf("expected one filter in each node but found %d", len(filters))
+	}
+	return filters[0], nil
+}
+
+func buildLogFileFilters(configs []LogFileFilterConfig, combine func([]LogFileFilter) LogFileFilter) (LogFileFilter, error) {
+	var filters = make([]LogFileFilter, 0, len(configs))
+	for _, config := range configs {
+		var filter, err = config.Build()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return combine(filters), nil
+}
+
+func stringSet(values []string) map[string]bool {
+	var set = make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
@@ -0,0 +1,81 @@
+package vpcflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogFileFilter(t *testing.T) {
+	var filter, err = ParseLogFileFilter([]byte(`{"and": [
+		{"region": ["us-west-2", "us-east-1"]},
+		{"time": {"start": "2018-10-17T00:00:00Z", "end": "2018-10-18T00:00:00Z"}},
+		{"not": {"storageClass": ["GLACIER"]}},
+		{"or": [{"account": ["123456789012"]}, {"flowLogID": ["fl-1"]}]},
+		{"keyGlob": "AWSLogs/*/*.log.gz"},
+		{"keyRegexp": "\\.log\\.gz$"},
+		{"size": {"min": 1, "max": 1000}},
+		{"lastModified": {"start": "2018-10-17T00:00:00Z"}}
+	]}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+	var lf = LogFile{
+		Key:          "AWSLogs/123456789012/a.log.gz",
+		Account:      "123456789012",
+		Region:       "us-west-2",
+		FlowLogID:    "fl-2",
+		Timestamp:    time.Date(2018, 10, 17, 0, 30, 0, 0, time.UTC),
+		Size:         100,
+		LastModified: time.Date(2018, 10, 17, 0, 35, 0, 0, time.UTC),
+		StorageClass: "STANDARD",
+	}
+	assert.True(t, filter.FilterLogFile(lf))
+
+	var variants = []func(*LogFile){
+		func(lf *LogFile) { lf.Region = "eu-west-1" },
+		func(lf *LogFile) { lf.Timestamp = lf.Timestamp.Add(48 * time.Hour) },
+		func(lf *LogFile) { lf.StorageClass = "GLACIER" },
+		func(lf *LogFile) { lf.Account = "other" },
+		func(lf *LogFile) { lf.Key = "AWSLogs/123456789012/a.log" },
+		func(lf *LogFile) { lf.Size = 1001 },
+		func(lf *LogFile) { lf.LastModified = time.Time{} },
+	}
+	for idx, variant := range variants {
+		var changed = lf
+		variant(&changed)
+		assert.False(t, filter.FilterLogFile(changed), "variant %d passed", idx)
+	}
+	var changed = lf
+	changed.Account = "other"
+	changed.FlowLogID = "fl-1"
+	assert.True(t, filter.FilterLogFile(changed))
+}
+
+func TestParseLogFileFilterErrors(t *testing.T) {
+	tc := []struct {
+		Name     string
+		Input    string
+		Expected string
+	}{
+		{Name: "syntax", Input: `{"region": `, Expected: "unexpected EOF"},
+		{Name: "unknown", Input: `{"regions": ["us-west-2"]}`, Expected: "regions"},
+		{Name: "empty", Input: `{}`, Expected: "expected one filter in each node but found 0"},
+		{Name: "many", Input: `{"region": ["us-west-2"], "account": ["1"]}`, Expected: "expected one filter in each node but found 2"},
+		{Name: "nested", Input: `{"or": [{"not": {}}]}`, Expected: "expected one filter in each node but found 0"},
+		{Name: "glob", Input: `{"keyGlob": "["}`, Expected: "invalid keyGlob"},
+		{Name: "regexp", Input: `{"keyRegexp": "("}`, Expected: "invalid keyRegexp"},
+		{Name: "time", Input: `{"time": {"start": "2018-10-17T00:00:00Z"}}`, Expected: "time requires a start and an end"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var filter, err = ParseLogFileFilter([]byte(tt.Input))
+			assert.Nil(t, filter)
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), "error parsing log file filter. ")
+				assert.Contains(t, err.Error(), tt.Expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package vpcflow
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field accessors used by filter expressions, grouped by the type of
+// value each field holds.
+var (
+	intFields = map[string]func(FlowRecord) int64{
+		FieldVersion:     func(r FlowRecord) int64 { return int64(r.Version) },
+		FieldSrcPort:     func(r FlowRecord) int64 { return int64(r.SrcPort) },
+		FieldDstPort:     func(r FlowRecord) int64 { return int64(r.DstPort) },
+		FieldProtocol:    func(r FlowRecord) int64 { return int64(r.Protocol) },
+		FieldPackets:     func(r FlowRecord) int64 { return r.Packets },
+		FieldBytes:       func(r FlowRecord) int64 { return r.Bytes },
+		FieldTCPFlags:    func(r FlowRecord) int64 { return int64(r.TCPFlags) },
+		FieldTrafficPath: func(r FlowRecord) int64 { return int64(r.TrafficPath) },
+	}
+	timeFields = map[string]func(FlowRecord) time.Time{
+		FieldStart: func(r FlowRecord) time.Time { return r.Start },
+		FieldEnd:   func(r FlowRecord) time.Time { return r.End },
+	}
+	addrFields = map[string]func(FlowRecord) net.IP{
+		FieldSrcAddr:    func(r FlowRecord) net.IP { return r.SrcAddr },
+		FieldDstAddr:    func(r FlowRecord) net.IP { return r.DstAddr },
+		FieldPktSrcAddr: func(r FlowRecord) net.IP { return r.PktSrcAddr },
+		FieldPktDstAddr: func(r FlowRecord) net.IP { return r.PktDstAddr },
+	}
+	stringFields = map[string]func(FlowRecord) string{
+		FieldAccountID:        func(r FlowRecord) string { return r.AccountID },
+		FieldInterfaceID:      func(r FlowRecord) string { return r.InterfaceID },
+		FieldAction:           func(r FlowRecord) string { return r.Action },
+		FieldLogStatus:        func(r FlowRecord) string { return r.LogStatus },
+		FieldVPCID:            func(r FlowRecord) string { return r.VPCID },
+		FieldSubnetID:         func(r FlowRecord) string { return r.SubnetID },
+		FieldInstanceID:       func(r FlowRecord) string { return r.InstanceID },
+		FieldType:             func(r FlowRecord) string { return r.Type },
+		FieldRegion:           func(r FlowRecord) string { return r.Region },
+		FieldAZID:             func(r FlowRecord) string { return r.AZID },
+		FieldSublocationType:  func(r FlowRecord) string { return r.SublocationType },
+		FieldSublocationID:    func(r FlowRecord) string { return r.SublocationID },
+		FieldPktSrcAWSService: func(r FlowRecord) string { return r.PktSrcAWSService },
+		FieldPktDstAWSService: func(r FlowRecord) string { return r.PktDstAWSService },
+		FieldFlowDirection:    func(r FlowRecord) string { return r.FlowDirection },
+	}
+)
+
+// ParseRecordFilter compiles a filter expression into a RecordFilter. The
+// expression is parsed once and values are converted to the type of their
+// field so that evaluating the filter does no parsing. For example:
+//
+//	dstport in (22, 3389) and action == "REJECT" and srcaddr not in 10.0.0.0/8
+//
+// Comparisons take the form <field> <operator> <value> where the field is
+// any name that may appear in a flow log format, such as dstport or
+// log-status, and the operator is one of ==, !=, <, <=, >, or >=. The form
+// <field> in (<value>, ...) matches any of the listed values and may be
+// negated as not in. Comparisons are combined with and, or, and not, with
+// not binding most tightly and and binding more tightly than or, and may
+// be grouped with parentheses.
+//
+// Values are written bare or in double quotes. Numeric fields compare as
+// integers. The start and end fields take Unix seconds or RFC 3339 times.
+// Address fields take addresses or CIDR blocks, which match any address
+// within them, and support only equality and in. All other fields compare
+// as text without regard to case and support only equality and in. Fields
+// that are empty in a record compare as zero, as the zero time, as no
+// address, or as empty text.
+func ParseRecordFilter(expression string) (RecordFilter, error) {
+	var tokens, err = lexFilter(expression)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record filter. %s", err)
+	}
+	var p = &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEnd {
+		err = p.unexpected("and, or, or the end of the expression")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record filter. %s", err)
+	}
+	return RecordFilterFunc(filter), nil
+}
+
+const (
+	tokenEnd = iota
+	tokenWord
+	tokenString
+	tokenPunct
+)
+
+type filterToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// lexFilter splits an expression into words, quoted strings, and
+// punctuation. Words run until a space or punctuation so that field
+// names, addresses, and CIDR blocks are each one word.
+func lexFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	var pos = 0
+	for pos < len(expression) {
+		var c = expression[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos = pos + 1
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, filterToken{kind: tokenPunct, text: string(c), pos: pos})
+			pos = pos + 1
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			var end = pos + 1
+			if end < len(expression) && expression[end] == '=' {
+				end = end + 1
+			}
+			tokens = append(tokens, filterToken{kind: tokenPunct, text: expression[pos:end], pos: pos})
+			pos = end
+		case c == '"':
+			var end = pos + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end = end + 1
+				}
+				end = end + 1
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at offset %d", pos)
+			}
+			var text, err = strconv.Unquote(expression[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d. %s", pos, err)
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: text, pos: pos})
+			pos = end + 1
+		default:
+			var end = pos
+			for end < len(expression) && !strings.ContainsRune(" \t\n\r(),=!<>\"", rune(expression[end])) {
+				end = end + 1
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: expression[pos:end], pos: pos})
+			pos = end
+		}
+	}
+	return append(tokens, filterToken{kind: tokenEnd, pos: len(expression)}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	var t = p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next = p.next + 1
+	}
+	return t
+}
+
+// keyword reports whether the next token is the given keyword and, if
+// so, consumes it.
+func (p *filterParser) keyword(word string) bool {
+	var t = p.peek()
+	if t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.next = p.next + 1
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) punct(text string) bool {
+	var t = p.peek()
+	if t.kind == tokenPunct && t.text == text {
+		p.next = p.next + 1
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) unexpected(expected string) error {
+	var t = p.peek()
+	if t.kind == tokenEnd {
+		return fmt.Errorf("expected %s but found the end of the expression", expected)
+	}
+	return fmt.Errorf("expected %s but found %q at offset %d", expected, t.text, t.pos)
+}
+
+func (p *filterParser) parseOr() (func(FlowRecord) bool, error) {
+	var left, err = p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		var right, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		var l = left
+		left = func(r FlowRecord) bool { return l(r) || right(r) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (func(FlowRecord) bool, error) {
+	var left, err = p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		var right, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		var l = left
+		left = func(r FlowRecord) bool { return l(r) && right(r) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (func(FlowRecord) bool, error) {
+	if p.keyword("not") {
+		var inner, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r FlowRecord) bool { return !inner(r) }, nil
+	}
+	if p.punct("(") {
+		var inner, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.punct(")") {
+			return nil, p.unexpected(")")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (func(FlowRecord) bool, error) {
+	var t = p.peek()
+	if t.kind != tokenWord {
+		return nil, p.unexpected("a field name")
+	}
+	var field = strings.ToLower(t.text)
+	if _, ok := fieldCodecs[field]; !ok {
+		return nil, fmt.Errorf("unknown field %q at offset %d", t.text, t.pos)
+	}
+	p.take()
+
+	var negate = p.keyword("not")
+	if negate || p.keyword("in") {
+		if negate && !p.keyword("in") {
+			return nil, p.unexpected("in")
+		}
+		var values, err = p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		match, err := compileIn(field, values)
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			return func(r FlowRecord) bool { return !match(r) }, nil
+		}
+		return match, nil
+	}
+
+	var op = p.peek()
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, p.unexpected("an operator")
+	}
+	if op.kind != tokenPunct {
+		return nil, p.unexpected("an operator")
+	}
+	p.take()
+	var value, err = p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return compileComparison(field, op.text, value)
+}
+
+// parseSet reads a parenthesized list of values or a single value.
+func (p *filterParser) parseSet() ([]filterToken, error) {
+	if !p.punct("(") {
+		var value, err = p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return []filterToken{value}, nil
+	}
+	var values []filterToken
+	for {
+		var value, err = p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if p.punct(")") {
+			return values, nil
+		}
+		if !p.punct(",") {
+			return nil, p.unexpected(", or )")
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (filterToken, error) {
+	var t = p.peek()
+	if t.kind != tokenWord && t.kind != tokenString {
+		return t, p.unexpected("a value")
+	}
+	return p.take(), nil
+}
+
+func compileComparison(field string, op string, value filterToken) (func(FlowRecord) bool, error) {
+	if get, ok := intFields[field]; ok {
+		var v, err = strconv.ParseInt(value.text, 10, 64)
+		if err != nil {
+			return nil, invalidValue(field, value)
+		}
+		return compareOrdered(op, func(r FlowRecord) int {
+			var x = get(r)
+			switch {
+			case x < v:
+				return -1
+			case x > v:
+				return 1
+			}
+			return 0
+		}), nil
+	}
+	if get, ok := timeFields[field]; ok {
+		var v, err = parseFilterTime(value.text)
+		if err != nil {
+			return nil, invalidValue(field, value)
+		}
+		return compareOrdered(op, func(r FlowRecord) int {
+			var x = get(r)
+			switch {
+			case x.Before(v):
+				return -1
+			case x.After(v):
+				return 1
+			}
+			return 0
+		}), nil
+	}
+	if op != "==" && op != "!=" {
+		return nil, fmt.Errorf("operator %s is not supported for %s at offset %d", op, field, value.pos)
+	}
+	var match, err = compileIn(field, []filterToken{value})
+	if err != nil {
+		return nil, err
+	}
+	if op == "!=" {
+		return func(r FlowRecord) bool { return !match(r) }, nil
+	}
+	return match, nil
+}
+
+func compareOrdered(op string, compare func(FlowRecord) int) func(FlowRecord) bool {
+	switch op {
+	case "==":
+		return func(r FlowRecord) bool { return compare(r) == 0 }
+	case "!=":
+		return func(r FlowRecord) bool { return compare(r) != 0 }
+	case "<":
+		return func(r FlowRecord) bool { return compare(r) < 0 }
+	case "<=":
+		return func(r FlowRecord) bool { return compare(r) <= 0 }
+	case ">":
+		return func(r FlowRecord) bool { return compare(r) > 0 }
+	default:
+		return func(r FlowRecord) bool { return compare(r) >= 0 }
+	}
+}
+
+// compileIn produces a match of a field against any of a set of values.
+func compileIn(field string, values []filterToken) (func(FlowRecord) bool, error) {
+	if get, ok := intFields[field]; ok {
+		var set = make(map[int64]bool, len(values))
+		for _, value := range values {
+			var v, err = strconv.ParseInt(value.text, 10, 64)
+			if err != nil {
+				return nil, invalidValue(field, value)
+			}
+			set[v] = true
+		}
+		return func(r FlowRecord) bool { return set[get(r)] }, nil
+	}
+	if get, ok := timeFields[field]; ok {
+		var set = make(map[int64]bool, len(values))
+		for _, value := range values {
+			var v, err = parseFilterTime(value.text)
+			if err != nil {
+				return nil, invalidValue(field, value)
+			}
+			set[v.Unix()] = true
+		}
+		return func(r FlowRecord) bool { return set[get(r).Unix()] }, nil
+	}
+	if get, ok := addrFields[field]; ok {
+		var networks = make([]*net.IPNet, 0, len(values))
+		for _, value := range values {
+			var network, err = parseFilterNetwork(value.text)
+			if err != nil {
+				return nil, invalidValue(field, value)
+			}
+			networks = append(networks, network)
+		}
+		return func(r FlowRecord) bool {
+			var ip = get(r)
+			if ip == nil {
+				return false
+			}
+			for _, network := range networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	var get = stringFields[field]
+	var set = make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(value.text)] = true
+	}
+	return func(r FlowRecord) bool { return set[strings.ToLower(get(r))] }, nil
+}
+
+func invalidValue(field string, value filterToken) error {
+	return fmt.Errorf("invalid value %q for %s at offset %d", value.text, field, value.pos)
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseFilterNetwork parses a CIDR block or a single address, which is
+// treated as a block that contains only that address.
+func parseFilterNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		var _, network, err = net.ParseCIDR(value)
+		return network, err
+	}
+	var ip = net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", value)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
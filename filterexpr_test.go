@@ -0,0 +1,105 @@
+package vpcflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRecordFilter(t *testing.T) {
+	var format = append(append(Format{}, DefaultFormat...), FieldVPCID, FieldPktSrcAddr)
+	var parse = func(line string) FlowRecord {
+		var record, err = parseFlowRecord(format, strings.Fields(line))
+		assert.Nil(t, err)
+		return record
+	}
+	var ssh = parse("2 123456789010 eni-abc123de 192.168.1.5 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 REJECT OK vpc-1 -")
+	var rdp = parse("2 123456789010 eni-abc123de 10.1.2.3 172.31.16.21 20641 3389 6 20 4249 1418530010 1418530070 REJECT OK vpc-1 10.1.2.3")
+	var web = parse("2 123456789010 eni-abc123de 192.168.1.5 172.31.16.21 20641 443 6 20 4249 1418530010 1418530070 ACCEPT OK vpc-2 -")
+	var nodata = parse("2 123456789010 eni-abc123de - - - - - - - 1418530010 1418530070 - NODATA - -")
+
+	tc := []struct {
+		Name       string
+		Expression string
+		Expected   []bool
+	}{
+		{Name: "example", Expression: `dstport in (22,3389) and action == "REJECT" and srcaddr not in 10.0.0.0/8`, Expected: []bool{true, false, false, false}},
+		{Name: "or", Expression: `dstport == 443 or srcaddr == 10.1.2.3`, Expected: []bool{false, true, true, false}},
+		{Name: "precedence", Expression: `dstport == 443 or dstport == 22 and action == accept`, Expected: []bool{false, false, true, false}},
+		{Name: "grouping", Expression: `(dstport == 443 or dstport == 22) and action == reject`, Expected: []bool{true, false, false, false}},
+		{Name: "not", Expression: `not (action == ACCEPT or log-status == nodata)`, Expected: []bool{true, true, false, false}},
+		{Name: "case", Expression: `ACTION == "reject" AND VPC-ID In (VPC-1)`, Expected: []bool{true, true, false, false}},
+		{Name: "ordered", Expression: `dstport >= 22 and dstport < 3389 and bytes > 0`, Expected: []bool{true, false, true, false}},
+		{Name: "not-equal", Expression: `vpc-id != vpc-1`, Expected: []bool{false, false, true, true}},
+		{Name: "time", Expression: `start >= 1418530010 and end <= 2014-12-14T04:14:30Z`, Expected: []bool{true, true, true, true}},
+		{Name: "empty-address", Expression: `pkt-srcaddr in 0.0.0.0/0`, Expected: []bool{false, true, false, false}},
+		{Name: "empty-text", Expression: `action == ""`, Expected: []bool{false, false, false, true}},
+		{Name: "ipv6", Expression: `srcaddr in (::1, 2001:db8::/32)`, Expected: []bool{false, false, false, false}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var filter, err = ParseRecordFilter(tt.Expression)
+			if !assert.Nil(t, err) {
+				return
+			}
+			var actual []bool
+			for _, record := range []FlowRecord{ssh, rdp, web, nodata} {
+				actual = append(actual, filter.FilterRecord(record))
+			}
+			assert.Equal(t, tt.Expected, actual)
+		})
+	}
+}
+
+func TestParseRecordFilterErrors(t *testing.T) {
+	tc := []struct {
+		Name       string
+		Expression string
+		Expected   string
+	}{
+		{Name: "empty", Expression: ``, Expected: "expected a field name but found the end of the expression"},
+		{Name: "unknown-field", Expression: `port == 22`, Expected: `unknown field "port" at offset 0`},
+		{Name: "missing-operator", Expression: `dstport 22`, Expected: `expected an operator but found "22" at offset 8`},
+		{Name: "missing-value", Expression: `dstport ==`, Expected: "expected a value but found the end of the expression"},
+		{Name: "bad-number", Expression: `dstport == ssh`, Expected: `invalid value "ssh" for dstport at offset 11`},
+		{Name: "bad-address", Expression: `srcaddr in (10.0.0.0/8, nope)`, Expected: `invalid value "nope" for srcaddr at offset 24`},
+		{Name: "bad-time", Expression: `start > yesterday`, Expected: `invalid value "yesterday" for start`},
+		{Name: "ordered-text", Expression: `action < ACCEPT`, Expected: "operator < is not supported for action"},
+		{Name: "ordered-address", Expression: `srcaddr > 10.0.0.1`, Expected: "operator > is not supported for srcaddr"},
+		{Name: "unclosed-group", Expression: `(dstport == 22`, Expected: "expected ) but found the end of the expression"},
+		{Name: "unclosed-set", Expression: `dstport in (22 80)`, Expected: `expected , or ) but found "80" at offset 15`},
+		{Name: "not-without-in", Expression: `dstport not 22`, Expected: `expected in but found "22" at offset 12`},
+		{Name: "trailing", Expression: `dstport == 22 action == ACCEPT`, Expected: `expected and, or, or the end of the expression but found "action" at offset 14`},
+		{Name: "unterminated", Expression: `action == "ACCEPT`, Expected: "unterminated string at offset 10"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var filter, err = ParseRecordFilter(tt.Expression)
+			assert.Nil(t, filter)
+			if assert.NotNil(t, err) {
+				assert.True(t, strings.HasPrefix(err.Error(), "error parsing record filter. "), err.Error())
+				assert.Contains(t, err.Error(), tt.Expected)
+			}
+		})
+	}
+}
+
+func TestFilterFieldsCoverFormats(t *testing.T) {
+	for field := range fieldCodecs {
+		var count int
+		if _, ok := intFields[field]; ok {
+			count = count + 1
+		}
+		if _, ok := timeFields[field]; ok {
+			count = count + 1
+		}
+		if _, ok := addrFields[field]; ok {
+			count = count + 1
+		}
+		if _, ok := stringFields[field]; ok {
+			count = count + 1
+		}
+		assert.Equal(t, 1, count, field)
+	}
+}
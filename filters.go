@@ -1,6 +1,9 @@
 package vpcflow
 
 import (
+	"context"
+	"path"
+	"regexp"
 	"time"
 )
 
@@ -62,8 +65,114 @@ func (f LogFileAccountFilter) FilterLogFile(lf LogFile) bool {
 	return f.Account[lf.Account]
 }
 
+// AnyLogFileFilter composes any number of filters into a single
+// filter that returns true on the first passed filter or false if
+// all filters fail.
+type AnyLogFileFilter []LogFileFilter
+
+// FilterLogFile executes all enclosed filters until one of them
+// returns true.
+func (f AnyLogFileFilter) FilterLogFile(lf LogFile) bool {
+	for _, filter := range f {
+		if filter.FilterLogFile(lf) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotLogFileFilter inverts the result of another filter.
+type NotLogFileFilter struct {
+	Filter LogFileFilter
+}
+
+// FilterLogFile negates the enclosed filter.
+func (f NotLogFileFilter) FilterLogFile(lf LogFile) bool {
+	return !f.Filter.FilterLogFile(lf)
+}
+
+// LogFileFlowLogIDFilter reduces the set to only those from a
+// particular set of flow logs.
+type LogFileFlowLogIDFilter struct {
+	FlowLogID map[string]bool
+}
+
+// FilterLogFile compares against the set of allowed flow logs.
+func (f LogFileFlowLogIDFilter) FilterLogFile(lf LogFile) bool {
+	return f.FlowLogID[lf.FlowLogID]
+}
+
+// LogFileKeyGlobFilter reduces the set to only those with a key that
+// matches a shell pattern. Patterns use the syntax of path.Match, in
+// which * does not match the / separator, and must match the whole key.
+type LogFileKeyGlobFilter struct {
+	Pattern string
+}
+
+// FilterLogFile matches the key against the pattern. Malformed patterns
+// match nothing.
+func (f LogFileKeyGlobFilter) FilterLogFile(lf LogFile) bool {
+	var ok, _ = path.Match(f.Pattern, lf.Key)
+	return ok
+}
+
+// LogFileKeyRegexpFilter reduces the set to only those with a key that
+// contains a match of the regular expression.
+type LogFileKeyRegexpFilter struct {
+	Regexp *regexp.Regexp
+}
+
+// FilterLogFile matches the key against the regular expression.
+func (f LogFileKeyRegexpFilter) FilterLogFile(lf LogFile) bool {
+	return f.Regexp.MatchString(lf.Key)
+}
+
+// LogFileSizeFilter applies an inclusive bound to the size of all
+// files. A Max of zero leaves the size unbounded above.
+type LogFileSizeFilter struct {
+	Min int64
+	Max int64
+}
+
+// FilterLogFile applies the size bound checks.
+func (f LogFileSizeFilter) FilterLogFile(lf LogFile) bool {
+	return lf.Size >= f.Min && (f.Max < 1 || lf.Size <= f.Max)
+}
+
+// LogFileLastModifiedFilter applies an inclusive start/end time bound
+// to the time each file was last modified. A zero Start or End leaves
+// that side unbounded. Files without a known modification time fail
+// the filter unless it is unbounded on both sides.
+type LogFileLastModifiedFilter struct {
+	Start time.Time
+	End   time.Time
+}
+
+// FilterLogFile applies the time bound checks.
+func (f LogFileLastModifiedFilter) FilterLogFile(lf LogFile) bool {
+	if f.Start.IsZero() && f.End.IsZero() {
+		return true
+	}
+	return !lf.LastModified.IsZero() &&
+		(f.Start.IsZero() || !lf.LastModified.Before(f.Start)) &&
+		(f.End.IsZero() || !lf.LastModified.After(f.End))
+}
+
+// LogFileStorageClassFilter reduces the set to only those stored in a
+// particular set of S3 storage classes, such as STANDARD or GLACIER.
+type LogFileStorageClassFilter struct {
+	StorageClass map[string]bool
+}
+
+// FilterLogFile compares against the set of allowed storage classes.
+func (f LogFileStorageClassFilter) FilterLogFile(lf LogFile) bool {
+	return f.StorageClass[lf.StorageClass]
+}
+
 // BucketFilter is a BucketIterator wrapper that
-// drops anything that fails the filter check.
+// drops anything that fails the filter check. If the
+// wrapped iterator is an Acknowledger then dropped files
+// are acknowledged as they are skipped.
 type BucketFilter struct {
 	Filter LogFileFilter
 	BucketIterator
@@ -72,14 +181,30 @@ type BucketFilter struct {
 // Iterate will consume from the wrapped iterator until
 // an element is found that passes the filter.
 func (it *BucketFilter) Iterate() bool {
-	var more = it.BucketIterator.Iterate()
+	return it.IterateWithContext(context.Background())
+}
+
+// IterateWithContext is a variant of Iterate that passes the context
+// to the wrapped iterator if it is a ContextBucketIterator.
+func (it *BucketFilter) IterateWithContext(ctx context.Context) bool {
+	var more = iterateWithContext(ctx, it.BucketIterator)
 	if !more {
 		return false
 	}
 	var curr = it.BucketIterator.Current()
 	for more && !it.Filter.FilterLogFile(curr) {
-		more = it.BucketIterator.Iterate()
+		_ = it.Ack(curr)
+		more = iterateWithContext(ctx, it.BucketIterator)
 		curr = it.BucketIterator.Current()
 	}
 	return more
 }
+
+// Ack passes the acknowledgement through to the wrapped iterator
+// if it is an Acknowledger.
+func (it *BucketFilter) Ack(lf LogFile) error {
+	if ack, ok := it.BucketIterator.(Acknowledger); ok {
+		return ack.Ack(lf)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package vpcflow
 
 import (
+	"regexp"
 	"testing"
 	"time"
 
@@ -317,3 +318,48 @@ func TestBucketFilterReturnsAfterExhaustingIterator(t *testing.T) {
 	wrapped.EXPECT().Current().Return(lf)
 	assert.Equal(t, false, iter.Iterate())
 }
+
+func TestLogFileFilters(t *testing.T) {
+	var base = time.Date(2018, 10, 17, 0, 30, 0, 0, time.UTC)
+	var lf = LogFile{
+		Key:          "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz",
+		FlowLogID:    "fl-00123456789abcdef",
+		Size:         100,
+		LastModified: base,
+		StorageClass: "STANDARD",
+	}
+	var pass = LogFileFlowLogIDFilter{FlowLogID: map[string]bool{"fl-00123456789abcdef": true}}
+	var fail = LogFileFlowLogIDFilter{FlowLogID: map[string]bool{"fl-other": true}}
+	tc := []struct {
+		Name     string
+		Filter   LogFileFilter
+		Expected bool
+	}{
+		{Name: "any-pass", Filter: AnyLogFileFilter{fail, pass}, Expected: true},
+		{Name: "any-fail", Filter: AnyLogFileFilter{fail, fail}, Expected: false},
+		{Name: "any-empty", Filter: AnyLogFileFilter{}, Expected: false},
+		{Name: "not-pass", Filter: NotLogFileFilter{Filter: fail}, Expected: true},
+		{Name: "not-fail", Filter: NotLogFileFilter{Filter: pass}, Expected: false},
+		{Name: "glob-pass", Filter: LogFileKeyGlobFilter{Pattern: "AWSLogs/*/vpcflowlogs/us-*/2018/*/*/*.log.gz"}, Expected: true},
+		{Name: "glob-separator", Filter: LogFileKeyGlobFilter{Pattern: "AWSLogs/*.log.gz"}, Expected: false},
+		{Name: "glob-malformed", Filter: LogFileKeyGlobFilter{Pattern: "AWSLogs/["}, Expected: false},
+		{Name: "regexp-pass", Filter: LogFileKeyRegexpFilter{Regexp: regexp.MustCompile(`/2018/10/1[0-9]/`)}, Expected: true},
+		{Name: "regexp-fail", Filter: LogFileKeyRegexpFilter{Regexp: regexp.MustCompile(`^other/`)}, Expected: false},
+		{Name: "size-pass", Filter: LogFileSizeFilter{Min: 100, Max: 100}, Expected: true},
+		{Name: "size-unbounded", Filter: LogFileSizeFilter{Min: 1}, Expected: true},
+		{Name: "size-small", Filter: LogFileSizeFilter{Max: 99}, Expected: false},
+		{Name: "size-large", Filter: LogFileSizeFilter{Min: 101}, Expected: false},
+		{Name: "modified-pass", Filter: LogFileLastModifiedFilter{Start: base, End: base}, Expected: true},
+		{Name: "modified-start", Filter: LogFileLastModifiedFilter{Start: base.Add(time.Second)}, Expected: false},
+		{Name: "modified-end", Filter: LogFileLastModifiedFilter{End: base.Add(-time.Second)}, Expected: false},
+		{Name: "storage-pass", Filter: LogFileStorageClassFilter{StorageClass: map[string]bool{"STANDARD": true}}, Expected: true},
+		{Name: "storage-fail", Filter: LogFileStorageClassFilter{StorageClass: map[string]bool{"GLACIER": true}}, Expected: false},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, tt.Filter.FilterLogFile(lf))
+		})
+	}
+	assert.False(t, LogFileLastModifiedFilter{Start: base}.FilterLogFile(LogFile{}), "unknown modification time passed")
+	assert.True(t, LogFileLastModifiedFilter{}.FilterLogFile(LogFile{}))
+}
@@ -0,0 +1,445 @@
+package vpcflow
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field names as they appear in a flow log format string and in the
+// header line of each log file.
+const (
+	FieldVersion          = "version"
+	FieldAccountID        = "account-id"
+	FieldInterfaceID      = "interface-id"
+	FieldSrcAddr          = "srcaddr"
+	FieldDstAddr          = "dstaddr"
+	FieldSrcPort          = "srcport"
+	FieldDstPort          = "dstport"
+	FieldProtocol         = "protocol"
+	FieldPackets          = "packets"
+	FieldBytes            = "bytes"
+	FieldStart            = "start"
+	FieldEnd              = "end"
+	FieldAction           = "action"
+	FieldLogStatus        = "log-status"
+	FieldVPCID            = "vpc-id"
+	FieldSubnetID         = "subnet-id"
+	FieldInstanceID       = "instance-id"
+	FieldTCPFlags         = "tcp-flags"
+	FieldType             = "type"
+	FieldPktSrcAddr       = "pkt-srcaddr"
+	FieldPktDstAddr       = "pkt-dstaddr"
+	FieldRegion           = "region"
+	FieldAZID             = "az-id"
+	FieldSublocationType  = "sublocation-type"
+	FieldSublocationID    = "sublocation-id"
+	FieldPktSrcAWSService = "pkt-src-aws-service"
+	FieldPktDstAWSService = "pkt-dst-aws-service"
+	FieldFlowDirection    = "flow-direction"
+	FieldTrafficPath      = "traffic-path"
+)
+
+// emptyValue is the placeholder AWS writes for fields that have no
+// value in a record, such as the addresses of a NODATA record.
+const emptyValue = "-"
+
+// Format is the ordered list of fields contained in each line of
+// a flow log.
+type Format []string
+
+// DefaultFormat is the version 2 format that AWS uses when a flow
+// log is created without a custom format.
+var DefaultFormat = Format{
+	FieldVersion,
+	FieldAccountID,
+	FieldInterfaceID,
+	FieldSrcAddr,
+	FieldDstAddr,
+	FieldSrcPort,
+	FieldDstPort,
+	FieldProtocol,
+	FieldPackets,
+	FieldBytes,
+	FieldStart,
+	FieldEnd,
+	FieldAction,
+	FieldLogStatus,
+}
+
+// allFields is every supported field in the order used when
+// formats from different sources are merged.
+var allFields = append(append(Format{}, DefaultFormat...),
+	FieldVPCID,
+	FieldSubnetID,
+	FieldInstanceID,
+	FieldTCPFlags,
+	FieldType,
+	FieldPktSrcAddr,
+	FieldPktDstAddr,
+	FieldRegion,
+	FieldAZID,
+	FieldSublocationType,
+	FieldSublocationID,
+	FieldPktSrcAWSService,
+	FieldPktDstAWSService,
+	FieldFlowDirection,
+	FieldTrafficPath,
+)
+
+// ParseFormat converts either an AWS format string, such as
+// "${version} ${vpc-id} ${srcaddr}", or a log file header line, such
+// as "version vpc-id srcaddr", into a Format. Fields that are not
+// supported, such as those AWS adds after this package was written, are
+// kept so that each column of a line is matched to its field but their
+// values are ignored. An error is returned if a field name is malformed.
+func ParseFormat(s string) (Format, error) {
+	tokens := strings.Fields(s)
+	if len(tokens) < 1 {
+		return nil, fmt.Errorf("flow log format is empty")
+	}
+	format := make(Format, 0, len(tokens))
+	for _, token := range tokens {
+		field := strings.TrimSuffix(strings.TrimPrefix(token, "${"), "}")
+		if !isFieldName(field) {
+			return nil, fmt.Errorf("invalid flow log field %q", field)
+		}
+		format = append(format, field)
+	}
+	return format, nil
+}
+
+// isFieldName reports whether the name is made of the lower case letters,
+// digits, and dashes used in the names of flow log fields.
+func isFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeader reports whether the tokens of a line form a header line. Each
+// token must be a field name and at least one must be a supported field.
+func isHeader(attrs []string) bool {
+	var supported bool
+	for _, attr := range attrs {
+		if !isFieldName(attr) {
+			return false
+		}
+		_, ok := fieldCodecs[attr]
+		supported = supported || ok
+	}
+	return supported
+}
+
+// String renders the format as a log file header line.
+func (f Format) String() string {
+	return strings.Join(f, " ")
+}
+
+// Contains reports whether the field is part of the format.
+func (f Format) Contains(field string) bool {
+	return f.index(field) >= 0
+}
+
+// Equal reports whether both formats contain the same fields in
+// the same order.
+func (f Format) Equal(other Format) bool {
+	if len(f) != len(other) {
+		return false
+	}
+	for idx := range f {
+		if f[idx] != other[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Format) index(field string) int {
+	for idx, name := range f {
+		if name == field {
+			return idx
+		}
+	}
+	return -1
+}
+
+// mergeFormats produces a format that contains every supported field from
+// all the given formats, ordered as in allFields.
+func mergeFormats(formats ...Format) Format {
+	var merged Format
+	for _, field := range allFields {
+		for _, format := range formats {
+			if format.Contains(field) {
+				merged = append(merged, field)
+				break
+			}
+		}
+	}
+	return merged
+}
+
+// fieldCodec converts a single field between its text and FlowRecord
+// representations.
+type fieldCodec struct {
+	parse  func(*FlowRecord, string) error
+	format func(FlowRecord) string
+}
+
+// ignoredField is the codec of fields that are not supported. Their
+// values are dropped when parsed and written as empty.
+var ignoredField = fieldCodec{
+	parse:  func(*FlowRecord, string) error { return nil },
+	format: func(FlowRecord) string { return emptyValue },
+}
+
+// codecOf gets the codec of a field.
+func codecOf(field string) fieldCodec {
+	if codec, ok := fieldCodecs[field]; ok {
+		return codec
+	}
+	return ignoredField
+}
+
+var fieldCodecs = map[string]fieldCodec{
+	FieldVersion: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.Version, err = parseInt(v); return err },
+		format: func(r FlowRecord) string { return strconv.Itoa(r.Version) },
+	},
+	FieldAccountID: {
+		parse:  func(r *FlowRecord, v string) error { r.AccountID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.AccountID) },
+	},
+	FieldInterfaceID: {
+		parse:  func(r *FlowRecord, v string) error { r.InterfaceID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.InterfaceID) },
+	},
+	FieldSrcAddr: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.SrcAddr, err = parseIP(v); return err },
+		format: func(r FlowRecord) string { return formatIP(r.SrcAddr) },
+	},
+	FieldDstAddr: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.DstAddr, err = parseIP(v); return err },
+		format: func(r FlowRecord) string { return formatIP(r.DstAddr) },
+	},
+	FieldSrcPort: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.SrcPort, err = parseInt(v); return err },
+		format: func(r FlowRecord) string { return strconv.Itoa(r.SrcPort) },
+	},
+	FieldDstPort: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.DstPort, err = parseInt(v); return err },
+		format: func(r FlowRecord) string { return strconv.Itoa(r.DstPort) },
+	},
+	FieldProtocol: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.Protocol, err = parseInt(v); return err },
+		format: func(r FlowRecord) string { return strconv.Itoa(r.Protocol) },
+	},
+	FieldPackets: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.Packets, err = parseInt64(v); return err },
+		format: func(r FlowRecord) string { return strconv.FormatInt(r.Packets, 10) },
+	},
+	FieldBytes: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.Bytes, err = parseInt64(v); return err },
+		format: func(r FlowRecord) string { return strconv.FormatInt(r.Bytes, 10) },
+	},
+	FieldStart: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.Start, err = parseUnixTime(v); return err },
+		format: func(r FlowRecord) string { return formatUnixTime(r.Start) },
+	},
+	FieldEnd: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.End, err = parseUnixTime(v); return err },
+		format: func(r FlowRecord) string { return formatUnixTime(r.End) },
+	},
+	FieldAction: {
+		parse:  func(r *FlowRecord, v string) error { r.Action = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.Action) },
+	},
+	FieldLogStatus: {
+		parse:  func(r *FlowRecord, v string) error { r.LogStatus = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.LogStatus) },
+	},
+	FieldVPCID: {
+		parse:  func(r *FlowRecord, v string) error { r.VPCID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.VPCID) },
+	},
+	FieldSubnetID: {
+		parse:  func(r *FlowRecord, v string) error { r.SubnetID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.SubnetID) },
+	},
+	FieldInstanceID: {
+		parse:  func(r *FlowRecord, v string) error { r.InstanceID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.InstanceID) },
+	},
+	FieldTCPFlags: {
+		parse: func(r *FlowRecord, v string) (err error) {
+			r.TCPFlags, err = parseInt(v)
+			r.zeroTCPFlags = r.TCPFlags == 0 && v != emptyValue
+			return err
+		},
+		format: func(r FlowRecord) string {
+			if r.zeroTCPFlags {
+				return strconv.Itoa(r.TCPFlags)
+			}
+			return formatOptionalInt(r.TCPFlags)
+		},
+	},
+	FieldType: {
+		parse:  func(r *FlowRecord, v string) error { r.Type = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.Type) },
+	},
+	FieldPktSrcAddr: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.PktSrcAddr, err = parseIP(v); return err },
+		format: func(r FlowRecord) string { return formatIP(r.PktSrcAddr) },
+	},
+	FieldPktDstAddr: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.PktDstAddr, err = parseIP(v); return err },
+		format: func(r FlowRecord) string { return formatIP(r.PktDstAddr) },
+	},
+	FieldRegion: {
+		parse:  func(r *FlowRecord, v string) error { r.Region = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.Region) },
+	},
+	FieldAZID: {
+		parse:  func(r *FlowRecord, v string) error { r.AZID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.AZID) },
+	},
+	FieldSublocationType: {
+		parse:  func(r *FlowRecord, v string) error { r.SublocationType = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.SublocationType) },
+	},
+	FieldSublocationID: {
+		parse:  func(r *FlowRecord, v string) error { r.SublocationID = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.SublocationID) },
+	},
+	FieldPktSrcAWSService: {
+		parse:  func(r *FlowRecord, v string) error { r.PktSrcAWSService = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.PktSrcAWSService) },
+	},
+	FieldPktDstAWSService: {
+		parse:  func(r *FlowRecord, v string) error { r.PktDstAWSService = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.PktDstAWSService) },
+	},
+	FieldFlowDirection: {
+		parse:  func(r *FlowRecord, v string) error { r.FlowDirection = parseString(v); return nil },
+		format: func(r FlowRecord) string { return formatString(r.FlowDirection) },
+	},
+	FieldTrafficPath: {
+		parse:  func(r *FlowRecord, v string) (err error) { r.TrafficPath, err = parseInt(v); return err },
+		format: func(r FlowRecord) string { return formatOptionalInt(r.TrafficPath) },
+	},
+}
+
+// parseFlowRecord converts the tokenized attributes of a log line into a FlowRecord.
+func parseFlowRecord(format Format, attrs []string) (FlowRecord, error) {
+	var r FlowRecord
+	if len(attrs) != len(format) {
+		return r, fmt.Errorf("expected %d fields but found %d", len(format), len(attrs))
+	}
+	for idx, field := range format {
+		if err := codecOf(field).parse(&r, attrs[idx]); err != nil {
+			return r, fmt.Errorf("invalid %s. %s", field, err)
+		}
+	}
+	return r, nil
+}
+
+// attrs converts the record into the tokenized attributes of a log line
+// in the given format.
+func (r FlowRecord) attrs(format Format) []string {
+	attrs := make([]string, len(format))
+	for idx, field := range format {
+		attrs[idx] = codecOf(field).format(r)
+	}
+	return attrs
+}
+
+// Format renders the record as a space delimited VPC Flow log line
+// containing the given fields.
+func (r FlowRecord) Format(format Format) string {
+	return strings.Join(r.attrs(format), " ")
+}
+
+// String renders the record as a space delimited VPC Flow log line
+// in the DefaultFormat.
+func (r FlowRecord) String() string {
+	return r.Format(DefaultFormat)
+}
+
+func parseString(val string) string {
+	if val == emptyValue {
+		return ""
+	}
+	return val
+}
+
+func parseInt(val string) (int, error) {
+	if val == emptyValue {
+		return 0, nil
+	}
+	return strconv.Atoi(val)
+}
+
+func parseInt64(val string) (int64, error) {
+	if val == emptyValue {
+		return 0, nil
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+func parseIP(val string) (net.IP, error) {
+	if val == emptyValue {
+		return nil, nil
+	}
+	ip := net.ParseIP(val)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", val)
+	}
+	return ip, nil
+}
+
+func parseUnixTime(val string) (time.Time, error) {
+	if val == emptyValue {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+func formatString(val string) string {
+	if val == "" {
+		return emptyValue
+	}
+	return val
+}
+
+func formatOptionalInt(val int) string {
+	if val == 0 {
+		return emptyValue
+	}
+	return strconv.Itoa(val)
+}
+
+func formatIP(val net.IP) string {
+	if val == nil {
+		return emptyValue
+	}
+	return val.String()
+}
+
+func formatUnixTime(val time.Time) string {
+	if val.IsZero() {
+		return emptyValue
+	}
+	return strconv.FormatInt(val.Unix(), 10)
+}
@@ -0,0 +1,132 @@
+package vpcflow
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormat(t *testing.T) {
+	tc := []struct {
+		Name          string
+		Input         string
+		Expected      Format
+		ExpectedError bool
+	}{
+		{
+			Name:     "format-string",
+			Input:    "${version} ${vpc-id} ${srcaddr} ${dstaddr} ${tcp-flags}",
+			Expected: Format{FieldVersion, FieldVPCID, FieldSrcAddr, FieldDstAddr, FieldTCPFlags},
+		},
+		{
+			Name:     "header-line",
+			Input:    "version vpc-id srcaddr dstaddr tcp-flags\n",
+			Expected: Format{FieldVersion, FieldVPCID, FieldSrcAddr, FieldDstAddr, FieldTCPFlags},
+		},
+		{
+			Name:     "default",
+			Input:    DefaultFormat.String(),
+			Expected: DefaultFormat,
+		},
+		{
+			Name:     "unsupported-field",
+			Input:    "${version} ${not-a-field}",
+			Expected: Format{FieldVersion, "not-a-field"},
+		},
+		{
+			Name:          "malformed-field",
+			Input:         "${version} ${Not_A_Field}",
+			ExpectedError: true,
+		},
+		{
+			Name:          "empty",
+			Input:         " ",
+			ExpectedError: true,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			format, err := ParseFormat(tt.Input)
+			if tt.ExpectedError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.Expected, format)
+		})
+	}
+}
+
+func TestFormatEqual(t *testing.T) {
+	assert.True(t, DefaultFormat.Equal(append(Format{}, DefaultFormat...)))
+	assert.False(t, DefaultFormat.Equal(DefaultFormat[1:]))
+	assert.False(t, Format{FieldSrcAddr, FieldDstAddr}.Equal(Format{FieldDstAddr, FieldSrcAddr}))
+}
+
+func TestMergeFormats(t *testing.T) {
+	merged := mergeFormats(
+		Format{FieldTCPFlags, FieldSrcAddr},
+		Format{FieldDstAddr, FieldVPCID, FieldSrcAddr},
+	)
+	assert.Equal(t, Format{FieldSrcAddr, FieldDstAddr, FieldVPCID, FieldTCPFlags}, merged)
+	assert.Equal(t, DefaultFormat, mergeFormats(DefaultFormat, DefaultFormat))
+}
+
+func TestFlowRecordCustomFormat(t *testing.T) {
+	format, _ := ParseFormat("${version} ${vpc-id} ${subnet-id} ${instance-id} ${interface-id} ${srcaddr} ${dstaddr} ${pkt-srcaddr} ${pkt-dstaddr} ${tcp-flags} ${type} ${region} ${az-id} ${sublocation-type} ${sublocation-id} ${pkt-src-aws-service} ${pkt-dst-aws-service} ${flow-direction} ${traffic-path}")
+	line := "5 vpc-abcdefab012345678 subnet-aaaaaaaa012345678 i-0c50d5961bcb2d47b eni-1235b8ca123456789 10.0.1.5 10.0.0.220 10.0.1.5 203.0.113.5 3 IPv4 us-east-1 use1-az1 - - - S3 egress 8"
+
+	record, err := parseFlowRecord(format, strings.Fields(line))
+	assert.Nil(t, err)
+	assert.Equal(t, FlowRecord{
+		Version:          5,
+		VPCID:            "vpc-abcdefab012345678",
+		SubnetID:         "subnet-aaaaaaaa012345678",
+		InstanceID:       "i-0c50d5961bcb2d47b",
+		InterfaceID:      "eni-1235b8ca123456789",
+		SrcAddr:          net.ParseIP("10.0.1.5"),
+		DstAddr:          net.ParseIP("10.0.0.220"),
+		PktSrcAddr:       net.ParseIP("10.0.1.5"),
+		PktDstAddr:       net.ParseIP("203.0.113.5"),
+		TCPFlags:         3,
+		Type:             "IPv4",
+		Region:           "us-east-1",
+		AZID:             "use1-az1",
+		PktDstAWSService: "S3",
+		FlowDirection:    "egress",
+		TrafficPath:      8,
+	}, record)
+	assert.Equal(t, line, record.Format(format))
+}
+
+func TestFlowRecordOptionalFields(t *testing.T) {
+	format := Format{FieldVersion, FieldTCPFlags, FieldTrafficPath}
+	record, err := parseFlowRecord(format, strings.Fields("5 - -"))
+	assert.Nil(t, err)
+	assert.Equal(t, "5 - -", record.Format(format))
+}
+
+func TestFlowRecordZeroTCPFlags(t *testing.T) {
+	format := Format{FieldVersion, FieldSrcAddr, FieldDstAddr, FieldTCPFlags}
+	line := "5 10.0.0.1 10.0.0.2 0"
+	record, err := parseFlowRecord(format, strings.Fields(line))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, record.TCPFlags)
+	assert.Equal(t, line, record.Format(format))
+
+	// Records without the field still write it as missing.
+	record, err = parseFlowRecord(Format{FieldVersion, FieldSrcAddr, FieldDstAddr}, strings.Fields("5 10.0.0.1 10.0.0.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "5 10.0.0.1 10.0.0.2 -", record.Format(format))
+}
+
+func TestParseFlowRecordBadField(t *testing.T) {
+	format := Format{FieldSrcAddr, FieldTCPFlags}
+	_, err := parseFlowRecord(format, []string{"10.0.0.1", "SYN"})
+	assert.NotNil(t, err)
+	_, err = parseFlowRecord(format, []string{"10.0.0.1"})
+	assert.NotNil(t, err)
+}
@@ -1,11 +1,11 @@
 module github.com/asecurityteam/go-vpcflow
 
-go 1.12
+go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.17.5
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/mock v1.2.0
-	github.com/stretchr/testify v1.3.0
+	github.com/fraugster/parquet-go v0.12.0
+	github.com/golang/mock v1.5.0
+	github.com/stretchr/testify v1.7.0
 	gonum.org/v1/gonum v0.0.0-20181210083604-572d9101fe4f
 )
@@ -0,0 +1,224 @@
+package vpcflow
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logsDirectory   = "AWSLogs"
+	serviceName     = "vpcflowlogs"
+	timestampFormat = "20060102T1504Z"
+)
+
+// KeyParser converts the S3 object key of a VPC Flow log file into
+// a LogFile. Only the Key, Account, Region, Timestamp, FlowLogID, and
+// Hash values are expected to be set. Keys that cannot be parsed must
+// result in a *KeyError.
+type KeyParser interface {
+	ParseKey(key string) (LogFile, error)
+}
+
+// KeyParserFunc adapts a function to the KeyParser interface.
+type KeyParserFunc func(key string) (LogFile, error)
+
+// ParseKey calls the underlying function.
+func (f KeyParserFunc) ParseKey(key string) (LogFile, error) {
+	return f(key)
+}
+
+// KeyError is returned when an object key does not match the expected
+// layout of a VPC Flow log file.
+type KeyError struct {
+	// Key is the object key that could not be parsed.
+	Key string
+	// Reason describes the part of the key that did not match.
+	Reason string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("error parsing logfile name %s. %s", e.Key, e.Reason)
+}
+
+// KeyErrorPolicy determines how an iterator handles object keys that
+// cannot be parsed.
+type KeyErrorPolicy int
+
+const (
+	// FailOnKeyError stops iteration at the first key that cannot be
+	// parsed. The *KeyError is returned when closing the iterator.
+	FailOnKeyError KeyErrorPolicy = iota
+	// SkipOnKeyError drops any key that cannot be parsed and continues.
+	SkipOnKeyError
+)
+
+// KeyLayout is a KeyParser for the key layouts AWS uses when delivering
+// flow logs to S3. These take the form of
+//
+//	<prefix>/AWSLogs/<account>/vpcflowlogs/<region>/YYYY/MM/DD/<file>
+//
+// with an optional organization ID segment after AWSLogs and an optional
+// hour segment after the day. Hive-compatible keys, in which each directory
+// is written as name=value (aws-account-id=, aws-service=, aws-region=,
+// year=, month=, day=, hour=), are also accepted. The file name is always
+//
+//	<account>_vpcflowlogs_<region>_<flow_log_id>_<timestamp>_<hash>.log.gz
+//
+// or the same with a .log.parquet suffix. Keys without an AWSLogs directory,
+// such as bare file names or copies under a custom directory structure, are
+// parsed from the file name alone.
+//
+// ParseKey accepts every variant of the layout regardless of the
+// OrganizationID, HiveCompatible, and HourlyPartitions settings. Those are
+// only used to build the prefixes of partitions with PartitionPrefix.
+type KeyLayout struct {
+	// Prefix, if set, must be present at the start of every key.
+	Prefix string
+	// OrganizationID is the AWS Organizations ID included in the keys
+	// of logs delivered for an organization.
+	OrganizationID string
+	// HiveCompatible indicates that directories are written as
+	// name=value pairs.
+	HiveCompatible bool
+	// HourlyPartitions indicates that files are partitioned by hour
+	// rather than by day.
+	HourlyPartitions bool
+}
+
+// ParseKey validates the key against the layout and extracts the log file
+// metadata. A *KeyError is returned if the key does not match.
+func (l KeyLayout) ParseKey(key string) (LogFile, error) {
+	if !strings.HasPrefix(key, l.Prefix) {
+		return LogFile{}, &KeyError{Key: key, Reason: fmt.Sprintf("key does not begin with prefix %q", l.Prefix)}
+	}
+	var dir, name = path.Split(key)
+	var logfile, reason = parseLogFileName(name)
+	if reason != "" {
+		return LogFile{}, &KeyError{Key: key, Reason: reason}
+	}
+	logfile.Key = key
+	if reason = checkLogFileDir(strings.TrimPrefix(dir, l.Prefix), logfile); reason != "" {
+		return LogFile{}, &KeyError{Key: key, Reason: reason}
+	}
+	return logfile, nil
+}
+
+// PartitionPrefix builds the key prefix of the given account and region. The
+// prefix contains the year, month, day, and hour directories for the given
+// time down to and including the directory of the given unit.
+func (l KeyLayout) PartitionPrefix(account string, region string, t time.Time, unit PartitionUnit) string {
+	var segments = make([]string, 0, 10)
+	if l.Prefix != "" {
+		segments = append(segments, strings.TrimSuffix(l.Prefix, "/"))
+	}
+	segments = append(segments, logsDirectory)
+	var parts = []struct {
+		name  string
+		value string
+	}{
+		{name: "aws-organization-id", value: l.OrganizationID},
+		{name: "aws-account-id", value: account},
+		{name: "aws-service", value: serviceName},
+		{name: "aws-region", value: region},
+	}
+	t = t.UTC()
+	var dateParts = []struct {
+		name  string
+		value string
+	}{
+		{name: "year", value: t.Format("2006")},
+		{name: "month", value: t.Format("01")},
+		{name: "day", value: t.Format("02")},
+		{name: "hour", value: t.Format("15")},
+	}
+	parts = append(parts, dateParts[:int(unit)+1]...)
+	for _, part := range parts {
+		if part.value == "" {
+			continue
+		}
+		if l.HiveCompatible {
+			segments = append(segments, part.name+"="+part.value)
+			continue
+		}
+		segments = append(segments, part.value)
+	}
+	return strings.Join(segments, "/") + "/"
+}
+
+// parseLogFileName extracts metadata from a log file name. A non-empty reason
+// is returned if the name is not valid.
+func parseLogFileName(name string) (LogFile, string) {
+	var logfile LogFile
+	var elements = strings.Split(name, "_")
+	if len(elements) != 6 {
+		return logfile, fmt.Sprintf("expected 6 elements in log file name but found %d", len(elements))
+	}
+	if elements[1] != serviceName {
+		return logfile, fmt.Sprintf("expected %s in log file name but found %q", serviceName, elements[1])
+	}
+	var timestamp, err = time.Parse(timestampFormat, elements[4])
+	if err != nil {
+		return logfile, "timestamp could not be parsed from log file name. " + err.Error()
+	}
+	logfile.Account = elements[0]
+	logfile.Region = elements[2]
+	logfile.FlowLogID = elements[3]
+	logfile.Timestamp = timestamp
+	logfile.Hash = strings.Split(elements[5], ".")[0]
+	if logfile.Account == "" || logfile.Region == "" || logfile.FlowLogID == "" || logfile.Hash == "" {
+		return LogFile{}, "log file name contains an empty element"
+	}
+	return logfile, ""
+}
+
+// checkLogFileDir verifies that the directories in which a log file is found
+// agree with the file name. A non-empty reason is returned if they do not.
+func checkLogFileDir(dir string, logfile LogFile) string {
+	var segments = strings.Split(strings.Trim(dir, "/"), "/")
+	var start = -1
+	for idx, segment := range segments {
+		if segment == logsDirectory {
+			start = idx + 1
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+	segments = segments[start:]
+	if len(segments) > 0 && (strings.HasPrefix(segments[0], "aws-organization-id=") || strings.HasPrefix(segments[0], "o-")) {
+		segments = segments[1:]
+	}
+	if len(segments) != 6 && len(segments) != 7 {
+		return fmt.Sprintf("expected 6 or 7 directories after %s but found %d", logsDirectory, len(segments))
+	}
+	var expected = []struct {
+		name  string
+		value string
+	}{
+		{name: "aws-account-id", value: logfile.Account},
+		{name: "aws-service", value: serviceName},
+		{name: "aws-region", value: logfile.Region},
+		{name: "year"},
+		{name: "month"},
+		{name: "day"},
+		{name: "hour"},
+	}
+	for idx, segment := range segments {
+		var value = strings.TrimPrefix(segment, expected[idx].name+"=")
+		if expected[idx].value == "" {
+			// Files are delivered into the partition for the time at which
+			// they were published so it may differ from the file name.
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Sprintf("invalid %s directory %q", expected[idx].name, segment)
+			}
+			continue
+		}
+		if value != expected[idx].value {
+			return fmt.Sprintf("expected %s directory %q but found %q", expected[idx].name, expected[idx].value, segment)
+		}
+	}
+	return ""
+}
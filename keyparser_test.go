@@ -0,0 +1,153 @@
+package vpcflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLogFileName = "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"
+
+func TestKeyLayoutParseKey(t *testing.T) {
+	tc := []struct {
+		Name          string
+		Prefix        string
+		Key           string
+		ExpectedError bool
+	}{
+		{
+			Name: "bare-file-name",
+			Key:  testLogFileName,
+		},
+		{
+			Name: "default",
+			Key:  "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/" + testLogFileName,
+		},
+		{
+			Name: "hourly",
+			Key:  "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/00/" + testLogFileName,
+		},
+		{
+			Name: "hive",
+			Key:  "AWSLogs/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/" + testLogFileName,
+		},
+		{
+			Name: "hive-hourly",
+			Key:  "AWSLogs/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/hour=00/" + testLogFileName,
+		},
+		{
+			Name: "organization",
+			Key:  "AWSLogs/o-abcde12345/123456789012/vpcflowlogs/us-west-2/2018/10/17/" + testLogFileName,
+		},
+		{
+			Name: "hive-organization",
+			Key:  "AWSLogs/aws-organization-id=o-abcde12345/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/" + testLogFileName,
+		},
+		{
+			Name:   "custom-prefix",
+			Prefix: "flowlogs/prod/",
+			Key:    "flowlogs/prod/AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/" + testLogFileName,
+		},
+		{
+			Name: "custom-directories",
+			Key:  "archive/2018-10/" + testLogFileName,
+		},
+		{
+			Name: "parquet",
+			Key:  "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.parquet",
+		},
+		{
+			Name:          "wrong-prefix",
+			Prefix:        "flowlogs/prod/",
+			Key:           "flowlogs/dev/AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/" + testLogFileName,
+			ExpectedError: true,
+		},
+		{
+			Name:          "directory",
+			Key:           "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+			ExpectedError: true,
+		},
+		{
+			Name:          "too-few-name-elements",
+			Key:           "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs.log.gz",
+			ExpectedError: true,
+		},
+		{
+			Name:          "other-service",
+			Key:           "123456789012_CloudTrail_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz",
+			ExpectedError: true,
+		},
+		{
+			Name:          "empty-element",
+			Key:           "123456789012_vpcflowlogs__fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz",
+			ExpectedError: true,
+		},
+		{
+			Name:          "mismatched-account",
+			Key:           "AWSLogs/210987654321/vpcflowlogs/us-west-2/2018/10/17/" + testLogFileName,
+			ExpectedError: true,
+		},
+		{
+			Name:          "mismatched-region",
+			Key:           "AWSLogs/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-east-1/year=2018/month=10/day=17/" + testLogFileName,
+			ExpectedError: true,
+		},
+		{
+			Name:          "truncated-path",
+			Key:           "AWSLogs/123456789012/vpcflowlogs/" + testLogFileName,
+			ExpectedError: true,
+		},
+		{
+			Name:          "invalid-date",
+			Key:           "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/oct/17/" + testLogFileName,
+			ExpectedError: true,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var lf, err = KeyLayout{Prefix: tt.Prefix}.ParseKey(tt.Key)
+			if tt.ExpectedError {
+				assert.IsType(t, &KeyError{}, err)
+				assert.Equal(t, tt.Key, err.(*KeyError).Key)
+				assert.Equal(t, LogFile{}, lf)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, LogFile{
+				Key:       tt.Key,
+				Account:   "123456789012",
+				Region:    "us-west-2",
+				Timestamp: time.Date(2018, 10, 17, 00, 30, 00, 00, time.UTC),
+				FlowLogID: "fl-00123456789abcdef",
+				Hash:      "0a1b2c3d",
+			}, lf)
+		})
+	}
+}
+
+func TestIterateWithCustomKeyParser(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var bi = BucketStateIterator{
+		Bucket: "testbucket",
+		Queue:  queue,
+		KeyParser: KeyParserFunc(func(key string) (LogFile, error) {
+			return LogFile{Key: key, Account: "custom"}, nil
+		}),
+	}
+	var output = s3.ListObjectsV2Output{
+		Contents: []*s3.Object{{Key: aws.String("anything"), Size: aws.Int64(100)}},
+	}
+
+	queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&output, nil)
+
+	assert.Equal(t, true, bi.Iterate())
+	assert.Equal(t, LogFile{Bucket: "testbucket", Key: "anything", Account: "custom", Size: 100}, bi.Current())
+	assert.Nil(t, bi.Close())
+}
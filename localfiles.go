@@ -0,0 +1,211 @@
+package vpcflow
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DirectoryBucketIterator implements the BucketIterator interface for a
+// local copy of a flow log bucket. Every file below Root is treated as an
+// object whose key is the slash separated path relative to Root, so a tree
+// copied from S3 produces the same LogFile values as the bucket itself. The
+// Bucket of each LogFile is set to Root so that the file can be found again.
+//
+// Files are visited in lexical order of their keys to match the ordering of
+// ListObjectsV2. Keys are parsed and errors are handled in the same way as
+// the BucketStateIterator.
+type DirectoryBucketIterator struct {
+	Root           string
+	Prefix         string
+	KeyParser      KeyParser
+	KeyErrorPolicy KeyErrorPolicy
+
+	initialized bool
+	files       []LogFile
+	position    int
+	error       error
+}
+
+// Iterate moves to the next log file in the directory.
+func (iter *DirectoryBucketIterator) Iterate() bool {
+	if !iter.initialized {
+		iter.initialized = true
+		iter.position = -1
+		iter.files, iter.error = iter.walk()
+	}
+	if iter.error != nil || iter.position >= len(iter.files) {
+		return false
+	}
+	iter.position = iter.position + 1
+	return iter.position < len(iter.files)
+}
+
+func (iter *DirectoryBucketIterator) walk() ([]LogFile, error) {
+	var files []LogFile
+	var err = filepath.Walk(iter.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Size() == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(iter.Root, path)
+		if err != nil {
+			return err
+		}
+		var key = filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, iter.Prefix) {
+			return nil
+		}
+		logfile, err := parseLogFile(iter.KeyParser, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		}, iter.Root)
+		if err != nil {
+			if iter.KeyErrorPolicy == SkipOnKeyError {
+				return nil
+			}
+			return err
+		}
+		files = append(files, logfile)
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(*KeyError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error getting log file metadata. %s", err)
+	}
+	// Walk orders by path elements which differs from the key order
+	// when names contain characters that sort before the separator.
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
+
+// Current gets the current value of the iterator.
+func (iter *DirectoryBucketIterator) Current() LogFile {
+	if !iter.initialized || iter.position < 0 || iter.position >= len(iter.files) {
+		return LogFile{}
+	}
+	return iter.files[iter.position]
+}
+
+// Close cleans up any resources used by the iterator and
+// returns an error, if any, that caused iterations to stop.
+func (iter *DirectoryBucketIterator) Close() error {
+	iter.initialized = true
+	iter.files = nil
+	iter.position = 0
+	return iter.error
+}
+
+// localFile is a decompressed reader of an open file.
+type localFile struct {
+	io.Reader
+	file    *os.File
+	logFile LogFile
+}
+
+// LocalFileManager implements the FileManager interface for log files that
+// are stored on the local filesystem, such as those produced by the
+// DirectoryBucketIterator. The file of each LogFile is found by joining the
+// Bucket and Key. Files are opened one at a time when requested and are
+// closed when they are returned with Put. If the BucketIterator is an
+// Acknowledger then files are acknowledged as they are returned with Put.
+type LocalFileManager struct {
+	BucketIterator BucketIterator
+
+	done bool
+	acks ackErrors
+}
+
+// Get opens the next file of the iterator. A nil reader is returned once
+// the iterator is exhausted.
+func (f *LocalFileManager) Get() (io.Reader, error) {
+	return f.GetWithContext(context.Background())
+}
+
+// GetWithContext is a variant of Get that stops waiting on the iterator
+// once ctx is done.
+func (f *LocalFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
+	if e := f.acks.take(); e != nil {
+		return nil, e
+	}
+	if f.done {
+		return nil, nil
+	}
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	if !iterateWithContext(ctx, f.BucketIterator) {
+		f.done = true
+		if e := f.BucketIterator.Close(); e != nil {
+			return nil, e
+		}
+		return nil, nil
+	}
+	var lf = f.BucketIterator.Current()
+	var r, e = openLocalFile(lf)
+	if e != nil {
+		return nil, &LogFileError{LogFile: lf, Err: e}
+	}
+	return r, nil
+}
+
+// Source returns the LogFile from which a reader was opened.
+func (f *LocalFileManager) Source(r io.Reader) (LogFile, bool) {
+	var file, ok = r.(*localFile)
+	if !ok {
+		return LogFile{}, false
+	}
+	return file.logFile, true
+}
+
+// Put closes a file that has been consumed. If the BucketIterator is an
+// Acknowledger then the file is acknowledged as consumed and an error
+// doing so is returned by the next Get.
+func (f *LocalFileManager) Put(r io.Reader) {
+	var file, ok = r.(*localFile)
+	if !ok {
+		return
+	}
+	_ = file.file.Close()
+	f.acks.ack(f.BucketIterator, file.logFile)
+}
+
+func openLocalFile(lf LogFile) (io.Reader, error) {
+	var file, e = os.Open(filepath.Join(lf.Bucket, filepath.FromSlash(lf.Key)))
+	if e != nil {
+		return nil, e
+	}
+	var result io.Reader
+	if isParquet(lf.Key) {
+		result, e = NewParquetReader(file)
+	} else {
+		result, e = gzip.NewReader(file)
+	}
+	if e != nil {
+		_ = file.Close()
+		return nil, e
+	}
+	return &localFile{Reader: result, file: file, logFile: lf}, nil
+}
+
+// NewLocalFilePolicy implements the signature required for the
+// BucketIteratorReader.FetchPolicy by producing a FileManager that
+// reads files from the local filesystem.
+func NewLocalFilePolicy() func(BucketIterator) FileManager {
+	return func(iter BucketIterator) FileManager {
+		return &LocalFileManager{BucketIterator: iter}
+	}
+}
@@ -0,0 +1,188 @@
+package vpcflow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testLocalDir = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/"
+
+func writeTestTree(t *testing.T, files map[string]string) string {
+	var root, err = ioutil.TempDir("", "vpcflow")
+	assert.Nil(t, err)
+	for name, content := range files {
+		var path = filepath.Join(root, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+		var b bytes.Buffer
+		if strings.HasSuffix(name, ".gz") {
+			var gz = gzip.NewWriter(&b)
+			_, _ = gz.Write([]byte(content))
+			_ = gz.Close()
+		} else {
+			b.WriteString(content)
+		}
+		assert.Nil(t, ioutil.WriteFile(path, b.Bytes(), 0600))
+	}
+	return root
+}
+
+func TestDirectoryBucketIterator(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_b.log.gz": "b",
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "a",
+		"AWSLogs/notes.txt": "not a log file",
+		"AWSLogs/empty":     "",
+	})
+	defer os.RemoveAll(root)
+
+	var iter = &DirectoryBucketIterator{Root: root, KeyErrorPolicy: SkipOnKeyError}
+	var hashes []string
+	for iter.Iterate() {
+		var lf = iter.Current()
+		assert.Equal(t, root, lf.Bucket)
+		assert.Equal(t, "123456789012", lf.Account)
+		assert.True(t, lf.Size > 0)
+		assert.True(t, strings.HasPrefix(lf.Key, testLocalDir))
+		hashes = append(hashes, lf.Hash)
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []string{"a", "b"}, hashes)
+	assert.Equal(t, LogFile{}, iter.Current())
+
+	iter = &DirectoryBucketIterator{Root: root}
+	assert.False(t, iter.Iterate())
+	assert.IsType(t, &KeyError{}, iter.Close())
+
+	iter = &DirectoryBucketIterator{Root: root, Prefix: "AWSLogs/123456789012/"}
+	assert.True(t, iter.Iterate())
+	assert.True(t, iter.Iterate())
+	assert.False(t, iter.Iterate())
+	assert.Nil(t, iter.Close())
+
+	iter = &DirectoryBucketIterator{Root: filepath.Join(root, "missing")}
+	assert.False(t, iter.Iterate())
+	assert.NotNil(t, iter.Close())
+}
+
+func TestLocalFileManager(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "a\n",
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_b.log.gz": "b\n",
+	})
+	defer os.RemoveAll(root)
+	// Corrupt files are reported but do not stop the remaining files
+	// from being read.
+	var corrupt = filepath.Join(root, filepath.FromSlash(testLocalDir+"123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_aa.log.gz"))
+	assert.Nil(t, ioutil.WriteFile(corrupt, []byte("not gzip"), 0600))
+
+	var r = &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewLocalFilePolicy(),
+	}
+	var b bytes.Buffer
+	var errs int
+	for {
+		var chunk = make([]byte, 1024)
+		var n, err = r.Read(chunk)
+		b.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = errs + 1
+		}
+	}
+	assert.Equal(t, 1, errs)
+	assert.Equal(t, "a\nb\n", b.String())
+	assert.Nil(t, r.Close())
+
+	var fm = &LocalFileManager{BucketIterator: &DirectoryBucketIterator{Root: filepath.Join(root, "missing")}}
+	var f, err = fm.Get()
+	assert.Nil(t, f)
+	assert.NotNil(t, err)
+	f, err = fm.Get()
+	assert.Nil(t, f)
+	assert.Nil(t, err)
+}
+
+// ackingBucketIterator records the keys of the files it acknowledges
+// and fails each acknowledgement with err, if set.
+type ackingBucketIterator struct {
+	BucketIterator
+	acked []string
+	err   error
+}
+
+func (iter *ackingBucketIterator) Ack(lf LogFile) error {
+	iter.acked = append(iter.acked, lf.Key)
+	return iter.err
+}
+
+func TestLocalFileManagerAck(t *testing.T) {
+	var name = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz"
+	var root = writeTestTree(t, map[string]string{name: "a\n"})
+	defer os.RemoveAll(root)
+
+	var iter = &ackingBucketIterator{BucketIterator: &DirectoryBucketIterator{Root: root}}
+	var fm = NewLocalFilePolicy()(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	assert.Empty(t, iter.acked)
+	fm.Put(r)
+	assert.Equal(t, []string{name}, iter.acked)
+
+	// A failed acknowledgement is returned by the next Get.
+	var ackErr = errors.New("ack failed")
+	iter = &ackingBucketIterator{BucketIterator: &DirectoryBucketIterator{Root: root}, err: ackErr}
+	fm = NewLocalFilePolicy()(iter)
+	r, err = fm.Get()
+	assert.Nil(t, err)
+	fm.Put(r)
+	_, err = fm.Get()
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, ackErr, err.(*AckError).Err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	r, err = fm.(ContextFileManager).GetWithContext(ctx)
+	assert.Nil(t, r)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestLocalFilesDigest(t *testing.T) {
+	var root = writeTestTree(t, map[string]string{
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz": "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n",
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0130Z_a.log.gz": "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20642 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n",
+		testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0230Z_a.log.gz": "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20643 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n",
+	})
+	defer os.RemoveAll(root)
+
+	var r = &BucketIteratorReader{
+		BucketIterator: &BucketFilter{
+			BucketIterator: &DirectoryBucketIterator{Root: root},
+			Filter: LogFileTimeFilter{
+				Start: time.Date(2018, 10, 17, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2018, 10, 17, 1, 30, 0, 0, time.UTC),
+			},
+		},
+		FetchPolicy: NewLocalFilePolicy(),
+	}
+	var d = &ReaderDigester{Reader: r}
+	var digest, err = d.Digest()
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 22 6 40 8498 1418530010 1418530070 ACCEPT OK\n", string(content))
+}
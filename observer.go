@@ -0,0 +1,74 @@
+package vpcflow
+
+import (
+	"context"
+	"time"
+)
+
+// Observer receives measurements from the stages of reading log files so
+// that their behavior can be monitored. Implementations must be safe for
+// concurrent use. The Stats type is an Observer that keeps totals in memory.
+//
+// Each stage uses the Observer that it is given directly or, if none is
+// given, the Observer of its Context as set by WithObserver. This allows
+// an Observer to reach the FileManagers that are created by the policies
+// with a context, such as NewPrefetchPolicyWithContext.
+type Observer interface {
+	// ObserveListed is called for each file produced by a
+	// BucketStateIterator.
+	ObserveListed(lf LogFile)
+	// ObserveFetch is called when a PrefetchFileManager or
+	// DiskFileManager finishes the download of a file of the given number
+	// of bytes that took the given time, or that failed with err. A
+	// StreamingFileManager downloads a file as it is read and reports it
+	// once the file is released.
+	ObserveFetch(lf LogFile, bytes int64, latency time.Duration, err error)
+	// ObserveBuffer is called with the change in the number of files,
+	// and in the bytes they are charged, held by a FileManager whether
+	// they are being downloaded or waiting to be read. Prefetched files
+	// are charged for memory, spooled files for disk, and streamed files
+	// for the working memory of their decoder.
+	ObserveBuffer(files int, bytes int64)
+	// ObserveWait is called with the time a BucketIteratorReader or
+	// BucketRecordIterator waited on its FileManager for a file.
+	ObserveWait(wait time.Duration)
+	// ObserveReadError is called for each file or line that could not be
+	// read or parsed, whether or not it is skipped.
+	ObserveReadError(err *LogFileError)
+}
+
+type observerKey struct{}
+
+// WithObserver returns a copy of the context that carries the Observer.
+func WithObserver(ctx context.Context, o Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, o)
+}
+
+// ObserverFromContext returns the Observer carried by the context or nil
+// if it has none.
+func ObserverFromContext(ctx context.Context) Observer {
+	var o, _ = ctx.Value(observerKey{}).(Observer)
+	return o
+}
+
+// observerOf returns the given Observer, or that of the context, or an
+// Observer that discards all measurements.
+func observerOf(o Observer, ctx context.Context) Observer {
+	if o != nil {
+		return o
+	}
+	if ctx != nil {
+		if o := ObserverFromContext(ctx); o != nil {
+			return o
+		}
+	}
+	return nopObserver{}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveListed(LogFile)                             {}
+func (nopObserver) ObserveFetch(LogFile, int64, time.Duration, error) {}
+func (nopObserver) ObserveBuffer(int, int64)                          {}
+func (nopObserver) ObserveWait(time.Duration)                         {}
+func (nopObserver) ObserveReadError(*LogFileError)                    {}
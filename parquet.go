@@ -0,0 +1,105 @@
+package vpcflow
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	goparquet "github.com/fraugster/parquet-go"
+)
+
+// parquetSuffix identifies log files that AWS delivered in the
+// Apache Parquet format rather than as gzip compressed text.
+const parquetSuffix = ".parquet"
+
+func isParquet(key string) bool {
+	return strings.HasSuffix(key, parquetSuffix)
+}
+
+// parquetReader renders the rows of a Parquet log file as text
+// lines identical to those of a text log file.
+type parquetReader struct {
+	file    *goparquet.FileReader
+	columns []string
+	buff    bytes.Buffer
+	err     error
+	// rowGroupSize is the largest uncompressed size of a row group.
+	// Row groups are decoded into memory one at a time.
+	rowGroupSize int64
+}
+
+// NewParquetReader converts the content of a Parquet log file into
+// the same text representation AWS uses for plain text log files.
+// The output begins with a header line naming the fields of the file
+// followed by one space delimited line per record. Columns use the
+// field names with underscores in place of hyphens, as in AWS
+// Parquet logs. Columns that are not supported fields are written as
+// text and their values are ignored when the lines are parsed.
+func NewParquetReader(r io.ReadSeeker) (io.Reader, error) {
+	meta, err := goparquet.ReadFileMetaData(r, true)
+	if err != nil {
+		return nil, fmt.Errorf("error opening parquet log file. %s", err)
+	}
+	file, err := goparquet.NewFileReaderWithOptions(r, goparquet.WithFileMetaData(meta))
+	if err != nil {
+		return nil, fmt.Errorf("error opening parquet log file. %s", err)
+	}
+	pr := &parquetReader{file: file}
+	for _, group := range meta.RowGroups {
+		if group.GetTotalByteSize() > pr.rowGroupSize {
+			pr.rowGroupSize = group.GetTotalByteSize()
+		}
+	}
+	fields := make([]string, 0, len(file.Columns()))
+	for _, col := range file.Columns() {
+		pr.columns = append(pr.columns, col.Name())
+		fields = append(fields, strings.Replace(col.Name(), "_", "-", -1))
+	}
+	format, err := ParseFormat(strings.Join(fields, " "))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing parquet log file schema. %s", err)
+	}
+	_, _ = pr.buff.WriteString(format.String() + "\n")
+	return pr, nil
+}
+
+// Read rendered lines, decoding more rows from the file as needed.
+func (r *parquetReader) Read(b []byte) (int, error) {
+	for r.buff.Len() < 1 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		row, err := r.file.NextRow()
+		if err != nil {
+			r.err = err
+			continue
+		}
+		var prefix string
+		for _, col := range r.columns {
+			_, _ = r.buff.WriteString(prefix)
+			_, _ = r.buff.WriteString(formatParquetValue(row[col]))
+			prefix = " "
+		}
+		_ = r.buff.WriteByte('\n')
+	}
+	return r.buff.Read(b)
+}
+
+func formatParquetValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return emptyValue
+	case []byte:
+		return formatString(string(v))
+	case string:
+		return formatString(v)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
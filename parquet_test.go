@@ -0,0 +1,154 @@
+package vpcflow
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	s3 "github.com/aws/aws-sdk-go/service/s3"
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/fraugster/parquet-go/parquetschema"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testParquetSchema = `message flowlogs {
+	optional int32 version;
+	optional binary account_id (STRING);
+	optional binary interface_id (STRING);
+	optional binary srcaddr (STRING);
+	optional binary dstaddr (STRING);
+	optional int32 srcport;
+	optional int32 dstport;
+	optional int32 protocol;
+	optional int64 packets;
+	optional int64 bytes;
+	optional int64 start;
+	optional int64 end;
+	optional binary action (STRING);
+	optional binary log_status (STRING);
+	optional binary vpc_id (STRING);
+	optional int32 tcp_flags;
+}`
+
+func newTestParquetFile(t *testing.T, rows ...map[string]interface{}) []byte {
+	sd, err := parquetschema.ParseSchemaDefinition(testParquetSchema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var buff bytes.Buffer
+	fw := goparquet.NewFileWriter(&buff,
+		goparquet.WithSchemaDefinition(sd),
+		goparquet.WithCompressionCodec(parquet.CompressionCodec_GZIP),
+	)
+	for _, row := range rows {
+		if err := fw.AddData(row); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buff.Bytes()
+}
+
+var testParquetRows = []map[string]interface{}{
+	{
+		"version":      int32(3),
+		"account_id":   []byte("123456789010"),
+		"interface_id": []byte("eni-abc123de"),
+		"srcaddr":      []byte("172.31.16.139"),
+		"dstaddr":      []byte("172.31.16.21"),
+		"srcport":      int32(20641),
+		"dstport":      int32(80),
+		"protocol":     int32(6),
+		"packets":      int64(20),
+		"bytes":        int64(1000),
+		"start":        int64(1418530010),
+		"end":          int64(1418530070),
+		"action":       []byte("ACCEPT"),
+		"log_status":   []byte("OK"),
+		"vpc_id":       []byte("vpc-abcdefab012345678"),
+		"tcp_flags":    int32(2),
+	},
+	{
+		"version":      int32(3),
+		"account_id":   []byte("123456789010"),
+		"interface_id": []byte("eni-1a2b3c4d"),
+		"start":        int64(1431280876),
+		"end":          int64(1431280934),
+		"log_status":   []byte("NODATA"),
+	},
+}
+
+const testParquetText = `version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status vpc-id tcp-flags
+3 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK vpc-abcdefab012345678 2
+3 123456789010 eni-1a2b3c4d - - - - - - - 1431280876 1431280934 - NODATA - -
+`
+
+func TestParquetReader(t *testing.T) {
+	content := newTestParquetFile(t, testParquetRows...)
+	r, err := NewParquetReader(bytes.NewReader(content))
+	assert.Nil(t, err)
+	text, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, testParquetText, string(text))
+}
+
+func TestParquetReaderNotParquet(t *testing.T) {
+	_, err := NewParquetReader(bytes.NewReader([]byte("version account-id\n")))
+	assert.NotNil(t, err)
+}
+
+func TestParquetReaderUnsupportedColumn(t *testing.T) {
+	sd, _ := parquetschema.ParseSchemaDefinition(`message flowlogs {
+	optional int32 version;
+	optional binary not_a_field (STRING);
+}`)
+	var buff bytes.Buffer
+	fw := goparquet.NewFileWriter(&buff, goparquet.WithSchemaDefinition(sd))
+	_ = fw.AddData(map[string]interface{}{"version": int32(2)})
+	_ = fw.Close()
+
+	r, err := NewParquetReader(bytes.NewReader(buff.Bytes()))
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "version not-a-field\n2 -\n", string(content))
+}
+
+func TestPrefetchFileManagerParquet(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var queue = NewMockS3API(ctrl)
+	var content = newTestParquetFile(t, testParquetRows...)
+	var lf = LogFile{
+		Size:   int64(len(content)),
+		Key:    "AWSLogs/123456789010/vpcflowlogs/us-west-2/2018/10/17/123456789010_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.parquet",
+		Bucket: "bucket",
+	}
+	var fm = &PrefetchFileManager{
+		Queue: queue,
+		Ready: make(chan io.Reader, 1),
+		Lock:  &Semaphore{C: make(chan interface{}, 1)},
+	}
+	fm.once.Do(fm.init)
+
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: aws.Int64(int64(len(content))),
+	}, nil)
+
+	fm.wg.Add(1)
+	fm.prefetchFile(lf)
+	r, err := fm.Get()
+	assert.Nil(t, err)
+	text, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, testParquetText, string(text))
+	fm.Put(r)
+}
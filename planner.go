@@ -0,0 +1,182 @@
+package vpcflow
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// PartitionUnit identifies a level of the date partitions in which AWS
+// delivers flow log files.
+type PartitionUnit int
+
+const (
+	// PartitionYear is the partition containing a year of files.
+	PartitionYear PartitionUnit = iota
+	// PartitionMonth is the partition containing a month of files.
+	PartitionMonth
+	// PartitionDay is the partition containing a day of files.
+	PartitionDay
+	// PartitionHour is the partition containing an hour of files. This
+	// is only present in layouts with hourly partitions.
+	PartitionHour
+)
+
+const (
+	// DefaultPlanBefore is the padding applied before the start of a
+	// PrefixPlan. File names carry a timestamp truncated to the minute in
+	// which the file was written so a file may be named shortly before the
+	// end of the last flow it contains.
+	DefaultPlanBefore = 5 * time.Minute
+	// DefaultPlanAfter is the padding applied after the end of a
+	// PrefixPlan. A flow is written only after its aggregation interval, of
+	// up to ten minutes, closes and files are published every five minutes
+	// with delivery sometimes lagging further behind, so a file may be
+	// published well after the start of the flows it contains.
+	DefaultPlanAfter = 30 * time.Minute
+)
+
+// PrefixPlan describes the subset of a bucket that contains the flow logs
+// of some accounts and regions over a time range. Rather than listing an
+// entire bucket and filtering out most of the files, the plan is used to
+// list only the partitions that overlap the time range.
+type PrefixPlan struct {
+	// Layout describes the keys of the bucket.
+	Layout KeyLayout
+	// Accounts are the AWS account IDs to include.
+	Accounts []string
+	// Regions are the AWS regions to include.
+	Regions []string
+	// Start is the inclusive beginning of the time range.
+	Start time.Time
+	// End is the inclusive end of the time range.
+	End time.Time
+	// Before widens the range of partitions ahead of Start. If not set
+	// then DefaultPlanBefore is used. A negative value disables the
+	// padding.
+	Before time.Duration
+	// After widens the range of partitions beyond End. If not set then
+	// DefaultPlanAfter is used. A negative value disables the
+	// padding.
+	After time.Duration
+}
+
+// Prefixes produces the smallest set of partition prefixes that overlap
+// the time range for every combination of account and region. Whole years,
+// months, or days within the range are listed with a single prefix rather
+// than one per day or hour. Prefixes are ordered by time and then by account
+// and region.
+//
+// Files are delivered to the partition of the time they are published,
+// which may be some time after the flows they contain. The time range is
+// padded by Before and After, in the same way as a FlowTimeFilter, so that
+// the partitions of files published shortly after End are also listed.
+// Partitions are selected using the date of the partition only. Files that
+// overlap the padded range may still contain records outside of the time
+// range so the results should be filtered with a FlowTimeFilter if an exact
+// bound is needed. The plan and the filter should be given the same Start,
+// End, Before, and After so that the plan lists every file the filter keeps.
+func (p PrefixPlan) Prefixes() ([]string, error) {
+	if len(p.Accounts) < 1 || len(p.Regions) < 1 {
+		return nil, errors.New("prefix plan requires at least one account and region")
+	}
+	if p.End.Before(p.Start) {
+		return nil, errors.New("prefix plan end is before start")
+	}
+	var prefixes []string
+	for _, part := range p.partitions() {
+		for _, account := range p.Accounts {
+			for _, region := range p.Regions {
+				prefixes = append(prefixes, p.Layout.PartitionPrefix(account, region, part.start, part.unit))
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+type partition struct {
+	start time.Time
+	unit  PartitionUnit
+}
+
+// partitions walks down from years to the finest partition of the layout and
+// selects the largest partitions that either fall entirely within the time
+// range or cannot be divided further.
+func (p PrefixPlan) partitions() []partition {
+	var start = p.Start.UTC().Add(-padding(p.Before, DefaultPlanBefore))
+	var end = p.End.UTC().Add(padding(p.After, DefaultPlanAfter)).Add(time.Nanosecond) // exclusive
+	var finest = PartitionDay
+	if p.Layout.HourlyPartitions {
+		finest = PartitionHour
+	}
+	var result []partition
+	var visit func(from time.Time, unit PartitionUnit)
+	visit = func(from time.Time, unit PartitionUnit) {
+		var to = nextPartition(from, unit)
+		if !to.After(start) || !from.Before(end) {
+			return
+		}
+		if unit == finest || (!from.Before(start) && !to.After(end)) {
+			result = append(result, partition{start: from, unit: unit})
+			return
+		}
+		for child := from; child.Before(to); child = nextPartition(child, unit+1) {
+			visit(child, unit+1)
+		}
+	}
+	for year := start.Year(); year <= end.Year(); year = year + 1 {
+		visit(time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC), PartitionYear)
+	}
+	return result
+}
+
+func nextPartition(t time.Time, unit PartitionUnit) time.Time {
+	switch unit {
+	case PartitionYear:
+		return t.AddDate(1, 0, 0)
+	case PartitionMonth:
+		return t.AddDate(0, 1, 0)
+	case PartitionDay:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.Add(time.Hour)
+	}
+}
+
+// NewPlannedBucketIterator produces a BucketIterator that lists only the
+// prefixes of the plan. Up to maxConcurrent prefixes are listed in parallel
+// and the results are merged into a single iterator in the order of the
+// prefixes.
+func NewPlannedBucketIterator(q s3iface.S3API, bucket string, plan PrefixPlan, maxConcurrent int) (BucketIterator, error) {
+	var prefixes, err = plan.Prefixes()
+	if err != nil {
+		return nil, err
+	}
+	var iterators = make([]BucketIterator, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		iterators = append(iterators, &BucketStateIterator{
+			Bucket:    bucket,
+			Prefix:    prefix,
+			Queue:     q,
+			KeyParser: plan.Layout,
+		})
+	}
+	return &MultiBucketIterator{
+		Iterators:     iterators,
+		MaxConcurrent: maxConcurrent,
+	}, nil
+}
+
+// padding resolves a configured padding against its default. Zero selects
+// the default and a negative value disables the padding.
+func padding(d time.Duration, def time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0:
+		return def
+	default:
+		return d
+	}
+}
@@ -0,0 +1,352 @@
+package vpcflow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixPlanPrefixes(t *testing.T) {
+	tc := []struct {
+		Name     string
+		Plan     PrefixPlan
+		Expected []string
+	}{
+		{
+			Name: "single-day",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 17, 3, 0, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 17, 5, 0, 0, 0, time.UTC),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+			},
+		},
+		{
+			Name: "accounts-and-regions",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012", "210987654321"},
+				Regions:  []string{"us-west-2", "us-east-1"},
+				Start:    time.Date(2018, 10, 17, 23, 0, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 18, 1, 0, 0, 0, time.UTC),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+				"AWSLogs/123456789012/vpcflowlogs/us-east-1/2018/10/17/",
+				"AWSLogs/210987654321/vpcflowlogs/us-west-2/2018/10/17/",
+				"AWSLogs/210987654321/vpcflowlogs/us-east-1/2018/10/17/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/18/",
+				"AWSLogs/123456789012/vpcflowlogs/us-east-1/2018/10/18/",
+				"AWSLogs/210987654321/vpcflowlogs/us-west-2/2018/10/18/",
+				"AWSLogs/210987654321/vpcflowlogs/us-east-1/2018/10/18/",
+			},
+		},
+		{
+			Name: "whole-months-and-years",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2017, 11, 30, 12, 0, 0, 0, time.UTC),
+				End:      time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2017/11/30/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2017/12/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2019/01/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2019/02/01/",
+			},
+		},
+		{
+			Name: "hourly",
+			Plan: PrefixPlan{
+				Layout:   KeyLayout{HourlyPartitions: true},
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 16, 22, 30, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 18, 1, 0, 0, 0, time.UTC),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/16/22/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/16/23/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/18/00/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/18/01/",
+			},
+		},
+		{
+			Name: "hive-organization-prefix",
+			Plan: PrefixPlan{
+				Layout: KeyLayout{
+					Prefix:           "flowlogs/",
+					OrganizationID:   "o-abcde12345",
+					HiveCompatible:   true,
+					HourlyPartitions: true,
+				},
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 17, 3, 0, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 17, 3, 59, 0, 0, time.UTC),
+			},
+			Expected: []string{
+				"flowlogs/AWSLogs/aws-organization-id=o-abcde12345/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/hour=02/",
+				"flowlogs/AWSLogs/aws-organization-id=o-abcde12345/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/hour=03/",
+				"flowlogs/AWSLogs/aws-organization-id=o-abcde12345/aws-account-id=123456789012/aws-service=vpcflowlogs/aws-region=us-west-2/year=2018/month=10/day=17/hour=04/",
+			},
+		},
+		{
+			Name: "published-after-end",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 17, 23, 59, 59, 0, time.UTC),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/18/",
+			},
+		},
+		{
+			Name: "no-padding",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 17, 0, 0, 0, 0, time.UTC),
+				End:      time.Date(2018, 10, 17, 23, 59, 59, 0, time.UTC),
+				Before:   -1,
+				After:    -1,
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+			},
+		},
+		{
+			Name: "non-utc",
+			Plan: PrefixPlan{
+				Accounts: []string{"123456789012"},
+				Regions:  []string{"us-west-2"},
+				Start:    time.Date(2018, 10, 17, 20, 0, 0, 0, time.FixedZone("PDT", -7*60*60)),
+				End:      time.Date(2018, 10, 17, 21, 0, 0, 0, time.FixedZone("PDT", -7*60*60)),
+			},
+			Expected: []string{
+				"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/18/",
+			},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var prefixes, err = tt.Plan.Prefixes()
+			assert.Nil(t, err)
+			assert.Equal(t, tt.Expected, prefixes)
+		})
+	}
+}
+
+func TestPrefixPlanInvalid(t *testing.T) {
+	var start = time.Date(2018, 10, 17, 0, 0, 0, 0, time.UTC)
+	var _, err = PrefixPlan{Regions: []string{"us-west-2"}, Start: start, End: start}.Prefixes()
+	assert.NotNil(t, err)
+	_, err = PrefixPlan{Accounts: []string{"123456789012"}, Start: start, End: start}.Prefixes()
+	assert.NotNil(t, err)
+	_, err = PrefixPlan{
+		Accounts: []string{"123456789012"},
+		Regions:  []string{"us-west-2"},
+		Start:    start,
+		End:      start.Add(-time.Hour),
+	}.Prefixes()
+	assert.NotNil(t, err)
+}
+
+func TestMultiBucketIteratorPreservesOrder(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var iterators []BucketIterator
+	for x := 0; x < 5; x = x + 1 {
+		var iter = NewMockBucketIterator(ctrl)
+		gomock.InOrder(
+			iter.EXPECT().Iterate().Return(true),
+			iter.EXPECT().Current().Return(LogFile{Key: string(rune('a' + x))}),
+			iter.EXPECT().Iterate().Return(true),
+			iter.EXPECT().Current().Return(LogFile{Key: string(rune('A' + x))}),
+			iter.EXPECT().Iterate().Return(false),
+			iter.EXPECT().Close().Return(nil),
+		)
+		iterators = append(iterators, iter)
+	}
+	var multi = &MultiBucketIterator{Iterators: iterators, MaxConcurrent: 2}
+
+	var keys []string
+	for multi.Iterate() {
+		keys = append(keys, multi.Current().Key)
+	}
+	assert.Nil(t, multi.Close())
+	assert.Equal(t, []string{"a", "A", "b", "B", "c", "C", "d", "D", "e", "E"}, keys)
+	assert.Equal(t, LogFile{}, multi.Current())
+}
+
+func TestMultiBucketIteratorStopsOnError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var listErr = errors.New("")
+	var failing = NewMockBucketIterator(ctrl)
+	failing.EXPECT().Iterate().Return(true)
+	failing.EXPECT().Current().Return(LogFile{Key: "a"})
+	failing.EXPECT().Iterate().Return(false)
+	failing.EXPECT().Close().Return(listErr)
+	var other = NewMockBucketIterator(ctrl)
+	other.EXPECT().Iterate().Return(false).AnyTimes()
+	other.EXPECT().Close().Return(nil).AnyTimes()
+
+	var multi = &MultiBucketIterator{Iterators: []BucketIterator{failing, other}}
+	assert.True(t, multi.Iterate())
+	assert.Equal(t, "a", multi.Current().Key)
+	assert.False(t, multi.Iterate())
+	assert.False(t, multi.Iterate())
+	assert.Equal(t, listErr, multi.Close())
+}
+
+func TestMultiBucketIteratorAck(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var keys = make(map[string][]string)
+	var iterators []BucketIterator
+	var states []*BucketStateIterator
+	for _, prefix := range []string{"b/", "a/"} {
+		for x := 0; x < 2; x = x + 1 {
+			keys[prefix] = append(keys[prefix], fmt.Sprintf("%s123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_%d.log.gz", prefix, x))
+		}
+		var bi = &BucketStateIterator{Bucket: "bucket", Prefix: prefix, Queue: queue, KeyParser: KeyLayout{}, TrackAcks: true}
+		states = append(states, bi)
+		iterators = append(iterators, bi)
+	}
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+			var output = &s3.ListObjectsV2Output{}
+			for _, key := range keys[aws.StringValue(input.Prefix)] {
+				output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)})
+			}
+			return output, nil
+		},
+	).Times(2)
+
+	var multi = &MultiBucketIterator{Iterators: iterators, MaxConcurrent: 2}
+	var files []LogFile
+	for multi.Iterate() {
+		files = append(files, multi.Current())
+	}
+	assert.Nil(t, multi.Close())
+	assert.Len(t, files, 4)
+
+	// Acknowledgements reach the iterator that listed each file.
+	for x := len(files) - 1; x >= 0; x = x - 1 {
+		assert.Nil(t, multi.Ack(files[x]))
+	}
+	assert.Equal(t, keys["b/"][1], states[0].Checkpoint().LastKey)
+	assert.Equal(t, keys["a/"][1], states[1].Checkpoint().LastKey)
+	assert.Empty(t, multi.pending)
+	assert.Nil(t, multi.Ack(files[0]), "repeated acknowledgements should be ignored")
+}
+
+type endlessBucketIterator struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (it *endlessBucketIterator) Iterate() bool    { return true }
+func (it *endlessBucketIterator) Current() LogFile { return LogFile{Key: "key"} }
+func (it *endlessBucketIterator) Close() error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.closed = true
+	return nil
+}
+
+func TestMultiBucketIteratorCloseStopsListing(t *testing.T) {
+	var endless = &endlessBucketIterator{}
+	var multi = &MultiBucketIterator{Iterators: []BucketIterator{endless, &endlessBucketIterator{}}, MaxConcurrent: 2}
+	assert.True(t, multi.Iterate())
+
+	var done = make(chan interface{})
+	go func() {
+		assert.Nil(t, multi.Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not stop background listing")
+	}
+	endless.mu.Lock()
+	defer endless.mu.Unlock()
+	assert.True(t, endless.closed)
+	assert.False(t, multi.Iterate())
+}
+
+func TestMultiBucketIteratorCloseWithoutIterate(t *testing.T) {
+	var multi = &MultiBucketIterator{Iterators: []BucketIterator{&endlessBucketIterator{}}}
+	assert.Nil(t, multi.Close())
+	assert.False(t, multi.Iterate())
+}
+
+func TestNewPlannedBucketIterator(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var plan = PrefixPlan{
+		Accounts: []string{"123456789012"},
+		Regions:  []string{"us-west-2", "us-east-1"},
+		Start:    time.Date(2018, 10, 17, 1, 0, 0, 0, time.UTC),
+		End:      time.Date(2018, 10, 17, 2, 0, 0, 0, time.UTC),
+	}
+
+	var mu sync.Mutex
+	var listed []string
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(_ aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		listed = append(listed, aws.StringValue(input.Prefix))
+		var region = "us-west-2"
+		if aws.StringValue(input.Prefix) == "AWSLogs/123456789012/vpcflowlogs/us-east-1/2018/10/17/" {
+			region = "us-east-1"
+		}
+		return &s3.ListObjectsV2Output{
+			Contents: []*s3.Object{{
+				Key:  aws.String(aws.StringValue(input.Prefix) + "123456789012_vpcflowlogs_" + region + "_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"),
+				Size: aws.Int64(100),
+			}},
+		}, nil
+	}).Times(2)
+
+	var iter, err = NewPlannedBucketIterator(queue, "testbucket", plan, 2)
+	assert.Nil(t, err)
+	var regions []string
+	for iter.Iterate() {
+		regions = append(regions, iter.Current().Region)
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []string{"us-west-2", "us-east-1"}, regions)
+	sort.Strings(listed)
+	assert.Equal(t, []string{
+		"AWSLogs/123456789012/vpcflowlogs/us-east-1/2018/10/17/",
+		"AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/",
+	}, listed)
+
+	_, err = NewPlannedBucketIterator(queue, "testbucket", PrefixPlan{}, 2)
+	assert.NotNil(t, err)
+}
@@ -1,52 +1,131 @@
 package vpcflow
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strconv"
 	"strings"
 	"time"
 )
 
-// Each log line is space delimited. When tokenized, the attributes can be accessed by the below
-// index values
+// defaultDigestKeyFields are the fields that a ReaderDigester groups
+// records by when KeyFields is not set. They are every supported field
+// other than the start and end times and those of the
+// defaultDigestAggregations.
+var defaultDigestKeyFields = []string{
+	FieldVersion,
+	FieldAccountID,
+	FieldInterfaceID,
+	FieldSrcAddr,
+	FieldSrcPort,
+	FieldDstAddr,
+	FieldDstPort,
+	FieldProtocol,
+	FieldAction,
+	FieldLogStatus,
+	FieldVPCID,
+	FieldSubnetID,
+	FieldInstanceID,
+	FieldType,
+	FieldPktSrcAddr,
+	FieldPktDstAddr,
+	FieldRegion,
+	FieldAZID,
+	FieldSublocationType,
+	FieldSublocationID,
+	FieldPktSrcAWSService,
+	FieldPktDstAWSService,
+	FieldFlowDirection,
+	FieldTrafficPath,
+}
+
+// Aggregation determines how the values of a field are combined across
+// the records of a digest group.
+type Aggregation int
+
+const (
+	// SumAggregation adds the values together.
+	SumAggregation Aggregation = iota
+	// MinAggregation keeps the smallest value.
+	MinAggregation
+	// MaxAggregation keeps the largest value.
+	MaxAggregation
+	// BitwiseOrAggregation combines the bits of the values, as is done
+	// for the tcp-flags of a flow.
+	BitwiseOrAggregation
+)
+
+// defaultDigestAggregations are the aggregations that a ReaderDigester
+// applies when Aggregations is not set.
+var defaultDigestAggregations = map[string]Aggregation{
+	FieldPackets:  SumAggregation,
+	FieldBytes:    SumAggregation,
+	FieldTCPFlags: BitwiseOrAggregation,
+}
+
+// DefaultDigestKeyFields returns the fields that a ReaderDigester groups
+// records by when KeyFields is not set. They are every supported field
+// other than the start and end times and those of the
+// DefaultDigestAggregations. The result is a copy that may be modified
+// and given as the KeyFields.
+func DefaultDigestKeyFields() []string {
+	return append([]string(nil), defaultDigestKeyFields...)
+}
+
+// DefaultDigestAggregations returns the aggregations that a
+// ReaderDigester applies when Aggregations is not set. The result is a
+// copy that may be modified and given as the Aggregations.
+func DefaultDigestAggregations() map[string]Aggregation {
+	aggregations := make(map[string]Aggregation, len(defaultDigestAggregations))
+	for field, aggregation := range defaultDigestAggregations {
+		aggregations[field] = aggregation
+	}
+	return aggregations
+}
+
+// aggregatable fields
+var aggregateFields = map[string]bool{
+	FieldPackets:  true,
+	FieldBytes:    true,
+	FieldTCPFlags: true,
+}
+
+// TimeBounds determines the start and end times written on each line of
+// a digest.
+type TimeBounds int
+
 const (
-	idxVersion = iota
-	idxAccountID
-	idxInterfaceID
-	idxSrcAddr
-	idxDstAddr
-	idxSrcPort
-	idxDstPort
-	idxProtocol
-	idxPackets
-	idxBytes
-	idxStart
-	idxEnd
-	idxAction
-	idxLogStatus
+	// DigestTimeBounds writes the earliest start and latest end of the
+	// whole digest on every line. This is the default.
+	DigestTimeBounds TimeBounds = iota
+	// KeyTimeBounds writes the earliest start and latest end of the
+	// records of each line so that the line shows when its traffic was
+	// first and last seen.
+	KeyTimeBounds
 )
 
-// set of keyed fields
-var keyFields = map[int]bool{
-	idxVersion:     true,
-	idxAccountID:   true,
-	idxInterfaceID: true,
-	idxSrcAddr:     true,
-	idxSrcPort:     true,
-	idxDstAddr:     true,
-	idxDstPort:     true,
-	idxProtocol:    true,
-	idxAction:      true,
-	idxLogStatus:   true,
+// DigestReader is the io.ReadCloser produced by a ReaderDigester. It
+// exposes the time bounds of the whole digest alongside the lines, which
+// may carry the bounds of each key instead.
+type DigestReader struct {
+	io.ReadCloser
+	start time.Time
+	end   time.Time
+}
+
+// Bounds returns the earliest start and latest end of the records in the
+// digest.
+func (r *DigestReader) Bounds() (time.Time, time.Time) {
+	return r.start, r.end
 }
 
 type variableData struct {
-	bytes   int64
-	packets int64
+	record   FlowRecord
+	bytes    int64
+	packets  int64
+	tcpFlags int
 }
 
 // Digester interface digests input data, and outputs an io.ReaderCloser
@@ -56,8 +135,39 @@ type Digester interface {
 }
 
 // ReaderDigester is responsible for compacting multiple VPC flow log lines into fewer, summarized lines.
+// Records are grouped by their key fields and the remaining counters of each group are aggregated. The
+// bounds of the whole digest are available from the DigestReader returned by Digest.
 type ReaderDigester struct {
 	Reader io.ReadCloser
+	// Format is the format of any lines that appear before the first
+	// header line of the input. If not set then the DefaultFormat is used.
+	Format Format
+	// Filter, if set, selects the records that are digested.
+	Filter RecordFilter
+	// ReadErrorPolicy determines the handling of lines that cannot be
+	// parsed. With SkipLineOnReadError they are passed to OnReadError and
+	// left out of the digest. Files that cannot be read are skipped by
+	// giving the policy to the Reader, such as a BucketIteratorReader.
+	ReadErrorPolicy ReadErrorPolicy
+	OnReadError     func(*LogFileError)
+	// Observer, if set, receives the lines that cannot be parsed or
+	// digested. If not set then the Observer of the context given to
+	// DigestWithContext, if any, is used.
+	Observer Observer
+	// KeyFields are the fields by which records are grouped. If not set
+	// then the DefaultDigestKeyFields are used. For example, srcaddr,
+	// dstaddr, and dstport digest the traffic between addresses regardless
+	// of the interface that recorded it. Records of a format that lacks a
+	// key field are grouped by an empty value, but Digest returns an error
+	// if a key field is in none of the formats of the digested records.
+	KeyFields []string
+	// Aggregations combine the packets, bytes, and tcp-flags of each
+	// group. If not set then the DefaultDigestAggregations are used. Fields
+	// that are neither keyed nor aggregated, other than the start and end
+	// times, are left out of the digest.
+	Aggregations map[string]Aggregation
+	// TimeBounds chooses the start and end times written on each line.
+	TimeBounds TimeBounds
 }
 
 // Digest reads from the given io.Reader, and compacts multiple VPC flow log lines, producing a digest
@@ -67,39 +177,60 @@ type ReaderDigester struct {
 // as the more volatile values such as srcport, start, end, log-status, bytes, and packets. For the most
 // part, these volatile values will change with every entry even when the stable values are exactly the
 // same.
+//
+// Every field of a custom format is carried through the digest. The tcp-flags of squashed lines are
+// combined, and all other fields outside of the default set are treated as stable values. If the input
+// contains any format other than the DefaultFormat then the digest begins with a header line naming
+// the fields from all input formats. Lines of a format that lacks one of those fields have an empty value
+// in its place.
 func (d *ReaderDigester) Digest() (io.ReadCloser, error) {
-	defer d.Reader.Close()
-	reader := bufio.NewReader(d.Reader)
+	return d.DigestWithContext(context.Background())
+}
+
+// DigestWithContext is a variant of Digest that stops reading and closes the Reader once the context is
+// done. Reads that block, such as those of a BucketIteratorReader, are only interrupted if the Reader is
+// also given the context.
+func (d *ReaderDigester) DigestWithContext(ctx context.Context) (io.ReadCloser, error) {
+	keys, aggregations, err := d.groups()
+	if err != nil {
+		_ = d.Reader.Close()
+		return nil, err
+	}
+	observer := observerOf(d.Observer, ctx)
+	iter := &ReaderRecordIterator{
+		Reader:          d.Reader,
+		Format:          d.Format,
+		ReadErrorPolicy: d.ReadErrorPolicy,
+		OnReadError:     d.OnReadError,
+		Observer:        observer,
+	}
+	done := ctx.Done()
 	digest := make(map[string]variableData)
+	var formats []Format
 	var start, end time.Time
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF && len(line) < 1 {
-			break
-		}
-		if err != nil && err != io.EOF {
-			return nil, err
+	for iter.Iterate() {
+		select {
+		case <-done:
+			_ = iter.Close()
+			return nil, ctx.Err()
+		default:
 		}
-		attrs := strings.Split(line, " ")
-		logStatus := strings.ToLower(strings.TrimSpace(attrs[idxLogStatus]))
-		if attrs[idxVersion] != "2" || logStatus != "ok" {
+		record := iter.Current()
+		if record.LogStatus != "" && !strings.EqualFold(record.LogStatus, "ok") {
 			continue
 		}
-		dstPort, err := strconv.Atoi(attrs[idxDstPort])
-		if err != nil {
-			return nil, err
-		}
-		srcPort, err := strconv.Atoi(attrs[idxSrcPort])
-		if err != nil {
-			return nil, err
+		if d.Filter != nil && !d.Filter.FilterRecord(record) {
+			continue
 		}
-		bytes, err := strconv.ParseInt(attrs[idxBytes], 10, 64)
-		if err != nil {
+		format := iter.CurrentFormat()
+		if (format.Contains(FieldStart) && record.Start.IsZero()) || (format.Contains(FieldEnd) && record.End.IsZero()) {
+			err := fmt.Errorf("flow log record is missing start or end time. %s", record.Format(format))
+			observer.ObserveReadError(&LogFileError{Line: iter.line, Err: err})
+			_ = iter.Close()
 			return nil, err
 		}
-		packets, err := strconv.ParseInt(attrs[idxPackets], 10, 64)
-		if err != nil {
-			return nil, err
+		if len(formats) < 1 || !formats[len(formats)-1].Equal(format) {
+			formats = append(formats, format)
 		}
 
 		// We don't care about the ephemeral port; we only care about the meaningful port.
@@ -108,56 +239,122 @@ func (d *ReaderDigester) Digest() (io.ReadCloser, error) {
 		// extract this value, assuming that all "meaningful" ports are less than the
 		// ephemeral port used.
 		// We will normalize the ephemeral port to 0.
-		ephemeralPortIdx := idxSrcPort
-		if srcPort < dstPort {
-			ephemeralPortIdx = idxDstPort
+		if record.SrcPort < record.DstPort {
+			record.DstPort = 0
+		} else {
+			record.SrcPort = 0
 		}
-		attrs[ephemeralPortIdx] = "0"
 
-		key := keyFromAttrs(attrs)
-		if _, ok := digest[key]; !ok {
-			digest[key] = variableData{}
+		key := keyFromAttrs(allFields, record.attrs(allFields), keys)
+		vd, ok := digest[key]
+		if !ok {
+			vd = variableData{record: record, bytes: record.Bytes, packets: record.Packets, tcpFlags: record.TCPFlags}
+		} else {
+			// Keyed fields hold the same value across the group and are not combined.
+			if !keys[FieldBytes] {
+				vd.bytes = aggregations[FieldBytes].combine(vd.bytes, record.Bytes)
+			}
+			if !keys[FieldPackets] {
+				vd.packets = aggregations[FieldPackets].combine(vd.packets, record.Packets)
+			}
+			if !keys[FieldTCPFlags] {
+				vd.tcpFlags = int(aggregations[FieldTCPFlags].combine(int64(vd.tcpFlags), int64(record.TCPFlags)))
+				vd.record.zeroTCPFlags = vd.record.zeroTCPFlags || record.zeroTCPFlags
+			}
+			if record.Start.Before(vd.record.Start) || vd.record.Start.IsZero() {
+				vd.record.Start = record.Start
+			}
+			if record.End.After(vd.record.End) || vd.record.End.IsZero() {
+				vd.record.End = record.End
+			}
 		}
-		vd := digest[key]
-		vd.bytes = vd.bytes + bytes
-		vd.packets = vd.packets + packets
 		digest[key] = vd
 
-		s, e, err := timeBoundsFromAttrs(attrs)
-		if err != nil {
-			return nil, err
+		if record.Start.Before(start) || start.IsZero() {
+			start = record.Start
+		}
+		if record.End.After(end) || end.IsZero() {
+			end = record.End
+		}
+	}
+	if err := iter.Close(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		return nil, err
+	}
+	format := mergeFormats(formats...)
+	if len(formats) > 0 {
+		for _, field := range d.KeyFields {
+			if !format.Contains(field) {
+				return nil, fmt.Errorf("error configuring digest. key field %s is not part of the input format %s", field, format)
+			}
+		}
+	}
+	return readerFromDigest(digest, digestFormat(format, keys, aggregations), start, end, d.TimeBounds)
+}
 
-		// We are already losing a lot of granularity in the digest, and we do not have any use cases so far for each
-		// edge between nodes to have its own start/end time. For now, we will use the overall bound of the digest
-		// for each log line.
-		if s.Before(start) || start.IsZero() {
-			start = s
+// groups resolves the key fields and aggregations of the digest.
+func (d *ReaderDigester) groups() (map[string]bool, map[string]Aggregation, error) {
+	keys := stringSet(defaultDigestKeyFields)
+	if d.KeyFields != nil {
+		keys = stringSet(d.KeyFields)
+	}
+	aggregations := d.Aggregations
+	if aggregations == nil {
+		aggregations = defaultDigestAggregations
+	}
+	for field := range keys {
+		if _, ok := fieldCodecs[field]; !ok {
+			return nil, nil, fmt.Errorf("error configuring digest. unsupported key field %q", field)
+		}
+		if field == FieldStart || field == FieldEnd {
+			return nil, nil, fmt.Errorf("error configuring digest. %s cannot be a key field", field)
 		}
-		if e.After(end) || end.IsZero() {
-			end = e
+		if _, ok := aggregations[field]; ok {
+			return nil, nil, fmt.Errorf("error configuring digest. %s cannot be both a key field and aggregated", field)
 		}
 	}
-	return readerFromDigest(digest, start, end)
+	for field := range aggregations {
+		if !aggregateFields[field] {
+			return nil, nil, fmt.Errorf("error configuring digest. %s cannot be aggregated", field)
+		}
+	}
+	return keys, aggregations, nil
 }
 
-// for a given log line, extract the unix time stamp, and return start, end respectively
-func timeBoundsFromAttrs(attrs []string) (time.Time, time.Time, error) {
-	startString := attrs[idxStart]
-	endString := attrs[idxEnd]
-	startSec, err := strconv.ParseInt(startString, 10, 64)
-	if err != nil {
-		return time.Time{}, time.Time{}, err
+// digestFormat reduces a format to the fields that are carried through a digest.
+func digestFormat(format Format, keys map[string]bool, aggregations map[string]Aggregation) Format {
+	var digested Format
+	for _, field := range format {
+		if _, ok := aggregations[field]; ok || keys[field] || field == FieldStart || field == FieldEnd {
+			digested = append(digested, field)
+		}
 	}
-	endSec, err := strconv.ParseInt(endString, 10, 64)
-	if err != nil {
-		return time.Time{}, time.Time{}, err
+	return digested
+}
+
+func (a Aggregation) combine(x int64, y int64) int64 {
+	switch a {
+	case MinAggregation:
+		if y < x {
+			return y
+		}
+		return x
+	case MaxAggregation:
+		if y > x {
+			return y
+		}
+		return x
+	case BitwiseOrAggregation:
+		return x | y
+	default:
+		return x + y
 	}
-	return time.Unix(startSec, 0), time.Unix(endSec, 0), nil
 }
 
 // key gets generated from stable values which are not likely to change as much
-func keyFromAttrs(attrs []string) string {
+func keyFromAttrs(format Format, attrs []string, keys map[string]bool) string {
 	length := 0
 	for offset := range attrs {
 		length = length + len(attrs[offset])
@@ -166,7 +363,7 @@ func keyFromAttrs(attrs []string) string {
 	var prefix string
 	for idx, attr := range attrs {
 		val := strings.TrimSpace(attr)
-		if !keyFields[idx] {
+		if !keys[format[idx]] {
 			val = "-"
 		}
 		_, _ = key.WriteString(prefix)
@@ -176,33 +373,27 @@ func keyFromAttrs(attrs []string) string {
 	return key.String()
 }
 
-func readerFromDigest(digest map[string]variableData, start, end time.Time) (io.ReadCloser, error) {
+func readerFromDigest(digest map[string]variableData, format Format, start, end time.Time, bounds TimeBounds) (io.ReadCloser, error) {
 	var buff bytes.Buffer
-	for key, vd := range digest {
-		attrs := strings.Split(key, " ")
-		var line, prefix string
-		for idx, attr := range attrs {
-			var val string
-			switch idx {
-			case idxBytes:
-				val = fmt.Sprintf("%d", vd.bytes)
-			case idxPackets:
-				val = fmt.Sprintf("%d", vd.packets)
-			case idxStart:
-				val = fmt.Sprintf("%d", start.Unix())
-			case idxEnd:
-				val = fmt.Sprintf("%d", end.Unix())
-			default:
-				val = attr
-			}
-			line = line + prefix + val
-			prefix = " "
+	if len(format) < 1 {
+		format = DefaultFormat
+	}
+	if !format.Equal(DefaultFormat) {
+		_, _ = buff.WriteString(format.String() + "\n")
+	}
+	for _, vd := range digest {
+		record := vd.record
+		record.Bytes = vd.bytes
+		record.Packets = vd.packets
+		record.TCPFlags = vd.tcpFlags
+		if bounds != KeyTimeBounds {
+			record.Start = start
+			record.End = end
 		}
-		line = line + "\n"
-		_, err := buff.WriteString(line)
+		_, err := buff.WriteString(record.Format(format) + "\n")
 		if err != nil {
 			return nil, err
 		}
 	}
-	return ioutil.NopCloser(&buff), nil
+	return &DigestReader{ReadCloser: ioutil.NopCloser(&buff), start: start, end: end}, nil
 }
@@ -3,6 +3,7 @@ package vpcflow
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -77,6 +79,52 @@ func TestDigestSuccess(t *testing.T) {
 	}
 }
 
+func TestDigestCustomFormat(t *testing.T) {
+	input := ioutil.NopCloser(strings.NewReader(`version vpc-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status tcp-flags flow-direction
+5 vpc-abcdefab012345678 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK 2 ingress
+5 vpc-abcdefab012345678 eni-abc123de 172.31.16.139 172.31.16.21 20541 80 6 20 1000 1518530010 1518530070 ACCEPT OK 16 ingress
+5 vpc-abcdefab012345678 eni-1a2b3c4d - - - - - - - 1431280876 1431280934 - NODATA - -
+version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20441 80 6 20 1000 1618530010 1618530070 ACCEPT OK
+`))
+	rd := ReaderDigester{Reader: input}
+	output, err := rd.Digest()
+	assert.Nil(t, err)
+
+	content, _ := ioutil.ReadAll(output)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, "version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status vpc-id tcp-flags flow-direction", lines[0])
+	assert.ElementsMatch(t, []string{
+		"5 - eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 40 2000 1418530010 1618530070 ACCEPT OK vpc-abcdefab012345678 18 ingress",
+		"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 20 1000 1418530010 1618530070 ACCEPT OK - - -",
+	}, lines[1:])
+
+	// The digest must be consumable by the digester again.
+	rd = ReaderDigester{Reader: ioutil.NopCloser(bytes.NewReader(content))}
+	_, err = rd.Digest()
+	assert.Nil(t, err)
+}
+
+func TestDigestZeroTCPFlags(t *testing.T) {
+	input := `version srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status tcp-flags
+2 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK 0
+2 172.31.16.139 172.31.16.21 20541 80 6 20 1000 1418530010 1418530070 ACCEPT OK 0
+`
+	expected := "version srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status tcp-flags\n2 172.31.16.139 172.31.16.21 0 80 6 40 2000 1418530010 1418530070 ACCEPT OK 0\n"
+	rd := ReaderDigester{Reader: ioutil.NopCloser(strings.NewReader(input))}
+	output, err := rd.Digest()
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(output)
+	assert.Equal(t, expected, string(content))
+
+	// Digesting the digest again keeps the tcp-flags of 0.
+	rd = ReaderDigester{Reader: ioutil.NopCloser(bytes.NewReader(content))}
+	output, err = rd.Digest()
+	assert.Nil(t, err)
+	content, _ = ioutil.ReadAll(output)
+	assert.True(t, strings.HasSuffix(string(content), " ACCEPT OK 0\n"), string(content))
+}
+
 func TestDigestBadData(t *testing.T) {
 	tc := []struct {
 		Name  string
@@ -118,64 +166,242 @@ func TestDigestBadData(t *testing.T) {
 	}
 }
 
-func TestTimeBoundsFromAttrs(t *testing.T) {
+func TestDigestWithContext(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var line = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var ctx, cancel = context.WithCancel(context.Background())
+	var reader = NewMockReadCloser(ctrl)
+	reader.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+		// Cancel part way through an endless stream of records.
+		cancel()
+		return copy(b, line), nil
+	}).MinTimes(1)
+	reader.EXPECT().Close().Return(nil)
+
+	var d = &ReaderDigester{Reader: reader}
+	var digest, err = d.DigestWithContext(ctx)
+	assert.Nil(t, digest)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDigestSkipLine(t *testing.T) {
+	var line = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var collector ErrorCollector
+	var d = &ReaderDigester{
+		Reader:          ioutil.NopCloser(strings.NewReader(line + "not a record\n" + line)),
+		ReadErrorPolicy: SkipLineOnReadError,
+		OnReadError:     collector.Collect,
+	}
+	var digest, err = d.Digest()
+	assert.Nil(t, err)
+	var text, _ = ioutil.ReadAll(digest)
+	assert.Contains(t, string(text), " 40 8498 ")
+	if assert.Len(t, collector.Errors(), 1) {
+		assert.Equal(t, 2, collector.Errors()[0].Line)
+	}
+}
+
+func TestDigestFilter(t *testing.T) {
+	var ssh = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var web = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 443 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var filter, err = ParseRecordFilter("dstport == 22")
+	assert.Nil(t, err)
+	var d = &ReaderDigester{Reader: ioutil.NopCloser(strings.NewReader(ssh + web + ssh)), Filter: filter}
+	digest, err := d.Digest()
+	assert.Nil(t, err)
+	var text, _ = ioutil.ReadAll(digest)
+	assert.Equal(t, "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 22 6 40 8498 1418530010 1418530070 ACCEPT OK\n", string(text))
+}
+
+func TestDigestGroups(t *testing.T) {
+	input := `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-1a2b3c4d 172.31.16.139 172.31.16.21 20541 22 6 10 1000 1418530020 1418530080 ACCEPT OK
+2 210987654321 eni-abc123de 172.31.16.139 172.31.16.21 20441 443 6 5 500 1418530030 1418530090 REJECT OK
+`
 	tc := []struct {
-		Name          string
-		Start         string
-		End           string
-		ExpectedError bool
+		Name         string
+		KeyFields    []string
+		Aggregations map[string]Aggregation
+		Expected     []string
 	}{
 		{
-			Name:  "success",
-			Start: "1418530010",
-			End:   "1418530080",
+			Name:      "addresses-and-port",
+			KeyFields: []string{FieldSrcAddr, FieldDstAddr, FieldDstPort},
+			Expected: []string{
+				"srcaddr dstaddr dstport packets bytes start end",
+				"172.31.16.139 172.31.16.21 22 30 5249 1418530010 1418530090",
+				"172.31.16.139 172.31.16.21 443 5 500 1418530010 1418530090",
+			},
 		},
 		{
-			Name:          "bad-start",
-			Start:         "not valid unix ts",
-			End:           "1418530080",
-			ExpectedError: true,
+			Name:         "interface",
+			KeyFields:    []string{FieldInterfaceID},
+			Aggregations: map[string]Aggregation{FieldBytes: MaxAggregation, FieldPackets: MinAggregation},
+			Expected: []string{
+				"interface-id packets bytes start end",
+				"eni-abc123de 5 4249 1418530010 1418530090",
+				"eni-1a2b3c4d 10 1000 1418530010 1418530090",
+			},
 		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			d := &ReaderDigester{
+				Reader:       ioutil.NopCloser(strings.NewReader(input)),
+				KeyFields:    tt.KeyFields,
+				Aggregations: tt.Aggregations,
+			}
+			output, err := d.Digest()
+			assert.Nil(t, err)
+			content, _ := ioutil.ReadAll(output)
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			assert.Equal(t, tt.Expected[0], lines[0])
+			assert.ElementsMatch(t, tt.Expected[1:], lines[1:])
+
+			// The digest must be consumable by the digester again.
+			d = &ReaderDigester{Reader: ioutil.NopCloser(bytes.NewReader(content)), KeyFields: tt.KeyFields}
+			_, err = d.Digest()
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestDigestAggregatableKey(t *testing.T) {
+	input := `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 100 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20541 22 6 10 100 1418530020 1418530080 ACCEPT OK
+`
+	d := &ReaderDigester{
+		Reader:       ioutil.NopCloser(strings.NewReader(input)),
+		KeyFields:    []string{FieldSrcAddr, FieldBytes},
+		Aggregations: map[string]Aggregation{FieldPackets: SumAggregation},
+	}
+	output, err := d.Digest()
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(output)
+	assert.Equal(t, "srcaddr packets bytes start end\n172.31.16.139 30 100 1418530010 1418530080\n", string(content))
+}
+
+func TestDigestGroupsInvalid(t *testing.T) {
+	tc := []struct {
+		Name         string
+		KeyFields    []string
+		Aggregations map[string]Aggregation
+	}{
+		{Name: "unknown-key", KeyFields: []string{"subnet"}},
+		{Name: "time-key", KeyFields: []string{FieldSrcAddr, FieldStart}},
+		{Name: "aggregated-key", KeyFields: []string{FieldSrcAddr, FieldBytes}},
+		{Name: "unsupported-aggregation", KeyFields: []string{FieldSrcAddr}, Aggregations: map[string]Aggregation{FieldStart: MaxAggregation}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var ctrl = gomock.NewController(t)
+			defer ctrl.Finish()
+
+			reader := NewMockReadCloser(ctrl)
+			reader.EXPECT().Close().Return(nil)
+			d := &ReaderDigester{Reader: reader, KeyFields: tt.KeyFields, Aggregations: tt.Aggregations}
+			output, err := d.Digest()
+			assert.Nil(t, output)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestDigestKeyFieldNotInFormat(t *testing.T) {
+	input := `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+`
+	d := &ReaderDigester{Reader: ioutil.NopCloser(strings.NewReader(input)), KeyFields: []string{FieldSrcAddr, FieldSubnetID}}
+	output, err := d.Digest()
+	assert.Nil(t, output)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), FieldSubnetID)
+}
+
+func TestDefaultDigestGroupsAreCopies(t *testing.T) {
+	keys := DefaultDigestKeyFields()
+	keys[0] = FieldStart
+	aggregations := DefaultDigestAggregations()
+	aggregations[FieldBytes] = MaxAggregation
+	assert.Equal(t, FieldVersion, DefaultDigestKeyFields()[0])
+	assert.Equal(t, SumAggregation, DefaultDigestAggregations()[FieldBytes])
+}
+
+func TestDigestTimeBounds(t *testing.T) {
+	input := `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20541 22 6 10 1000 1418530100 1418530160 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20441 443 6 5 500 1418530200 1418530260 ACCEPT OK
+`
+	tc := []struct {
+		Name     string
+		Bounds   TimeBounds
+		Expected []string
+	}{
 		{
-			Name:          "bad-end",
-			Start:         "1418530010",
-			End:           "no valid unix ts",
-			ExpectedError: true,
+			Name:   "digest",
+			Bounds: DigestTimeBounds,
+			Expected: []string{
+				"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 22 6 30 5249 1418530010 1418530260 ACCEPT OK",
+				"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 443 6 5 500 1418530010 1418530260 ACCEPT OK",
+			},
+		},
+		{
+			Name:   "key",
+			Bounds: KeyTimeBounds,
+			Expected: []string{
+				"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 22 6 30 5249 1418530010 1418530160 ACCEPT OK",
+				"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 443 6 5 500 1418530200 1418530260 ACCEPT OK",
+			},
 		},
 	}
-
 	for _, tt := range tc {
 		t.Run(tt.Name, func(t *testing.T) {
-			fakeAttrs := make([]string, 14)
-			fakeAttrs[idxStart] = tt.Start
-			fakeAttrs[idxEnd] = tt.End
-			start, end, err := timeBoundsFromAttrs(fakeAttrs)
-			if tt.ExpectedError {
-				assert.NotNil(t, err)
-			} else {
-				assert.Equal(t, tt.Start, fmt.Sprintf("%d", start.Unix()))
-				assert.Equal(t, tt.End, fmt.Sprintf("%d", end.Unix()))
-			}
+			d := &ReaderDigester{Reader: ioutil.NopCloser(strings.NewReader(input)), TimeBounds: tt.Bounds}
+			output, err := d.Digest()
+			assert.Nil(t, err)
+			content, _ := ioutil.ReadAll(output)
+			assert.ElementsMatch(t, tt.Expected, strings.Split(strings.TrimSpace(string(content)), "\n"))
+
+			start, end := output.(*DigestReader).Bounds()
+			assert.Equal(t, time.Unix(1418530010, 0), start)
+			assert.Equal(t, time.Unix(1418530260, 0), end)
 		})
 	}
 }
 
+func TestDigestKeyTimeBoundsDOT(t *testing.T) {
+	input := `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.22 20441 443 6 5 500 1418530200 1418530260 ACCEPT OK
+`
+	d := &ReaderDigester{Reader: ioutil.NopCloser(strings.NewReader(input)), TimeBounds: KeyTimeBounds}
+	output, err := d.Digest()
+	assert.Nil(t, err)
+	dot, err := DOTConverter(output)
+	assert.Nil(t, err)
+	graph, _ := ioutil.ReadAll(dot)
+	assert.Contains(t, string(graph), `govpc_start="1418530010"`)
+	assert.Contains(t, string(graph), `govpc_end="1418530070"`)
+	assert.Contains(t, string(graph), `govpc_start="1418530200"`)
+	assert.Contains(t, string(graph), `govpc_end="1418530260"`)
+}
+
 func TestKeyFromAttrs(t *testing.T) {
 	logLine := "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 20 1000 1418530010 1418530070 ACCEPT OK"
 	expectedKey := "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 - - - - ACCEPT OK"
 
-	assert.Equal(t, expectedKey, keyFromAttrs(strings.Split(logLine, " ")))
+	assert.Equal(t, expectedKey, keyFromAttrs(DefaultFormat, strings.Split(logLine, " "), stringSet(DefaultDigestKeyFields())))
 }
 
 func TestReaderFromDigest(t *testing.T) {
+	record, _ := parseFlowRecord(DefaultFormat, strings.Split("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 - - - - ACCEPT OK", " "))
 	digest := map[string]variableData{
-		"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 - - - - ACCEPT OK": {bytes: 100, packets: 20},
+		"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 - - - - ACCEPT OK": {record: record, bytes: 100, packets: 20},
 	}
 	start := time.Now().Add(-10 * time.Second)
 	end := time.Now()
 	expectedDigestLine := fmt.Sprintf("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 0 80 6 20 100 %d %d ACCEPT OK\n", start.Unix(), end.Unix())
 
-	r, _ := readerFromDigest(digest, start, end)
+	r, _ := readerFromDigest(digest, DefaultFormat, start, end, DigestTimeBounds)
 	line, _ := bufio.NewReader(r).ReadString('\n')
 	assert.Equal(t, expectedDigestLine, line)
 }
@@ -183,11 +409,12 @@ func TestReaderFromDigest(t *testing.T) {
 var benchKeyFromAttrs string
 
 func BenchmarkKeyFromAttrs(b *testing.B) {
-	attrs := strings.Split("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 NaN 80 6 20 1000 1418530010 1418530070 ACCEPT OK", "")
+	attrs := strings.Split("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 NaN 80 6 20 1000 1418530010 1418530070 ACCEPT OK", " ")
+	keys := stringSet(DefaultDigestKeyFields())
 	var key string
 	b.ResetTimer()
 	for n := 0; n < b.N; n = n + 1 {
-		key = keyFromAttrs(attrs)
+		key = keyFromAttrs(DefaultFormat, attrs, keys)
 	}
 	benchKeyFromAttrs = key
 }
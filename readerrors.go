@@ -0,0 +1,141 @@
+package vpcflow
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LogFileError is an error encountered while reading a log file. It
+// identifies the file, and the line when it is known, so that failures can
+// be traced back to the object that caused them.
+type LogFileError struct {
+	// LogFile is the file that was being read. It is empty if the file
+	// is not known.
+	LogFile LogFile
+	// Line is the line of the file, counted from one, at which the error
+	// was encountered or zero if the line is not known.
+	Line int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *LogFileError) Error() string {
+	switch {
+	case e.LogFile.Key == "" && e.Line > 0:
+		return fmt.Sprintf("error reading line %d. %s", e.Line, e.Err)
+	case e.LogFile.Key == "":
+		return fmt.Sprintf("error reading log file. %s", e.Err)
+	case e.Line > 0:
+		return fmt.Sprintf("error reading log file %s/%s at line %d. %s", e.LogFile.Bucket, e.LogFile.Key, e.Line, e.Err)
+	default:
+		return fmt.Sprintf("error reading log file %s/%s. %s", e.LogFile.Bucket, e.LogFile.Key, e.Err)
+	}
+}
+
+// AckError is an error encountered while acknowledging a LogFile that
+// was consumed. The acknowledgement was lost so the file may be delivered
+// again, such as by SQS, or a checkpoint may not move past it.
+type AckError struct {
+	// LogFile is the file that was being acknowledged.
+	LogFile LogFile
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("error acknowledging log file %s/%s. %s", e.LogFile.Bucket, e.LogFile.Key, e.Err)
+}
+
+// ackErrors holds the errors of acknowledging files until they are
+// returned, one at a time, by the next Get or Read. Acknowledgements are
+// made from Put, which has no way of returning an error itself.
+type ackErrors struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+// ack acknowledges a file if the iterator is an Acknowledger and holds
+// the error, if any.
+func (a *ackErrors) ack(iter BucketIterator, lf LogFile) {
+	var ack, ok = iter.(Acknowledger)
+	if !ok {
+		return
+	}
+	if e := ack.Ack(lf); e != nil {
+		a.lock.Lock()
+		a.errors = append(a.errors, &AckError{LogFile: lf, Err: e})
+		a.lock.Unlock()
+	}
+}
+
+// take returns the oldest error that is held, if any.
+func (a *ackErrors) take() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.errors) < 1 {
+		return nil
+	}
+	var e = a.errors[0]
+	a.errors = a.errors[1:]
+	return e
+}
+
+// ReadErrorPolicy determines how readers and record iterators handle log
+// files that cannot be fetched, decompressed, or parsed.
+type ReadErrorPolicy int
+
+const (
+	// FailOnReadError stops at the first error, which is returned to
+	// the caller.
+	FailOnReadError ReadErrorPolicy = iota
+	// SkipFileOnReadError drops the remainder of any file that cannot
+	// be fetched, read, or parsed and continues with the next file.
+	SkipFileOnReadError
+	// SkipLineOnReadError drops any line that cannot be parsed and
+	// continues with the next line. Files that cannot be fetched or
+	// read are skipped as with SkipFileOnReadError.
+	SkipLineOnReadError
+)
+
+// ErrorCollector records the errors that are skipped under a
+// ReadErrorPolicy so that they can be reported once reading is done. Its
+// Collect method is used as the OnReadError of a reader or iterator and
+// may be shared between them.
+type ErrorCollector struct {
+	lock   sync.Mutex
+	errors []*LogFileError
+}
+
+// Collect records a skipped error.
+func (c *ErrorCollector) Collect(e *LogFileError) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors = append(c.errors, e)
+}
+
+// Errors returns the skipped errors in the order they were collected.
+func (c *ErrorCollector) Errors() []*LogFileError {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var result = make([]*LogFileError, len(c.errors))
+	copy(result, c.errors)
+	return result
+}
+
+// Files returns the distinct files of the skipped errors in the order
+// they were first collected. Errors of unknown files are not included.
+func (c *ErrorCollector) Files() []LogFile {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var seen = make(map[string]bool)
+	var result []LogFile
+	for _, e := range c.errors {
+		var id = e.LogFile.Bucket + "/" + e.LogFile.Key
+		if e.LogFile.Key == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, e.LogFile)
+	}
+	return result
+}
@@ -0,0 +1,45 @@
+package vpcflow
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFileError(t *testing.T) {
+	var lf = LogFile{Bucket: "bucket", Key: "key"}
+	var err = errors.New("bad")
+	tc := []struct {
+		Name     string
+		Error    *LogFileError
+		Expected string
+	}{
+		{Name: "file", Error: &LogFileError{LogFile: lf, Err: err}, Expected: "error reading log file bucket/key. bad"},
+		{Name: "line", Error: &LogFileError{LogFile: lf, Line: 3, Err: err}, Expected: "error reading log file bucket/key at line 3. bad"},
+		{Name: "unknown-file", Error: &LogFileError{Line: 3, Err: err}, Expected: "error reading line 3. bad"},
+		{Name: "unknown", Error: &LogFileError{Err: err}, Expected: "error reading log file. bad"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, tt.Error.Error())
+		})
+	}
+}
+
+func TestErrorCollector(t *testing.T) {
+	var collector ErrorCollector
+	assert.Empty(t, collector.Errors())
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "a", ""} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			collector.Collect(&LogFileError{LogFile: LogFile{Bucket: "bucket", Key: key}, Err: errors.New(key)})
+		}(key)
+	}
+	wg.Wait()
+	assert.Len(t, collector.Errors(), 4)
+	assert.Len(t, collector.Files(), 2)
+}
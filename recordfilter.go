@@ -0,0 +1,123 @@
+package vpcflow
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// RecordFilter is used to inspect FlowRecord values and determine if
+// they are kept by a reader, iterator, or digester.
+type RecordFilter interface {
+	FilterRecord(FlowRecord) bool
+}
+
+// RecordFilterFunc adapts a function to the RecordFilter interface.
+type RecordFilterFunc func(FlowRecord) bool
+
+// FilterRecord calls the function.
+func (f RecordFilterFunc) FilterRecord(r FlowRecord) bool {
+	return f(r)
+}
+
+// MultiRecordFilter composes any number of filters into a single filter
+// that returns false on the first failed filter or true if all filters
+// pass.
+type MultiRecordFilter []RecordFilter
+
+// FilterRecord executes all enclosed filters until one of them returns
+// false.
+func (f MultiRecordFilter) FilterRecord(r FlowRecord) bool {
+	for _, filter := range f {
+		if !filter.FilterRecord(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordFilterIterator is a RecordIterator wrapper that drops any record
+// that fails the filter check.
+type RecordFilterIterator struct {
+	Filter RecordFilter
+	RecordIterator
+}
+
+// Iterate will consume from the wrapped iterator until a record is found
+// that passes the filter.
+func (it *RecordFilterIterator) Iterate() bool {
+	for it.RecordIterator.Iterate() {
+		if it.Filter.FilterRecord(it.RecordIterator.Current()) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordFilterReader is an io.ReadCloser that drops the lines of flow log
+// content that fail the filter check. It is placed between a reader, such
+// as the BucketIteratorReader, and a consumer of text, such as the
+// ReaderDigester or a Converter. Lines that pass are returned unchanged.
+//
+// As with the ReaderRecordIterator, header lines switch the format used
+// to parse the lines that follow them and lines that appear before any
+// header are parsed using Format, or the DefaultFormat if Format is not
+// set. Header lines are always kept. Lines that cannot be parsed are also
+// kept so that the consumer reports or skips them. Empty lines are dropped.
+type RecordFilterReader struct {
+	Reader io.ReadCloser
+	Filter RecordFilter
+	Format Format
+
+	reader  *bufio.Reader
+	format  Format
+	pending []byte
+	err     error
+}
+
+// Read returns the lines of the underlying reader that pass the filter.
+func (r *RecordFilterReader) Read(b []byte) (int, error) {
+	if r.reader == nil {
+		r.reader = bufio.NewReader(r.Reader)
+		r.format = r.Format
+		if r.format == nil {
+			r.format = DefaultFormat
+		}
+	}
+	for len(r.pending) < 1 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var line, err = r.reader.ReadString('\n')
+		r.err = err
+		if r.keep(line) {
+			r.pending = append(r.pending[:0], line...)
+		}
+	}
+	var n = copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *RecordFilterReader) keep(line string) bool {
+	var attrs = strings.Fields(line)
+	if len(attrs) < 1 {
+		return false
+	}
+	if isHeader(attrs) {
+		if format, err := ParseFormat(line); err == nil {
+			r.format = format
+		}
+		return true
+	}
+	var record, err = parseFlowRecord(r.format, attrs)
+	if err != nil {
+		return true
+	}
+	return r.Filter.FilterRecord(record)
+}
+
+// Close the underlying reader.
+func (r *RecordFilterReader) Close() error {
+	return r.Reader.Close()
+}
@@ -0,0 +1,60 @@
+package vpcflow
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFilterInput = `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 REJECT OK
+
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 443 6 20 4249 1418530010 1418530070 ACCEPT OK
+not a record
+srcaddr dstaddr dstport action
+172.31.16.139 172.31.16.21 22 ACCEPT
+172.31.16.139 172.31.16.21 80 ACCEPT`
+
+func TestRecordFilterReader(t *testing.T) {
+	var filter, err = ParseRecordFilter("dstport in (22, 80)")
+	assert.Nil(t, err)
+	var r = &RecordFilterReader{Reader: ioutil.NopCloser(strings.NewReader(testFilterInput)), Filter: filter}
+	// A small buffer returns lines over many reads.
+	var text []byte
+	var b = make([]byte, 7)
+	for {
+		var n, err = r.Read(b)
+		text = append(text, b[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	assert.Nil(t, r.Close())
+	assert.Equal(t, `2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 REJECT OK
+not a record
+srcaddr dstaddr dstport action
+172.31.16.139 172.31.16.21 22 ACCEPT
+172.31.16.139 172.31.16.21 80 ACCEPT`, string(text))
+}
+
+func TestRecordFilterIterator(t *testing.T) {
+	var filter = MultiRecordFilter{
+		RecordFilterFunc(func(r FlowRecord) bool { return r.DstPort != 443 }),
+		RecordFilterFunc(func(r FlowRecord) bool { return r.Action == "ACCEPT" }),
+	}
+	var iter = &RecordFilterIterator{
+		Filter: filter,
+		RecordIterator: &ReaderRecordIterator{
+			Reader:          strings.NewReader(testFilterInput),
+			ReadErrorPolicy: SkipLineOnReadError,
+		},
+	}
+	var ports []int
+	for iter.Iterate() {
+		ports = append(ports, iter.Current().DstPort)
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []int{22, 80}, ports)
+	assert.Equal(t, FlowRecord{}, iter.Current())
+}
@@ -0,0 +1,311 @@
+package vpcflow
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReaderRecordIterator converts the contents of an io.Reader, such
+// as the BucketIteratorReader, into FlowRecord values. Empty lines
+// are skipped. Whenever a header line is encountered the iterator
+// switches to that format for all following lines so the content of
+// many files written with different formats may be concatenated.
+type ReaderRecordIterator struct {
+	Reader io.Reader
+	// Format is used for lines that appear before any header. If not
+	// set then the DefaultFormat is used.
+	Format Format
+	// ReadErrorPolicy determines the handling of lines that cannot be
+	// parsed. With SkipLineOnReadError they are skipped and a header line
+	// that cannot be parsed leaves the format unchanged. The iterator does
+	// not know where the files of its Reader begin and end so any other
+	// policy stops iterations at the first such line. This includes lines
+	// of another format, such as those cut short.
+	ReadErrorPolicy ReadErrorPolicy
+	// OnReadError, if set, is called with each error that is skipped.
+	OnReadError func(*LogFileError)
+	// Observer, if set, receives each line that cannot be parsed whether
+	// or not it is skipped.
+	Observer Observer
+
+	reader  *bufio.Reader
+	format  Format
+	line    int
+	current FlowRecord
+	isDone  bool
+	error   error
+}
+
+// Iterate pushes the cursor one record forward such that
+// the current value is fetched when calling Current().
+// This method returns false after all records have been
+// iterated over or a record could not be read or parsed.
+func (iter *ReaderRecordIterator) Iterate() bool {
+	if iter.reader == nil {
+		iter.reader = bufio.NewReader(iter.Reader)
+		iter.format = iter.Format
+		if iter.format == nil {
+			iter.format = DefaultFormat
+		}
+	}
+	for !iter.isDone {
+		line, err := iter.reader.ReadString('\n')
+		// A failed read is counted as a line so that the count
+		// identifies the line at which iterations stopped.
+		if len(line) > 0 || (err != nil && err != io.EOF) {
+			iter.line = iter.line + 1
+		}
+		if err != nil && err != io.EOF {
+			iter.error = err
+			iter.isDone = true
+			break
+		}
+		iter.isDone = err == io.EOF
+		attrs := strings.Fields(line)
+		if len(attrs) < 1 {
+			continue
+		}
+		if isHeader(attrs) {
+			format, err := ParseFormat(line)
+			if err != nil {
+				err = fmt.Errorf("error parsing flow log header. %s", err)
+				if iter.skipLine(err) {
+					continue
+				}
+				iter.error = err
+				iter.isDone = true
+				break
+			}
+			iter.format = format
+			continue
+		}
+		var record FlowRecord
+		switch {
+		case len(attrs) != len(iter.format):
+			err = fmt.Errorf("error parsing flow log record. expected %d fields but found %d", len(iter.format), len(attrs))
+		case iter.format.Equal(DefaultFormat) && attrs[0] != "2":
+			err = fmt.Errorf("error parsing flow log record. expected version 2 but found %s", attrs[0])
+		default:
+			record, err = parseFlowRecord(iter.format, attrs)
+			if err != nil {
+				err = fmt.Errorf("error parsing flow log record. %s", err)
+			}
+		}
+		if err != nil {
+			if iter.skipLine(err) {
+				continue
+			}
+			iter.error = err
+			iter.isDone = true
+			break
+		}
+		iter.current = record
+		return true
+	}
+	iter.current = FlowRecord{}
+	return false
+}
+
+// skipLine reports whether a line that could not be parsed is skipped
+// under the ReadErrorPolicy and passes skipped errors to OnReadError.
+func (iter *ReaderRecordIterator) skipLine(err error) bool {
+	if iter.ReadErrorPolicy != SkipLineOnReadError {
+		if iter.Observer != nil {
+			iter.Observer.ObserveReadError(&LogFileError{Line: iter.line, Err: err})
+		}
+		return false
+	}
+	iter.dropLine(err)
+	return true
+}
+
+// dropLine passes the error of a skipped line to the Observer and
+// OnReadError.
+func (iter *ReaderRecordIterator) dropLine(err error) {
+	var lfErr = &LogFileError{Line: iter.line, Err: err}
+	if iter.Observer != nil {
+		iter.Observer.ObserveReadError(lfErr)
+	}
+	if iter.OnReadError != nil {
+		iter.OnReadError(lfErr)
+	}
+}
+
+// Current gets the current value of the iterator.
+func (iter *ReaderRecordIterator) Current() FlowRecord {
+	return iter.current
+}
+
+// CurrentFormat gets the format of the line from which the current
+// value was parsed.
+func (iter *ReaderRecordIterator) CurrentFormat() Format {
+	switch {
+	case iter.format != nil:
+		return iter.format
+	case iter.Format != nil:
+		return iter.Format
+	default:
+		return DefaultFormat
+	}
+}
+
+// Close the underlying reader, if it is an io.Closer, and return
+// the error, if any, that caused iterations to stop.
+func (iter *ReaderRecordIterator) Close() error {
+	iter.isDone = true
+	var err error
+	if c, ok := iter.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+	if iter.error != nil {
+		return iter.error
+	}
+	return err
+}
+
+// BucketRecordIterator converts the files of a BucketIterator into
+// FlowRecord values and reports the LogFile from which each record was
+// parsed. Unlike a ReaderRecordIterator over a BucketIteratorReader, each
+// file is parsed on its own, starting from Format, and errors are returned
+// from Close as a *LogFileError that identifies the file and line.
+type BucketRecordIterator struct {
+	Context        context.Context
+	BucketIterator BucketIterator
+	// FetchPolicy must produce a SourceFileManager, such as those of this
+	// package, for records to be attributed to their files.
+	FetchPolicy func(BucketIterator) FileManager
+	Format      Format
+	// ReadErrorPolicy determines the handling of files that cannot be
+	// fetched, read, or parsed. With SkipFileOnReadError the remainder of
+	// the file is skipped and with SkipLineOnReadError only the lines that
+	// cannot be parsed are skipped. Records parsed from a file before it
+	// was skipped are not taken back. Skipped files are acknowledged as
+	// they are by the BucketIteratorReader.
+	ReadErrorPolicy ReadErrorPolicy
+	// OnReadError, if set, is called with each error that is skipped.
+	OnReadError func(*LogFileError)
+	// Observer, if set, receives the time spent waiting for each file and
+	// the errors of each file and line. If not set then the Observer of
+	// the Context, if any, is used.
+	Observer Observer
+
+	reader  *BucketIteratorReader
+	records *ReaderRecordIterator
+	current FlowRecord
+	isDone  bool
+	error   error
+}
+
+// Iterate pushes the cursor one record forward such that
+// the current value is fetched when calling Current().
+// This method returns false after all records have been
+// iterated over or a file could not be read or parsed.
+func (iter *BucketRecordIterator) Iterate() bool {
+	if iter.reader == nil {
+		iter.reader = &BucketIteratorReader{
+			Context:         iter.Context,
+			BucketIterator:  iter.BucketIterator,
+			FetchPolicy:     iter.FetchPolicy,
+			ReadErrorPolicy: iter.ReadErrorPolicy,
+			OnReadError:     iter.OnReadError,
+			Observer:        iter.Observer,
+		}
+	}
+	for !iter.isDone {
+		if iter.records == nil {
+			var ok, err = iter.reader.next()
+			if !ok {
+				if iter.reader.skipFetch(err) {
+					continue
+				}
+				if err != io.EOF {
+					iter.error = err
+				}
+				iter.isDone = true
+				break
+			}
+			iter.records = &ReaderRecordIterator{Reader: iter.reader.current, Format: iter.Format, OnReadError: iter.skipLine}
+			if iter.ReadErrorPolicy == SkipLineOnReadError {
+				iter.records.ReadErrorPolicy = SkipLineOnReadError
+			}
+		}
+		if iter.records.Iterate() {
+			iter.current = iter.records.Current()
+			return true
+		}
+		if err := iter.records.error; err != nil {
+			var source, _ = iter.reader.Source()
+			var lfErr = &LogFileError{LogFile: source, Line: iter.records.line, Err: err}
+			iter.reader.observer.ObserveReadError(lfErr)
+			if !iter.reader.skip(lfErr) {
+				iter.error = lfErr
+				iter.isDone = true
+				break
+			}
+		}
+		iter.reader.release()
+		iter.records = nil
+	}
+	iter.current = FlowRecord{}
+	return false
+}
+
+// skipLine attaches the current file to an error of a skipped line.
+func (iter *BucketRecordIterator) skipLine(e *LogFileError) {
+	e.LogFile, _ = iter.reader.Source()
+	iter.reader.observer.ObserveReadError(e)
+	if iter.OnReadError != nil {
+		iter.OnReadError(e)
+	}
+}
+
+// Current gets the current value of the iterator.
+func (iter *BucketRecordIterator) Current() FlowRecord {
+	return iter.current
+}
+
+// CurrentLogFile gets the LogFile from which the current value was
+// parsed. It returns false if the FileManager does not report sources.
+func (iter *BucketRecordIterator) CurrentLogFile() (LogFile, bool) {
+	if iter.reader == nil {
+		return LogFile{}, false
+	}
+	return iter.reader.Source()
+}
+
+// CurrentLine gets the line of the file, counted from one, from which the
+// current value was parsed.
+func (iter *BucketRecordIterator) CurrentLine() int {
+	if iter.records == nil {
+		return 0
+	}
+	return iter.records.line
+}
+
+// CurrentFormat gets the format of the line from which the current
+// value was parsed.
+func (iter *BucketRecordIterator) CurrentFormat() Format {
+	if iter.records == nil {
+		return (&ReaderRecordIterator{Format: iter.Format}).CurrentFormat()
+	}
+	return iter.records.CurrentFormat()
+}
+
+// Close the FileManager and the BucketIterator and return the error,
+// if any, that caused iterations to stop.
+func (iter *BucketRecordIterator) Close() error {
+	iter.isDone = true
+	var err error
+	if iter.reader != nil {
+		err = iter.reader.Close()
+	} else {
+		err = iter.BucketIterator.Close()
+	}
+	if iter.error != nil {
+		return iter.error
+	}
+	return err
+}
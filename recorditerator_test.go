@@ -0,0 +1,485 @@
+package vpcflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordIteratorSuccess(t *testing.T) {
+	input := []byte(`version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK
+
+2 123456789010 eni-1a2b3c4d - - - - - - - 1431280876 1431280934 - NODATA
+2 123456789010 eni-abc123de 2001:db8::1 2001:db8::2 20341 443 6 5 300 1718530010 1718530070 REJECT OK`)
+	expected := []FlowRecord{
+		{
+			Version:     2,
+			AccountID:   "123456789010",
+			InterfaceID: "eni-abc123de",
+			SrcAddr:     net.ParseIP("172.31.16.139"),
+			DstAddr:     net.ParseIP("172.31.16.21"),
+			SrcPort:     20641,
+			DstPort:     80,
+			Protocol:    6,
+			Packets:     20,
+			Bytes:       1000,
+			Start:       time.Unix(1418530010, 0),
+			End:         time.Unix(1418530070, 0),
+			Action:      "ACCEPT",
+			LogStatus:   "OK",
+		},
+		{
+			Version:     2,
+			AccountID:   "123456789010",
+			InterfaceID: "eni-1a2b3c4d",
+			Start:       time.Unix(1431280876, 0),
+			End:         time.Unix(1431280934, 0),
+			LogStatus:   "NODATA",
+		},
+		{
+			Version:     2,
+			AccountID:   "123456789010",
+			InterfaceID: "eni-abc123de",
+			SrcAddr:     net.ParseIP("2001:db8::1"),
+			DstAddr:     net.ParseIP("2001:db8::2"),
+			SrcPort:     20341,
+			DstPort:     443,
+			Protocol:    6,
+			Packets:     5,
+			Bytes:       300,
+			Start:       time.Unix(1718530010, 0),
+			End:         time.Unix(1718530070, 0),
+			Action:      "REJECT",
+			LogStatus:   "OK",
+		},
+	}
+
+	iter := &ReaderRecordIterator{Reader: bytes.NewReader(input)}
+	var actual []FlowRecord
+	for iter.Iterate() {
+		actual = append(actual, iter.Current())
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, FlowRecord{}, iter.Current())
+}
+
+func TestRecordIteratorFormats(t *testing.T) {
+	// Content from two files with different formats has been concatenated
+	// and the first file's header is missing so the configured format
+	// must be used until the second file's header is found.
+	input := `eni-abc123de 172.31.16.139 172.31.16.21 ACCEPT
+version vpc-id srcaddr dstaddr tcp-flags flow-direction
+3 vpc-abcdefab012345678 10.0.1.5 10.0.0.220 19 ingress`
+	iter := &ReaderRecordIterator{
+		Reader: strings.NewReader(input),
+		Format: Format{FieldInterfaceID, FieldSrcAddr, FieldDstAddr, FieldAction},
+	}
+
+	assert.Equal(t, iter.Format, iter.CurrentFormat())
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, iter.Format, iter.CurrentFormat())
+	assert.Equal(t, FlowRecord{
+		InterfaceID: "eni-abc123de",
+		SrcAddr:     net.ParseIP("172.31.16.139"),
+		DstAddr:     net.ParseIP("172.31.16.21"),
+		Action:      "ACCEPT",
+	}, iter.Current())
+
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, Format{FieldVersion, FieldVPCID, FieldSrcAddr, FieldDstAddr, FieldTCPFlags, FieldFlowDirection}, iter.CurrentFormat())
+	assert.Equal(t, FlowRecord{
+		Version:       3,
+		VPCID:         "vpc-abcdefab012345678",
+		SrcAddr:       net.ParseIP("10.0.1.5"),
+		DstAddr:       net.ParseIP("10.0.0.220"),
+		TCPFlags:      19,
+		FlowDirection: "ingress",
+	}, iter.Current())
+
+	assert.False(t, iter.Iterate())
+	assert.Nil(t, iter.Close())
+}
+
+func TestRecordIteratorUnsupportedField(t *testing.T) {
+	iter := &ReaderRecordIterator{Reader: strings.NewReader("version reject-reason srcaddr\n2 BPA 172.31.16.139\n")}
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, FlowRecord{Version: 2, SrcAddr: net.ParseIP("172.31.16.139")}, iter.Current())
+	assert.Equal(t, "2 - 172.31.16.139", iter.Current().Format(iter.CurrentFormat()))
+	assert.False(t, iter.Iterate())
+	assert.Nil(t, iter.Close())
+}
+
+func TestRecordIteratorBadData(t *testing.T) {
+	tc := []struct {
+		Name  string
+		Input string
+	}{
+		{
+			Name:  "bad-src-addr",
+			Input: "2 123456789010 eni-abc123de 172.31.16 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK",
+		},
+		{
+			Name:  "bad-protocol",
+			Input: "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 tcp 20 1000 1418530010 1418530070 ACCEPT OK",
+		},
+		{
+			Name:  "bad-start",
+			Input: "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 not-a-time 1418530070 ACCEPT OK",
+		},
+		{
+			Name:  "bad-end",
+			Input: "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 not-a-time ACCEPT OK",
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			iter := &ReaderRecordIterator{Reader: strings.NewReader(tt.Input)}
+			assert.False(t, iter.Iterate())
+			assert.NotNil(t, iter.Close())
+		})
+	}
+}
+
+func TestRecordIteratorForeignLines(t *testing.T) {
+	var record = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK"
+	tc := []struct {
+		Name  string
+		Input string
+	}{
+		{
+			Name:  "too-few-fields",
+			Input: "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT",
+		},
+		{
+			Name:  "too-many-fields",
+			Input: record + " vpc-abcdefab012345678",
+		},
+		{
+			Name:  "other-version",
+			Input: "3 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK",
+		},
+		{
+			Name:  "bad-version",
+			Input: "two 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK",
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var collector ErrorCollector
+			iter := &ReaderRecordIterator{
+				Reader:          strings.NewReader(record + "\n" + tt.Input + "\n" + record + "\n"),
+				ReadErrorPolicy: SkipLineOnReadError,
+				OnReadError:     collector.Collect,
+			}
+			var count int
+			for iter.Iterate() {
+				count = count + 1
+			}
+			assert.Nil(t, iter.Close())
+			assert.Equal(t, 2, count)
+			if assert.Len(t, collector.Errors(), 1) {
+				assert.Equal(t, 2, collector.Errors()[0].Line)
+			}
+
+			// Without skipping lines the read stops at the foreign line.
+			iter = &ReaderRecordIterator{
+				Reader:      strings.NewReader(record + "\n" + tt.Input + "\n" + record + "\n"),
+				OnReadError: collector.Collect,
+			}
+			assert.True(t, iter.Iterate())
+			assert.False(t, iter.Iterate())
+			assert.NotNil(t, iter.Close())
+			assert.Len(t, collector.Errors(), 1)
+		})
+	}
+}
+
+func TestRecordIteratorReaderError(t *testing.T) {
+	iter := &ReaderRecordIterator{Reader: &trapReader{}}
+	assert.False(t, iter.Iterate())
+	assert.NotNil(t, iter.Close())
+}
+
+func TestRecordIteratorClosesReader(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var closeErr = errors.New("")
+	var reader = NewMockReadCloser(ctrl)
+	reader.EXPECT().Close().Return(closeErr)
+
+	iter := &ReaderRecordIterator{Reader: reader}
+	assert.Equal(t, closeErr, iter.Close())
+}
+
+func TestFlowRecordString(t *testing.T) {
+	tc := []string{
+		"2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK",
+		"2 123456789010 eni-abc123de - - 0 0 0 0 0 1431280876 1431280934 - NODATA",
+	}
+	for _, line := range tc {
+		t.Run(line, func(t *testing.T) {
+			iter := &ReaderRecordIterator{Reader: ioutil.NopCloser(strings.NewReader(line))}
+			assert.True(t, iter.Iterate())
+			assert.Equal(t, line, iter.Current().String())
+			assert.Nil(t, iter.Close())
+		})
+	}
+}
+
+func TestParseUnixTime(t *testing.T) {
+	tc := []struct {
+		Name          string
+		Value         string
+		ExpectedError bool
+	}{
+		{
+			Name:  "success",
+			Value: "1418530010",
+		},
+		{
+			Name:  "empty",
+			Value: "-",
+		},
+		{
+			Name:          "bad-value",
+			Value:         "not valid unix ts",
+			ExpectedError: true,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			ts, err := parseUnixTime(tt.Value)
+			if tt.ExpectedError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.Value, formatUnixTime(ts))
+		})
+	}
+}
+
+var benchParseFlowRecord FlowRecord
+
+func BenchmarkParseFlowRecord(b *testing.B) {
+	attrs := strings.Split("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK", " ")
+	var record FlowRecord
+	var err error
+	b.ResetTimer()
+	for n := 0; n < b.N; n = n + 1 {
+		record, err = parseFlowRecord(DefaultFormat, attrs)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	benchParseFlowRecord = record
+}
+
+func TestBucketRecordIterator(t *testing.T) {
+	var a = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz"
+	var b = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_b.log.gz"
+	var root = writeTestTree(t, map[string]string{
+		a: "version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status\n" +
+			"2 123456789010 eni-aaaaaaaa 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK\n" +
+			"2 123456789010 eni-aaaaaaaa 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 REJECT OK",
+		b: "2 123456789010 eni-bbbbbbbb 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK\n" +
+			"\n" +
+			"2 123456789010 eni-bbbbbbbb not-an-address 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK\n",
+	})
+	defer os.RemoveAll(root)
+
+	var iter = &BucketRecordIterator{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewLocalFilePolicy(),
+	}
+	var keys []string
+	var lines []int
+	for iter.Iterate() {
+		var lf, ok = iter.CurrentLogFile()
+		assert.True(t, ok)
+		assert.Equal(t, "fl-00123456789abcdef", lf.FlowLogID)
+		keys = append(keys, lf.Key)
+		lines = append(lines, iter.CurrentLine())
+		assert.Equal(t, lf.Hash == "a", strings.HasPrefix(iter.Current().InterfaceID, "eni-a"))
+	}
+	assert.Equal(t, []string{a, a, b}, keys)
+	assert.Equal(t, []int{2, 3, 1}, lines)
+
+	var err = iter.Close()
+	var lfErr, ok = err.(*LogFileError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, b, lfErr.LogFile.Key)
+		assert.Equal(t, 3, lfErr.Line)
+		assert.Contains(t, lfErr.Error(), b+" at line 3.")
+	}
+}
+
+func TestBucketIteratorReaderSource(t *testing.T) {
+	var a = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_a.log.gz"
+	var root = writeTestTree(t, map[string]string{a: "a\n"})
+	defer os.RemoveAll(root)
+
+	var r = &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewLocalFilePolicy(),
+	}
+	var _, ok = r.Source()
+	assert.False(t, ok)
+	var text, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\n", string(text))
+	lf, ok := r.Source()
+	assert.True(t, ok)
+	assert.Equal(t, a, lf.Key)
+	assert.Nil(t, r.Close())
+
+	// Files that cannot be opened are identified in the error.
+	assert.Nil(t, os.Remove(filepath.Join(root, filepath.FromSlash(a))))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(a)), []byte("not gzip"), 0600))
+	r = &BucketIteratorReader{
+		BucketIterator: &DirectoryBucketIterator{Root: root},
+		FetchPolicy:    NewLocalFilePolicy(),
+	}
+	_, err = ioutil.ReadAll(r)
+	assert.IsType(t, &LogFileError{}, err)
+	assert.Contains(t, err.Error(), a)
+	assert.Nil(t, r.Close())
+}
+
+func TestRecordIteratorSkipLine(t *testing.T) {
+	var collector ErrorCollector
+	iter := &ReaderRecordIterator{
+		Reader: strings.NewReader(`2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 tcp 20 1000 1418530010 1418530070 ACCEPT OK
+2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK
+`),
+		ReadErrorPolicy: SkipLineOnReadError,
+		OnReadError:     collector.Collect,
+	}
+	var count int
+	for iter.Iterate() {
+		count = count + 1
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, 2, count)
+	var errs = collector.Errors()
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, 2, errs[0].Line)
+	}
+
+	// Lines are not skipped without knowing the files they belong to.
+	iter = &ReaderRecordIterator{
+		Reader:          strings.NewReader("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 80 tcp 20 1000 1418530010 1418530070 ACCEPT OK\n"),
+		ReadErrorPolicy: SkipFileOnReadError,
+	}
+	assert.False(t, iter.Iterate())
+	assert.NotNil(t, iter.Close())
+}
+
+// writeCorruptTree writes a set of log files of which the b file is not
+// gzip data, the c file is truncated, and the d file has a bad second line.
+func writeCorruptTree(t *testing.T) (string, map[string]string) {
+	var record = "2 123456789010 eni-%s 172.31.16.139 172.31.16.21 20641 80 6 20 1000 1418530010 1418530070 ACCEPT OK\n"
+	var keys = make(map[string]string)
+	var files = make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		keys[name] = testLocalDir + "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_" + name + ".log.gz"
+		files[keys[name]] = fmt.Sprintf(record, name)
+	}
+	files[keys["c"]] = strings.Repeat(fmt.Sprintf(record, "c"), 1000)
+	files[keys["d"]] = fmt.Sprintf(record, "d") + "2 123456789010 eni-d 172.31.16.139 172.31.16.21 20641 80 tcp 20 1000 1418530010 1418530070 ACCEPT OK\n" + fmt.Sprintf(record, "d")
+	var root = writeTestTree(t, files)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, keys["b"]), []byte("not gzip"), 0600))
+	var info, err = os.Stat(filepath.Join(root, keys["c"]))
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(filepath.Join(root, keys["c"]), info.Size()/2))
+	return root, keys
+}
+
+func TestBucketRecordIteratorReadErrorPolicy(t *testing.T) {
+	var root, keys = writeCorruptTree(t)
+	defer os.RemoveAll(root)
+
+	tc := []struct {
+		Name           string
+		Policy         ReadErrorPolicy
+		ExpectedCounts map[string]int
+		ExpectedErrors []string
+		ExpectedError  string
+	}{
+		{
+			Name:           "fail",
+			Policy:         FailOnReadError,
+			ExpectedCounts: map[string]int{"eni-a": 1},
+			ExpectedError:  "b",
+		},
+		{
+			Name:           "skip-file",
+			Policy:         SkipFileOnReadError,
+			ExpectedCounts: map[string]int{"eni-a": 1, "eni-d": 1, "eni-e": 1},
+			ExpectedErrors: []string{"b", "c", "d"},
+		},
+		{
+			Name:           "skip-line",
+			Policy:         SkipLineOnReadError,
+			ExpectedCounts: map[string]int{"eni-a": 1, "eni-d": 2, "eni-e": 1},
+			ExpectedErrors: []string{"b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var collector ErrorCollector
+			var iter = &BucketRecordIterator{
+				BucketIterator:  &DirectoryBucketIterator{Root: root},
+				FetchPolicy:     NewLocalFilePolicy(),
+				ReadErrorPolicy: tt.Policy,
+				OnReadError:     collector.Collect,
+			}
+			var counts = make(map[string]int)
+			for iter.Iterate() {
+				counts[iter.Current().InterfaceID] = counts[iter.Current().InterfaceID] + 1
+			}
+			var err = iter.Close()
+			// Records that were read from the truncated file before its
+			// error are kept.
+			assert.True(t, counts["eni-c"] < 1000)
+			delete(counts, "eni-c")
+			assert.Equal(t, tt.ExpectedCounts, counts)
+
+			if tt.ExpectedError != "" {
+				if assert.IsType(t, &LogFileError{}, err) {
+					assert.Equal(t, keys[tt.ExpectedError], err.(*LogFileError).LogFile.Key)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			var skipped []string
+			for _, e := range collector.Errors() {
+				skipped = append(skipped, e.LogFile.Key)
+			}
+			var expected []string
+			for _, name := range tt.ExpectedErrors {
+				expected = append(expected, keys[name])
+			}
+			assert.Equal(t, expected, skipped)
+			assert.Equal(t, 2, collector.Errors()[2].Line)
+		})
+	}
+}
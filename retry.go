@@ -0,0 +1,306 @@
+package vpcflow
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+// RetryError is returned when a call fails after more than one
+// attempt. Err is the error of the final attempt.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts. %s", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the final attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy retries calls that fail with a retryable error. The delay
+// before each retry grows exponentially from BaseDelay up to MaxDelay and
+// a random jitter of up to the full delay is applied so that concurrent
+// callers do not retry in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values less than two disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. If not set, 100ms
+	// is used.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. If not set, 10s is used.
+	MaxDelay time.Duration
+	// Retryable classifies errors. If not set, IsRetryableError is used.
+	Retryable func(error) bool
+	// OnRetry, if set, is called with the attempt number and the error
+	// of each failed attempt that will be retried.
+	OnRetry func(attempt int, err error)
+}
+
+// Do calls fn until it succeeds, fails with an error that cannot be
+// retried, or the attempts are exhausted. A *RetryError that records the
+// number of attempts is returned if fn failed more than once. Waiting
+// between attempts stops early, with the error of the context, if the
+// context is done.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	var retryable = p.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+	var attempt = 1
+	for {
+		var err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				return &RetryError{Attempts: attempt, Err: err}
+			}
+			return err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err)
+		}
+		var timer = time.NewTimer(p.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &RetryError{Attempts: attempt, Err: ctx.Err()}
+		case <-timer.C:
+		}
+		attempt = attempt + 1
+	}
+}
+
+// delay produces the jittered wait that follows the given attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	var base, max = p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+	var d = base
+	for x := 1; x < attempt && d < max; x = x + 1 {
+		d = d * 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// IsRetryableError reports whether an error is likely to be transient.
+// This includes AWS throttling and retryable error codes, server errors
+// with a 5xx or 429 status, and network timeouts. Cancelled requests are
+// never retried.
+func IsRetryableError(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		if rerr.StatusCode() >= 500 || rerr.StatusCode() == 429 {
+			return true
+		}
+	}
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// RetryS3API wraps an S3API so that the calls used to list and fetch
+// log files are retried according to the Policy. It may be given to the
+// BucketStateIterator and to NewPrefetchPolicy in place of the client.
+//
+// Reading the body of a fetched object is retried as well. A read that
+// fails with a retryable error resumes with a ranged request for the rest
+// of the object, or of the range that was requested, so that a connection
+// dropped part way through does not fail the download of a FileManager.
+// The resumed request is conditional on the ETag of the first response so
+// that content of an object that was replaced is never mixed.
+//
+// The AWS SDK applies its own retries within each call. Those should be
+// reduced through the client configuration when using this wrapper to
+// avoid multiplying the number of attempts.
+type RetryS3API struct {
+	s3iface.S3API
+	Policy RetryPolicy
+}
+
+// ListObjectsV2 lists objects with retries.
+func (r *RetryS3API) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	var output *s3.ListObjectsV2Output
+	var err = r.Policy.Do(context.Background(), func() error {
+		var e error
+		output, e = r.S3API.ListObjectsV2(input)
+		return e
+	})
+	return output, err
+}
+
+// ListObjectsV2WithContext lists objects with retries.
+func (r *RetryS3API) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	var output *s3.ListObjectsV2Output
+	var err = r.Policy.Do(ctx, func() error {
+		var e error
+		output, e = r.S3API.ListObjectsV2WithContext(ctx, input, opts...)
+		return e
+	})
+	return output, err
+}
+
+// GetObject fetches an object with retries.
+func (r *RetryS3API) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return r.getObject(context.Background(), input, r.S3API.GetObject)
+}
+
+// GetObjectWithContext fetches an object with retries. This is the call
+// used by the downloads of the FileManagers.
+func (r *RetryS3API) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return r.getObject(ctx, input, func(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return r.S3API.GetObjectWithContext(ctx, in, opts...)
+	})
+}
+
+func (r *RetryS3API) getObject(ctx context.Context, input *s3.GetObjectInput, get func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)) (*s3.GetObjectOutput, error) {
+	var output *s3.GetObjectOutput
+	var err = r.Policy.Do(ctx, func() error {
+		var e error
+		output, e = get(input)
+		return e
+	})
+	if err != nil || output == nil || output.Body == nil {
+		return output, err
+	}
+	output.Body = &retryBody{
+		ctx:    ctx,
+		policy: r.Policy,
+		get:    get,
+		input:  input,
+		etag:   output.ETag,
+		body:   output.Body,
+	}
+	return output, nil
+}
+
+// retryBody resumes reading an object body that fails part way through
+// with a ranged request that begins after the last byte read.
+type retryBody struct {
+	ctx    context.Context
+	policy RetryPolicy
+	get    func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	input  *s3.GetObjectInput
+	etag   *string
+	body   io.ReadCloser
+	offset int64
+	err    error
+	// stalled counts the resumes that have not read any content so that
+	// a body that fails immediately is not resumed forever.
+	stalled int
+}
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	for {
+		var n, err = b.body.Read(p)
+		b.offset = b.offset + int64(n)
+		if n > 0 {
+			b.stalled = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if b.err = b.resume(err); b.err != nil || n > 0 {
+			return n, b.err
+		}
+	}
+}
+
+// resume replaces the failed body with the remaining content. The error
+// of the read is returned if it cannot be retried.
+func (b *retryBody) resume(cause error) error {
+	var retryable = b.policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+	var input, ok = b.remaining()
+	if !ok || !retryable(cause) || b.stalled+1 >= b.policy.MaxAttempts || b.ctx.Err() != nil {
+		return cause
+	}
+	b.stalled = b.stalled + 1
+	_ = b.body.Close()
+	// The failed read counts as the first attempt of the policy so that
+	// the resumed request waits and retries in the same way as any other.
+	var failed = true
+	return b.policy.Do(b.ctx, func() error {
+		if failed {
+			failed = false
+			return cause
+		}
+		var output, e = b.get(input)
+		if e != nil {
+			return e
+		}
+		b.body = output.Body
+		return nil
+	})
+}
+
+// remaining builds the request for the content that follows the bytes
+// already read. Suffix ranges cannot be resumed.
+func (b *retryBody) remaining() (*s3.GetObjectInput, bool) {
+	var start, end = int64(0), ""
+	if rng := aws.StringValue(b.input.Range); rng != "" {
+		var bounds = strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		var e error
+		if len(bounds) != 2 || bounds[0] == "" {
+			return nil, false
+		}
+		if start, e = strconv.ParseInt(bounds[0], 10, 64); e != nil {
+			return nil, false
+		}
+		end = bounds[1]
+	}
+	var input = *b.input
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%s", start+b.offset, end))
+	if input.IfMatch == nil {
+		input.IfMatch = b.etag
+	}
+	return &input, true
+}
+
+func (b *retryBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,358 @@
+package vpcflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var errTransient = awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, "")
+
+func TestRetryPolicyDo(t *testing.T) {
+	var errFatal = errors.New("fatal")
+	tc := []struct {
+		Name             string
+		MaxAttempts      int
+		Errors           []error
+		ExpectedCalls    int
+		ExpectedRetries  int
+		ExpectedAttempts int
+		ExpectedErr      error
+	}{
+		{
+			Name:          "success",
+			MaxAttempts:   3,
+			Errors:        []error{nil},
+			ExpectedCalls: 1,
+		},
+		{
+			Name:            "recovers",
+			MaxAttempts:     3,
+			Errors:          []error{errTransient, errTransient, nil},
+			ExpectedCalls:   3,
+			ExpectedRetries: 2,
+		},
+		{
+			Name:             "exhausted",
+			MaxAttempts:      3,
+			Errors:           []error{errTransient, errTransient, errTransient, nil},
+			ExpectedCalls:    3,
+			ExpectedRetries:  2,
+			ExpectedAttempts: 3,
+			ExpectedErr:      errTransient,
+		},
+		{
+			Name:          "not-retryable",
+			MaxAttempts:   3,
+			Errors:        []error{errFatal, nil},
+			ExpectedCalls: 1,
+			ExpectedErr:   errFatal,
+		},
+		{
+			Name:             "not-retryable-after-retry",
+			MaxAttempts:      3,
+			Errors:           []error{errTransient, errFatal, nil},
+			ExpectedCalls:    2,
+			ExpectedRetries:  1,
+			ExpectedAttempts: 2,
+			ExpectedErr:      errFatal,
+		},
+		{
+			Name:          "disabled",
+			Errors:        []error{errTransient, nil},
+			ExpectedCalls: 1,
+			ExpectedErr:   errTransient,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var calls int
+			var retries []int
+			var p = RetryPolicy{
+				MaxAttempts: tt.MaxAttempts,
+				BaseDelay:   time.Microsecond,
+				OnRetry: func(attempt int, err error) {
+					retries = append(retries, attempt)
+				},
+			}
+			var err = p.Do(context.Background(), func() error {
+				calls = calls + 1
+				return tt.Errors[calls-1]
+			})
+			assert.Equal(t, tt.ExpectedCalls, calls)
+			assert.Len(t, retries, tt.ExpectedRetries)
+			if tt.ExpectedAttempts > 0 {
+				assert.IsType(t, &RetryError{}, err)
+				assert.Equal(t, tt.ExpectedAttempts, err.(*RetryError).Attempts)
+				assert.Equal(t, tt.ExpectedErr, err.(*RetryError).Err)
+				return
+			}
+			assert.Equal(t, tt.ExpectedErr, err)
+		})
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	var p = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+	var err = p.Do(ctx, func() error { return errTransient })
+	assert.IsType(t, &RetryError{}, err)
+	assert.Equal(t, 1, err.(*RetryError).Attempts)
+	assert.Equal(t, context.Canceled, err.(*RetryError).Err)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	var p = RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	for attempt := 1; attempt < 10; attempt = attempt + 1 {
+		var max = time.Millisecond << uint(attempt-1)
+		if max > p.MaxDelay {
+			max = p.MaxDelay
+		}
+		for x := 0; x < 100; x = x + 1 {
+			var d = p.delay(attempt)
+			assert.True(t, d >= 0 && d <= max, "attempt %d delay %s exceeds %s", attempt, d, max)
+		}
+	}
+	assert.True(t, RetryPolicy{}.delay(100) <= defaultRetryMaxDelay)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsRetryableError(t *testing.T) {
+	tc := []struct {
+		Name     string
+		Err      error
+		Expected bool
+	}{
+		{Name: "nil", Err: nil},
+		{Name: "plain", Err: errors.New("")},
+		{Name: "throttle", Err: awserr.New("Throttling", "", nil), Expected: true},
+		{Name: "request-timeout", Err: awserr.New("RequestTimeout", "", nil), Expected: true},
+		{Name: "5xx", Err: errTransient, Expected: true},
+		{Name: "429", Err: awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), Expected: true},
+		{Name: "4xx", Err: awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "", nil), 404, ""), Expected: false},
+		{Name: "cancelled", Err: awserr.New(request.CanceledErrorCode, "", context.Canceled), Expected: false},
+		{Name: "context", Err: context.DeadlineExceeded, Expected: false},
+		{Name: "timeout", Err: timeoutError{}, Expected: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, IsRetryableError(tt.Err))
+		})
+	}
+}
+
+func TestRetryS3APIListing(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var output = s3.ListObjectsV2Output{
+		Contents: []*s3.Object{{
+			Key:  aws.String("123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"),
+			Size: aws.Int64(100),
+		}},
+	}
+	gomock.InOrder(
+		queue.EXPECT().ListObjectsV2(gomock.Any()).Return(nil, errTransient),
+		queue.EXPECT().ListObjectsV2(gomock.Any()).Return(&output, nil),
+	)
+	var bi = BucketStateIterator{
+		Bucket: "testbucket",
+		Queue:  &RetryS3API{S3API: queue, Policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Microsecond}},
+	}
+	assert.True(t, bi.Iterate())
+	assert.False(t, bi.Iterate())
+	assert.Nil(t, bi.Close())
+
+	var ctx = context.Background()
+	queue.EXPECT().ListObjectsV2WithContext(ctx, gomock.Any()).Return(nil, errTransient).Times(2)
+	bi = BucketStateIterator{
+		Context: ctx,
+		Bucket:  "testbucket",
+		Queue:   &RetryS3API{S3API: queue, Policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Microsecond}},
+	}
+	assert.False(t, bi.Iterate())
+	assert.Contains(t, bi.Close().Error(), "failed after 2 attempts")
+}
+
+func TestRetryS3APIFetching(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var gzipBody = []byte{
+		31, 139, 8, 0, 0, 0, 0, 0, 0, 255, 98, 24, 5, 163, 96, 20, 12, 123, 0,
+		8, 0, 0, 255, 255, 128, 23, 11, 6, 232, 3, 0, 0,
+	}
+	gomock.InOrder(
+		queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errTransient),
+		queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.GetObjectOutput{
+			Body:          ioutil.NopCloser(bytes.NewBuffer(gzipBody)),
+			ContentLength: aws.Int64(int64(len(gzipBody))),
+		}, nil),
+	)
+	var retries int
+	var client = &RetryS3API{S3API: queue, Policy: RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Microsecond,
+		OnRetry:     func(int, error) { retries = retries + 1 },
+	}}
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "testbucket", Key: "file", Size: int64(len(gzipBody))}),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(nil),
+	)
+	var fm = NewPrefetchPolicy(client, 1024, 1)(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	var content, _ = ioutil.ReadAll(r)
+	assert.Len(t, content, 1000)
+	fm.Put(r)
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, retries)
+}
+
+// droppedBody returns the first n bytes of its content and then fails
+// as a dropped connection would.
+type droppedBody struct {
+	r *bytes.Reader
+}
+
+func newDroppedBody(content []byte, n int) io.ReadCloser {
+	return ioutil.NopCloser(&droppedBody{r: bytes.NewReader(content[:n])})
+}
+
+func (b *droppedBody) Read(p []byte) (int, error) {
+	if b.r.Len() < 1 {
+		return 0, errTransient
+	}
+	return b.r.Read(p)
+}
+
+func TestRetryS3APIResumesBody(t *testing.T) {
+	var content = []byte("0123456789abcdefghij")
+	tc := []struct {
+		Name            string
+		Range           string
+		Drops           []int
+		MaxAttempts     int
+		ExpectedRanges  []string
+		ExpectedContent string
+		ExpectedErr     bool
+	}{
+		{"whole object", "", []int{4}, 3, []string{"", "bytes=4-"}, string(content), false},
+		{"range", "bytes=10-19", []int{4}, 3, []string{"bytes=10-19", "bytes=14-19"}, "abcdefghij", false},
+		{"open range", "bytes=10-", []int{4}, 3, []string{"bytes=10-", "bytes=14-"}, "abcdefghij", false},
+		{"drops with progress", "", []int{4, 3}, 2, []string{"", "bytes=4-", "bytes=7-"}, string(content), false},
+		{"drops without progress", "", []int{4, 0}, 2, []string{"", "bytes=4-"}, "0123", true},
+		{"suffix range", "bytes=-5", []int{2}, 3, []string{"bytes=-5"}, "fg", true},
+		{"no retries", "", []int{4}, 1, []string{""}, "0123", true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var ctrl = gomock.NewController(t)
+			defer ctrl.Finish()
+			var queue = NewMockS3API(ctrl)
+			var ranges []string
+			queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+					var rng = aws.StringValue(input.Range)
+					ranges = append(ranges, rng)
+					if len(ranges) > 1 {
+						assert.Equal(t, "etag", aws.StringValue(input.IfMatch))
+					}
+					var body = content
+					switch {
+					case strings.HasPrefix(rng, "bytes=-"):
+						var n, _ = strconv.Atoi(strings.TrimPrefix(rng, "bytes=-"))
+						body = content[len(content)-n:]
+					case rng != "":
+						var start, end = 0, len(content) - 1
+						_, _ = fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+						body = content[start : end+1]
+					}
+					var reader = ioutil.NopCloser(bytes.NewReader(body))
+					if len(ranges) <= len(tt.Drops) {
+						reader = newDroppedBody(body, tt.Drops[len(ranges)-1])
+					}
+					return &s3.GetObjectOutput{Body: reader, ETag: aws.String("etag")}, nil
+				},
+			).AnyTimes()
+			var client = &RetryS3API{S3API: queue, Policy: RetryPolicy{MaxAttempts: tt.MaxAttempts, BaseDelay: time.Microsecond}}
+			var input = &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+			if tt.Range != "" {
+				input.Range = aws.String(tt.Range)
+			}
+			var output, err = client.GetObjectWithContext(context.Background(), input)
+			assert.Nil(t, err)
+			var read, readErr = ioutil.ReadAll(output.Body)
+			assert.Equal(t, tt.ExpectedErr, readErr != nil, "%v", readErr)
+			assert.Equal(t, tt.ExpectedContent, string(read))
+			assert.Equal(t, tt.ExpectedRanges, ranges)
+			assert.Nil(t, output.Body.Close())
+		})
+	}
+}
+
+func TestRetryS3APIResumesStreaming(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var content = gzipString(strings.Repeat("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n", 100))
+	gomock.InOrder(
+		queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.GetObjectOutput{
+			Body: newDroppedBody(content, len(content)/2),
+		}, nil),
+		queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				assert.Equal(t, fmt.Sprintf("bytes=%d-", len(content)/2), aws.StringValue(input.Range))
+				return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(content[len(content)/2:]))}, nil
+			},
+		),
+	)
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "testbucket", Key: "file.log.gz", Size: int64(len(content))}).AnyTimes(),
+	)
+	var client = &RetryS3API{S3API: queue, Policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Microsecond}}
+	var fm = NewStreamingPolicy(client, 0)(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	var read, _ = ioutil.ReadAll(r)
+	assert.Len(t, read, 100*len("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"))
+}
+
+func TestRetryErrorUnwrap(t *testing.T) {
+	var err = &RetryError{Attempts: 2, Err: errTransient}
+	assert.Equal(t, errTransient, err.Unwrap())
+}
@@ -0,0 +1,275 @@
+package vpcflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	objectCreatedEvent = "ObjectCreated:"
+	// maxReceiveMessages is the largest batch SQS will return from a
+	// single ReceiveMessage call.
+	maxReceiveMessages = 10
+)
+
+// s3Notification is the subset of an S3 event notification that is
+// needed to locate the created objects.
+type s3Notification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// sqsMessage tracks a received message until all of the files it
+// announced have been acknowledged.
+type sqsMessage struct {
+	receiptHandle *string
+	pending       int
+}
+
+// SQSBucketIterator implements the BucketIterator interface by consuming
+// S3 ObjectCreated event notifications from an SQS queue rather than
+// listing the bucket. Each created object becomes a LogFile with the key
+// parsed in the same way as the BucketStateIterator.
+//
+// Messages are only deleted from the queue once every file they contain
+// has been passed to Ack. The PrefetchFileManager acknowledges a file once
+// it has been read to the end so that files which fail to download or are
+// never consumed are redelivered by SQS after the visibility timeout. Files
+// skipped under a ReadErrorPolicy are acknowledged by the reader instead.
+//
+// By default the iterator polls forever. Set StopWhenEmpty to end the
+// iteration when a receive returns no messages, or use IterateWithContext
+// to stop polling when a context is done.
+type SQSBucketIterator struct {
+	// Queue is any implementation of the SQSAPI.
+	Queue sqsiface.SQSAPI
+	// QueueURL identifies the queue receiving the notifications.
+	QueueURL string
+	// WaitTimeSeconds is the long poll duration of each receive.
+	WaitTimeSeconds int64
+	// VisibilityTimeout, if set, overrides the queue visibility timeout
+	// of received messages. It should be longer than the time needed
+	// to read a file.
+	VisibilityTimeout int64
+	// StopWhenEmpty ends iteration when the queue has no messages.
+	StopWhenEmpty bool
+	// KeyParser and KeyErrorPolicy are used as they are in the
+	// BucketStateIterator. Skipped keys are acknowledged immediately.
+	KeyParser      KeyParser
+	KeyErrorPolicy KeyErrorPolicy
+
+	lock     sync.Mutex
+	messages map[string]*sqsMessage
+	files    map[string][]string
+	pending  []LogFile
+	current  LogFile
+	isDone   bool
+	error    error
+}
+
+// Iterate moves to the next LogFile announced on the queue, receiving
+// more messages as needed.
+func (iter *SQSBucketIterator) Iterate() bool {
+	return iter.iterate(nil)
+}
+
+// IterateWithContext is a variant of Iterate that also stops when ctx is
+// done. Receive requests are made with ctx so that a long poll is
+// abandoned once it is cancelled.
+func (iter *SQSBucketIterator) IterateWithContext(ctx context.Context) bool {
+	return iter.iterate(ctx)
+}
+
+func (iter *SQSBucketIterator) iterate(ctx context.Context) bool {
+	iter.lock.Lock()
+	defer iter.lock.Unlock()
+	if iter.messages == nil {
+		iter.messages = make(map[string]*sqsMessage)
+		iter.files = make(map[string][]string)
+	}
+	for len(iter.pending) < 1 {
+		if ctx != nil && ctx.Err() != nil && iter.error == nil {
+			iter.error = ctx.Err()
+		}
+		if iter.isDone || iter.error != nil {
+			iter.current = LogFile{}
+			return false
+		}
+		var input = &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(iter.QueueURL),
+			MaxNumberOfMessages: aws.Int64(maxReceiveMessages),
+			WaitTimeSeconds:     aws.Int64(iter.WaitTimeSeconds),
+		}
+		if iter.VisibilityTimeout > 0 {
+			input.VisibilityTimeout = aws.Int64(iter.VisibilityTimeout)
+		}
+		// The lock is released during the long poll so that files
+		// already handed out may be acknowledged in the meantime.
+		iter.lock.Unlock()
+		result, err := iter.receiveMessage(ctx, input)
+		iter.lock.Lock()
+		if err != nil && ctx != nil && ctx.Err() != nil {
+			iter.error = ctx.Err()
+			return false
+		}
+		if err != nil {
+			iter.error = fmt.Errorf("error receiving s3 notifications. %s", err)
+			return false
+		}
+		if len(result.Messages) < 1 && iter.StopWhenEmpty {
+			iter.isDone = true
+		}
+		for _, message := range result.Messages {
+			if err = iter.addMessage(message); err != nil {
+				iter.error = err
+				return false
+			}
+		}
+	}
+	iter.current = iter.pending[0]
+	iter.pending = iter.pending[1:]
+	return true
+}
+
+func (iter *SQSBucketIterator) receiveMessage(ctx context.Context, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	if ctx != nil {
+		return iter.Queue.ReceiveMessageWithContext(ctx, input)
+	}
+	return iter.Queue.ReceiveMessage(input)
+}
+
+// addMessage records the files announced by a message. Messages that
+// announce no log files are deleted right away.
+func (iter *SQSBucketIterator) addMessage(message *sqs.Message) error {
+	var logfiles, err = iter.parseMessage(message)
+	if err != nil {
+		return err
+	}
+	if len(logfiles) < 1 {
+		return iter.deleteMessage(message.ReceiptHandle)
+	}
+	var id = aws.StringValue(message.MessageId)
+	iter.messages[id] = &sqsMessage{receiptHandle: message.ReceiptHandle, pending: len(logfiles)}
+	for _, logfile := range logfiles {
+		var fileID = logfile.Bucket + "/" + logfile.Key
+		iter.files[fileID] = append(iter.files[fileID], id)
+		iter.pending = append(iter.pending, logfile)
+	}
+	return nil
+}
+
+func (iter *SQSBucketIterator) parseMessage(message *sqs.Message) ([]LogFile, error) {
+	var notification s3Notification
+	if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &notification); err != nil {
+		if iter.KeyErrorPolicy == SkipOnKeyError {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error parsing s3 notification %s. %s", aws.StringValue(message.MessageId), err)
+	}
+	var logfiles = make([]LogFile, 0, len(notification.Records))
+	for _, record := range notification.Records {
+		// Directories show up as objects of zero size and have no
+		// content to read.
+		if !strings.HasPrefix(record.EventName, objectCreatedEvent) || record.S3.Object.Size == 0 {
+			continue
+		}
+		// Keys in event notifications are URL encoded.
+		var key, err = url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		logfile, err := parseLogFile(iter.KeyParser, &s3.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(record.S3.Object.Size),
+		}, record.S3.Bucket.Name)
+		if err != nil {
+			if iter.KeyErrorPolicy == SkipOnKeyError {
+				continue
+			}
+			return nil, err
+		}
+		logfiles = append(logfiles, logfile)
+	}
+	return logfiles, nil
+}
+
+func (iter *SQSBucketIterator) deleteMessage(receiptHandle *string) error {
+	var _, err = iter.Queue.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(iter.QueueURL),
+		ReceiptHandle: receiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting s3 notification. %s", err)
+	}
+	return nil
+}
+
+// Ack marks a LogFile as consumed. The message that announced the file is
+// deleted from the queue once all of its files are acknowledged. An error
+// deleting a message also stops the iteration.
+func (iter *SQSBucketIterator) Ack(lf LogFile) error {
+	iter.lock.Lock()
+	defer iter.lock.Unlock()
+	var fileID = lf.Bucket + "/" + lf.Key
+	var ids = iter.files[fileID]
+	if len(ids) < 1 {
+		return nil
+	}
+	var id = ids[0]
+	if len(ids) > 1 {
+		iter.files[fileID] = ids[1:]
+	} else {
+		delete(iter.files, fileID)
+	}
+	var message = iter.messages[id]
+	message.pending = message.pending - 1
+	if message.pending > 0 {
+		return nil
+	}
+	delete(iter.messages, id)
+	if err := iter.deleteMessage(message.receiptHandle); err != nil {
+		if iter.error == nil {
+			iter.error = err
+		}
+		return err
+	}
+	return nil
+}
+
+// Current gets the current value of the iterator.
+func (iter *SQSBucketIterator) Current() LogFile {
+	iter.lock.Lock()
+	defer iter.lock.Unlock()
+	return iter.current
+}
+
+// Close stops the iteration and returns an error, if any, that caused
+// iterations to stop. Messages that have not been acknowledged are left
+// on the queue to be redelivered.
+func (iter *SQSBucketIterator) Close() error {
+	iter.lock.Lock()
+	defer iter.lock.Unlock()
+	iter.isDone = true
+	iter.pending = nil
+	iter.current = LogFile{}
+	return iter.error
+}
@@ -0,0 +1,389 @@
+package vpcflow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSQS serves batches of messages from memory and records
+// the receipt handles that are deleted.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	lock       sync.Mutex
+	batches    [][]*sqs.Message
+	receiveErr error
+	deleteErr  error
+	deleted    []string
+}
+
+func (q *fakeSQS) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.receiveErr != nil {
+		return nil, q.receiveErr
+	}
+	if len(q.batches) < 1 {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	var batch = q.batches[0]
+	q.batches = q.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+// ReceiveMessageWithContext waits out a short long poll on an empty
+// queue unless the context is done first.
+func (q *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	q.lock.Lock()
+	var empty = len(q.batches) < 1 && q.receiveErr == nil
+	q.lock.Unlock()
+	if empty {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return q.ReceiveMessage(input)
+}
+
+func (q *fakeSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.deleteErr != nil {
+		return nil, q.deleteErr
+	}
+	q.deleted = append(q.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (q *fakeSQS) Deleted() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]string(nil), q.deleted...)
+}
+
+const testNotificationKey = "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_%s.log.gz"
+
+type testNotificationRecord struct {
+	event string
+	key   string
+	size  int64
+}
+
+func testNotification(id string, records ...testNotificationRecord) *sqs.Message {
+	var body = `{"Records":[`
+	for x, r := range records {
+		if x > 0 {
+			body = body + ","
+		}
+		body = body + fmt.Sprintf(
+			`{"eventName":%q,"s3":{"bucket":{"name":"testbucket"},"object":{"key":%q,"size":%d}}}`,
+			r.event, r.key, r.size,
+		)
+	}
+	body = body + `]}`
+	return &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("receipt-" + id),
+		Body:          aws.String(body),
+	}
+}
+
+func TestSQSBucketIterator(t *testing.T) {
+	var queue = &fakeSQS{
+		batches: [][]*sqs.Message{
+			{
+				testNotification("1",
+					testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "a"), 100},
+					testNotificationRecord{"ObjectCreated:CompleteMultipartUpload", fmt.Sprintf(testNotificationKey, "b"), 200},
+				),
+				testNotification("2", testNotificationRecord{"ObjectRemoved:Delete", fmt.Sprintf(testNotificationKey, "c"), 100}),
+				{MessageId: aws.String("3"), ReceiptHandle: aws.String("receipt-3"), Body: aws.String(`{"Event":"s3:TestEvent"}`)},
+			},
+			{},
+			{
+				testNotification("4", testNotificationRecord{"ObjectCreated:Put", "AWSLogs/123456789012/vpcflowlogs/us-west-2/2018/10/17/123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_d%3Dd.log.gz", 100}),
+			},
+		},
+	}
+	var iter = &SQSBucketIterator{Queue: queue, QueueURL: "queue"}
+
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, fmt.Sprintf(testNotificationKey, "a"), iter.Current().Key)
+	assert.Equal(t, "testbucket", iter.Current().Bucket)
+	assert.Equal(t, "a", iter.Current().Hash)
+	assert.Equal(t, int64(100), iter.Current().Size)
+	assert.Equal(t, []string{"receipt-2", "receipt-3"}, queue.Deleted(), "messages without log files should be deleted")
+
+	var first = iter.Current()
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, fmt.Sprintf(testNotificationKey, "b"), iter.Current().Key)
+	assert.Nil(t, iter.Ack(first))
+	assert.Equal(t, []string{"receipt-2", "receipt-3"}, queue.Deleted(), "message deleted before all files were acknowledged")
+	assert.Nil(t, iter.Ack(iter.Current()))
+	assert.Equal(t, []string{"receipt-2", "receipt-3", "receipt-1"}, queue.Deleted())
+
+	// The empty receive is skipped over while polling.
+	assert.True(t, iter.Iterate())
+	assert.Equal(t, fmt.Sprintf(testNotificationKey, "d=d"), iter.Current().Key, "key was not decoded")
+	assert.Equal(t, "d=d", iter.Current().Hash)
+
+	iter.StopWhenEmpty = true
+	assert.False(t, iter.Iterate())
+	assert.Equal(t, LogFile{}, iter.Current())
+	assert.Nil(t, iter.Close())
+
+	// Acknowledging after close still deletes the message and unknown
+	// files are ignored.
+	assert.Nil(t, iter.Ack(LogFile{Bucket: "testbucket", Key: fmt.Sprintf(testNotificationKey, "d=d")}))
+	assert.Nil(t, iter.Ack(LogFile{Bucket: "testbucket", Key: "unknown"}))
+	assert.Equal(t, []string{"receipt-2", "receipt-3", "receipt-1", "receipt-4"}, queue.Deleted())
+}
+
+func TestSQSBucketIteratorDuplicateNotifications(t *testing.T) {
+	var key = fmt.Sprintf(testNotificationKey, "a")
+	var queue = &fakeSQS{
+		batches: [][]*sqs.Message{{
+			testNotification("1", testNotificationRecord{"ObjectCreated:Put", key, 100}),
+			testNotification("2", testNotificationRecord{"ObjectCreated:Put", key, 100}),
+		}},
+	}
+	var iter = &SQSBucketIterator{Queue: queue, QueueURL: "queue", StopWhenEmpty: true}
+	for iter.Iterate() {
+		assert.Nil(t, iter.Ack(iter.Current()))
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []string{"receipt-1", "receipt-2"}, queue.Deleted())
+}
+
+func TestSQSBucketIteratorErrors(t *testing.T) {
+	var badKey = testNotification("1", testNotificationRecord{"ObjectCreated:Put", "not-a-log-file", 100})
+	var badBody = &sqs.Message{MessageId: aws.String("2"), ReceiptHandle: aws.String("receipt-2"), Body: aws.String("{")}
+	tc := []struct {
+		Name   string
+		Queue  *fakeSQS
+		Policy KeyErrorPolicy
+	}{
+		{
+			Name:  "receive",
+			Queue: &fakeSQS{receiveErr: errors.New("")},
+		},
+		{
+			Name:  "bad-key",
+			Queue: &fakeSQS{batches: [][]*sqs.Message{{badKey}}},
+		},
+		{
+			Name:  "bad-body",
+			Queue: &fakeSQS{batches: [][]*sqs.Message{{badBody}}},
+		},
+		{
+			Name:   "delete",
+			Queue:  &fakeSQS{batches: [][]*sqs.Message{{badKey}}, deleteErr: errors.New("")},
+			Policy: SkipOnKeyError,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var iter = &SQSBucketIterator{Queue: tt.Queue, QueueURL: "queue", KeyErrorPolicy: tt.Policy, StopWhenEmpty: true}
+			assert.False(t, iter.Iterate())
+			assert.False(t, iter.Iterate())
+			assert.NotNil(t, iter.Close())
+			assert.Empty(t, tt.Queue.Deleted(), "message with an error should not be deleted")
+		})
+	}
+
+	var queue = &fakeSQS{batches: [][]*sqs.Message{{badKey, badBody}}}
+	var iter = &SQSBucketIterator{Queue: queue, QueueURL: "queue", KeyErrorPolicy: SkipOnKeyError, StopWhenEmpty: true}
+	assert.False(t, iter.Iterate())
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []string{"receipt-1", "receipt-2"}, queue.Deleted(), "skipped messages should be deleted")
+}
+
+func TestSQSBucketIteratorDeletesAfterRead(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var content = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var compressed bytes.Buffer
+	var gz = gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(content))
+	_ = gz.Close()
+
+	var queue = &fakeSQS{
+		batches: [][]*sqs.Message{{
+			testNotification("1", testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "a"), int64(compressed.Len())}),
+			testNotification("2", testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "b"), int64(compressed.Len())}),
+		}},
+	}
+	var s3queue = NewMockS3API(ctrl)
+	s3queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			if aws.StringValue(input.Key) == fmt.Sprintf(testNotificationKey, "b") {
+				return nil, errors.New("")
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(compressed.Bytes())),
+				ContentLength: aws.Int64(int64(compressed.Len())),
+			}, nil
+		},
+	).Times(2)
+
+	var r = &BucketIteratorReader{
+		BucketIterator: &SQSBucketIterator{Queue: queue, QueueURL: "queue", StopWhenEmpty: true},
+		FetchPolicy:    NewPrefetchPolicy(s3queue, 1024*1024, 1),
+	}
+	var b bytes.Buffer
+	var sawErr bool
+	for {
+		var chunk = make([]byte, 1024)
+		var n, err = r.Read(chunk)
+		b.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sawErr = true
+		}
+	}
+	assert.True(t, sawErr, "failed download was not reported")
+	assert.Equal(t, content, b.String())
+	assert.Equal(t, []string{"receipt-1"}, queue.Deleted(), "only the file that was read should be deleted")
+}
+
+func TestSQSBucketIteratorDeletesSkippedFiles(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var content = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var compressed = gzipString(content)
+	var truncated = compressed[:len(compressed)-8]
+
+	var queue = &fakeSQS{
+		batches: [][]*sqs.Message{{
+			testNotification("1", testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "a"), int64(len(compressed))}),
+			testNotification("2", testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "b"), int64(len(compressed))}),
+			testNotification("3", testNotificationRecord{"ObjectCreated:Put", fmt.Sprintf(testNotificationKey, "c"), int64(len(truncated))}),
+		}},
+	}
+	var s3queue = NewMockS3API(ctrl)
+	s3queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			var body = compressed
+			switch aws.StringValue(input.Key) {
+			case fmt.Sprintf(testNotificationKey, "b"):
+				return nil, errors.New("")
+			case fmt.Sprintf(testNotificationKey, "c"):
+				body = truncated
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: aws.Int64(int64(len(body))),
+			}, nil
+		},
+	).Times(3)
+
+	var collector ErrorCollector
+	var iter = &BucketRecordIterator{
+		BucketIterator:  &SQSBucketIterator{Queue: queue, QueueURL: "queue", StopWhenEmpty: true},
+		FetchPolicy:     NewPrefetchPolicy(s3queue, 1024*1024, 1),
+		ReadErrorPolicy: SkipFileOnReadError,
+		OnReadError:     collector.Collect,
+	}
+	for iter.Iterate() {
+	}
+	assert.Nil(t, iter.Close())
+	assert.Len(t, collector.Files(), 2)
+	assert.ElementsMatch(t, []string{"receipt-1", "receipt-2", "receipt-3"}, queue.Deleted(), "skipped files should be deleted")
+}
+
+func TestSQSBucketIteratorCloseEmptyQueue(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	var iter = &SQSBucketIterator{Queue: &fakeSQS{}, QueueURL: "queue"}
+	var r = &BucketIteratorReader{
+		Context:        ctx,
+		BucketIterator: iter,
+		FetchPolicy:    NewPrefetchPolicy(NewMockS3API(ctrl), 1024, 2),
+	}
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+	var _, e = r.Read(make([]byte, 10))
+	assert.Equal(t, context.Canceled, e)
+
+	var done = make(chan interface{})
+	go func() {
+		_ = r.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not stop polling the queue")
+	}
+
+	// Closing the policy stops polling without a cancelled context.
+	var fm = NewPrefetchPolicy(NewMockS3API(ctrl), 1024, 2)(&SQSBucketIterator{Queue: &fakeSQS{}, QueueURL: "queue"})
+	done = make(chan interface{})
+	go func() {
+		assert.Nil(t, fm.(io.Closer).Close())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "close did not stop polling the queue")
+	}
+}
+
+func TestSQSBucketIteratorDeleteError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var content = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var compressed = gzipString(content)
+	var key = fmt.Sprintf(testNotificationKey, "a")
+	var deleteErr = errors.New("delete failed")
+	var queue = &fakeSQS{
+		batches: [][]*sqs.Message{{
+			testNotification("1", testNotificationRecord{"ObjectCreated:Put", key, int64(len(compressed))}),
+		}},
+		deleteErr: deleteErr,
+	}
+	var s3queue = NewMockS3API(ctrl)
+	var ranges []string
+	serveObjects(s3queue, map[string][]byte{key: compressed}, &ranges)
+
+	var fm = NewPrefetchPolicy(s3queue, 1024*1024, 1)(&SQSBucketIterator{Queue: queue, QueueURL: "queue", StopWhenEmpty: true})
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	var text, _ = ioutil.ReadAll(r)
+	assert.Equal(t, content, string(text))
+	fm.Put(r)
+	// The failed delete is returned by the next Get.
+	_, err = fm.Get()
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, key, err.(*AckError).LogFile.Key)
+	}
+	assert.Nil(t, fm.(io.Closer).Close())
+}
@@ -0,0 +1,213 @@
+package vpcflow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the
+// histograms that Stats keeps of download latency and wait time.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Stats is an Observer that keeps totals of the measurements it receives
+// in memory. It may be shared by any number of stages. The totals are
+// read with Snapshot or exported in the Prometheus text format with
+// WritePrometheus. Stats is also an http.Handler that serves the
+// Prometheus format so that it can be scraped directly.
+type Stats struct {
+	// Buckets are the upper bounds, in seconds, of the latency
+	// histograms. If not set then DefaultLatencyBuckets are used.
+	Buckets []float64
+
+	once            sync.Once
+	lock            sync.Mutex
+	buckets         []float64
+	filesListed     int64
+	downloads       int64
+	downloadErrors  int64
+	downloadedBytes int64
+	downloadLatency *histogram
+	bufferedFiles   int64
+	bufferedBytes   int64
+	waits           *histogram
+	readErrors      int64
+}
+
+// StatsSnapshot is a copy of the totals of a Stats.
+type StatsSnapshot struct {
+	// FilesListed is the number of files produced by iterators.
+	FilesListed int64
+	// Downloads is the number of downloads that succeeded.
+	Downloads int64
+	// DownloadErrors is the number of downloads that failed.
+	DownloadErrors int64
+	// DownloadedBytes is the number of bytes downloaded.
+	DownloadedBytes int64
+	// DownloadTime is the sum of the latency of all downloads.
+	DownloadTime time.Duration
+	// BufferedFiles is the number of files currently held by prefetching.
+	BufferedFiles int64
+	// BufferedBytes is the memory currently charged for prefetched files.
+	BufferedBytes int64
+	// Waits is the number of times a reader waited for a file.
+	Waits int64
+	// WaitTime is the sum of the time readers waited for files.
+	WaitTime time.Duration
+	// ReadErrors is the number of files or lines that could not be read.
+	ReadErrors int64
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	var seconds = d.Seconds()
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i] = h.counts[i] + 1
+		}
+	}
+	h.count = h.count + 1
+	h.sum = h.sum + d
+}
+
+func (s *Stats) init() {
+	var buckets = s.Buckets
+	if len(buckets) < 1 {
+		buckets = DefaultLatencyBuckets
+	}
+	// The bounds are copied so that later changes to the configured or
+	// default buckets do not change the histograms.
+	s.buckets = append([]float64(nil), buckets...)
+	s.downloadLatency = &histogram{bounds: s.buckets, counts: make([]int64, len(s.buckets))}
+	s.waits = &histogram{bounds: s.buckets, counts: make([]int64, len(s.buckets))}
+}
+
+// ObserveListed counts a listed file.
+func (s *Stats) ObserveListed(lf LogFile) {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.filesListed = s.filesListed + 1
+}
+
+// ObserveFetch counts a download and its bytes and latency, or counts
+// a failed download.
+func (s *Stats) ObserveFetch(lf LogFile, bytes int64, latency time.Duration, err error) {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.downloadErrors = s.downloadErrors + 1
+		return
+	}
+	s.downloads = s.downloads + 1
+	s.downloadedBytes = s.downloadedBytes + bytes
+	s.downloadLatency.observe(latency)
+}
+
+// ObserveBuffer adjusts the files and bytes held by prefetching.
+func (s *Stats) ObserveBuffer(files int, bytes int64) {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bufferedFiles = s.bufferedFiles + int64(files)
+	s.bufferedBytes = s.bufferedBytes + bytes
+}
+
+// ObserveWait records the time a reader waited for a file.
+func (s *Stats) ObserveWait(wait time.Duration) {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.waits.observe(wait)
+}
+
+// ObserveReadError counts a file or line that could not be read.
+func (s *Stats) ObserveReadError(err *LogFileError) {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readErrors = s.readErrors + 1
+}
+
+// Snapshot returns a copy of the current totals.
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return StatsSnapshot{
+		FilesListed:     s.filesListed,
+		Downloads:       s.downloads,
+		DownloadErrors:  s.downloadErrors,
+		DownloadedBytes: s.downloadedBytes,
+		DownloadTime:    s.downloadLatency.sum,
+		BufferedFiles:   s.bufferedFiles,
+		BufferedBytes:   s.bufferedBytes,
+		Waits:           s.waits.count,
+		WaitTime:        s.waits.sum,
+		ReadErrors:      s.readErrors,
+	}
+}
+
+// WritePrometheus writes the current totals in the Prometheus text
+// exposition format. All metric names begin with vpcflow_.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	s.once.Do(s.init)
+	s.lock.Lock()
+	var downloadLatency = *s.downloadLatency
+	downloadLatency.counts = append([]int64(nil), s.downloadLatency.counts...)
+	var waits = *s.waits
+	waits.counts = append([]int64(nil), s.waits.counts...)
+	var snapshot = StatsSnapshot{
+		FilesListed:     s.filesListed,
+		Downloads:       s.downloads,
+		DownloadErrors:  s.downloadErrors,
+		DownloadedBytes: s.downloadedBytes,
+		BufferedFiles:   s.bufferedFiles,
+		BufferedBytes:   s.bufferedBytes,
+		ReadErrors:      s.readErrors,
+	}
+	s.lock.Unlock()
+
+	var b = bufio.NewWriter(w)
+	writeMetric(b, "vpcflow_files_listed_total", "counter", "Log files produced by bucket iterators.", snapshot.FilesListed)
+	writeMetric(b, "vpcflow_downloads_total", "counter", "Log file downloads that succeeded.", snapshot.Downloads)
+	writeMetric(b, "vpcflow_download_errors_total", "counter", "Log file downloads that failed.", snapshot.DownloadErrors)
+	writeMetric(b, "vpcflow_downloaded_bytes_total", "counter", "Bytes of log files downloaded.", snapshot.DownloadedBytes)
+	writeHistogram(b, "vpcflow_download_duration_seconds", "Latency of log file downloads.", &downloadLatency)
+	writeMetric(b, "vpcflow_prefetch_buffered_files", "gauge", "Log files held by prefetching.", snapshot.BufferedFiles)
+	writeMetric(b, "vpcflow_prefetch_buffered_bytes", "gauge", "Memory charged for prefetched log files.", snapshot.BufferedBytes)
+	writeHistogram(b, "vpcflow_get_wait_seconds", "Time readers waited for a log file.", &waits)
+	writeMetric(b, "vpcflow_read_errors_total", "counter", "Log files or lines that could not be read.", snapshot.ReadErrors)
+	return b.Flush()
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func writeHistogram(w io.Writer, name string, help string, h *histogram) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum.Seconds(), 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// ServeHTTP writes the current totals in the Prometheus text format.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = s.WritePrometheus(w)
+}
@@ -0,0 +1,199 @@
+package vpcflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	var stats = &Stats{Buckets: []float64{.1, 1}}
+	stats.ObserveListed(LogFile{})
+	stats.ObserveListed(LogFile{})
+	stats.ObserveFetch(LogFile{}, 100, 50*time.Millisecond, nil)
+	stats.ObserveFetch(LogFile{}, 200, 500*time.Millisecond, nil)
+	stats.ObserveFetch(LogFile{}, 0, time.Second, errors.New(""))
+	stats.ObserveBuffer(2, 300)
+	stats.ObserveBuffer(-1, -100)
+	stats.ObserveWait(2 * time.Second)
+	stats.ObserveReadError(&LogFileError{})
+
+	assert.Equal(t, StatsSnapshot{
+		FilesListed:     2,
+		Downloads:       2,
+		DownloadErrors:  1,
+		DownloadedBytes: 300,
+		DownloadTime:    550 * time.Millisecond,
+		BufferedFiles:   1,
+		BufferedBytes:   200,
+		Waits:           1,
+		WaitTime:        2 * time.Second,
+		ReadErrors:      1,
+	}, stats.Snapshot())
+
+	var w = httptest.NewRecorder()
+	stats.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+	var text = w.Body.String()
+	for _, expected := range []string{
+		"# TYPE vpcflow_files_listed_total counter\nvpcflow_files_listed_total 2\n",
+		"vpcflow_downloaded_bytes_total 300\n",
+		"# TYPE vpcflow_download_duration_seconds histogram\n",
+		"vpcflow_download_duration_seconds_bucket{le=\"0.1\"} 1\n",
+		"vpcflow_download_duration_seconds_bucket{le=\"1\"} 2\n",
+		"vpcflow_download_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"vpcflow_download_duration_seconds_sum 0.55\n",
+		"vpcflow_download_duration_seconds_count 2\n",
+		"# TYPE vpcflow_prefetch_buffered_bytes gauge\nvpcflow_prefetch_buffered_bytes 200\n",
+		"vpcflow_get_wait_seconds_bucket{le=\"1\"} 0\n",
+		"vpcflow_get_wait_seconds_count 1\n",
+		"vpcflow_read_errors_total 1\n",
+	} {
+		assert.Contains(t, text, expected)
+	}
+}
+
+func TestStatsDefaultBuckets(t *testing.T) {
+	var stats = &Stats{}
+	stats.ObserveWait(time.Millisecond)
+	assert.Nil(t, stats.Buckets, "configured buckets were changed")
+	// The default buckets are not shared with the histograms.
+	var defaults = DefaultLatencyBuckets[0]
+	DefaultLatencyBuckets[0] = 1000
+	defer func() { DefaultLatencyBuckets[0] = defaults }()
+	var w = httptest.NewRecorder()
+	stats.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "vpcflow_get_wait_seconds_bucket{le=\"0.005\"} 1\n")
+}
+
+func TestStatsObservesPipeline(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var line = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var good = "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3d.log.gz"
+	var missing = "123456789012_vpcflowlogs_us-west-2_fl-00123456789abcdef_20181017T0030Z_0a1b2c3e.log.gz"
+	var content = gzipString(line + "not a record\n")
+	var queue = NewMockS3API(ctrl)
+	queue.EXPECT().ListObjectsV2WithContext(gomock.Any(), gomock.Any()).Return(&s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String(good), Size: aws.Int64(int64(len(content)))},
+			{Key: aws.String(missing), Size: aws.Int64(10)},
+		},
+	}, nil)
+	queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			if aws.StringValue(input.Key) != good {
+				return nil, errors.New(s3.ErrCodeNoSuchKey)
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	).AnyTimes()
+
+	var stats = &Stats{}
+	var ctx = WithObserver(context.Background(), stats)
+	var r = &BucketIteratorReader{
+		Context:         ctx,
+		BucketIterator:  &BucketStateIterator{Context: ctx, Bucket: "bucket", Queue: queue},
+		FetchPolicy:     NewPrefetchPolicyWithContext(ctx, queue, 1<<20, 1),
+		ReadErrorPolicy: SkipFileOnReadError,
+	}
+	var d = &ReaderDigester{Reader: r, ReadErrorPolicy: SkipLineOnReadError}
+	var digest, err = d.DigestWithContext(ctx)
+	assert.Nil(t, err)
+	var text, _ = ioutil.ReadAll(digest)
+	assert.True(t, strings.Contains(string(text), "eni-abc123de"))
+
+	var snapshot = stats.Snapshot()
+	assert.Equal(t, int64(2), snapshot.FilesListed)
+	assert.Equal(t, int64(1), snapshot.Downloads)
+	assert.Equal(t, int64(1), snapshot.DownloadErrors)
+	assert.Equal(t, int64(len(content)), snapshot.DownloadedBytes)
+	// Every file has been Put and so none are held.
+	assert.Equal(t, int64(0), snapshot.BufferedFiles)
+	assert.Equal(t, int64(0), snapshot.BufferedBytes)
+	assert.True(t, snapshot.Waits >= 3, "%d waits", snapshot.Waits)
+	// The missing file and the bad line.
+	assert.Equal(t, int64(2), snapshot.ReadErrors)
+}
+
+func TestStatsObservesFileManagers(t *testing.T) {
+	var line = "2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n"
+	var content = gzipString(line)
+	tc := []struct {
+		Name   string
+		Policy func(context.Context, *MockS3API) func(BucketIterator) FileManager
+	}{
+		{"disk", func(ctx context.Context, queue *MockS3API) func(BucketIterator) FileManager {
+			return func(iter BucketIterator) FileManager {
+				var fm = &DiskFileManager{
+					Context:        ctx,
+					Queue:          queue,
+					BucketIterator: iter,
+					Lock:           &Semaphore{C: make(chan interface{}, 1)},
+					MaxBytes:       1 << 20,
+					Ready:          make(chan io.Reader, 2),
+				}
+				fm.start()
+				return fm
+			}
+		}},
+		{"streaming", func(_ context.Context, queue *MockS3API) func(BucketIterator) FileManager {
+			return NewStreamingPolicy(queue, 0)
+		}},
+		{"ranged streaming", func(_ context.Context, queue *MockS3API) func(BucketIterator) FileManager {
+			return NewStreamingPolicy(queue, 10)
+		}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var ctrl = gomock.NewController(t)
+			defer ctrl.Finish()
+			var queue = NewMockS3API(ctrl)
+			var ranges []string
+			serveObjects(queue, map[string][]byte{"good.log.gz": content}, &ranges).AnyTimes()
+			var iter = NewMockBucketIterator(ctrl)
+			gomock.InOrder(
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "good.log.gz", Size: int64(len(content))}).AnyTimes(),
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "missing.log.gz", Size: 10}).AnyTimes(),
+				iter.EXPECT().Iterate().Return(false),
+				iter.EXPECT().Close().Return(nil).AnyTimes(),
+			)
+
+			var stats = &Stats{}
+			var ctx = WithObserver(context.Background(), stats)
+			var r = &BucketIteratorReader{
+				Context:         ctx,
+				BucketIterator:  iter,
+				FetchPolicy:     tt.Policy(ctx, queue),
+				ReadErrorPolicy: SkipFileOnReadError,
+			}
+			var text, err = ioutil.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, line, string(text))
+			assert.Nil(t, r.Close())
+
+			var snapshot = stats.Snapshot()
+			assert.Equal(t, int64(1), snapshot.Downloads)
+			assert.Equal(t, int64(1), snapshot.DownloadErrors)
+			assert.Equal(t, int64(len(content)), snapshot.DownloadedBytes)
+			assert.Equal(t, int64(0), snapshot.BufferedFiles)
+			assert.Equal(t, int64(0), snapshot.BufferedBytes)
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package vpcflow
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// defaultParquetRangeSize is the size of the ranged reads used for
+// Parquet files when no range size is given. Parquet content must be
+// read out of order so it is always fetched with ranged reads.
+const defaultParquetRangeSize = 1024 * 1024
+
+// s3RangeReader implements io.ReadSeeker over an S3 object by issuing
+// a GetObject request for each range of the object as it is read.
+// Only the body of the current range is held open so memory use does
+// not depend on the size of the object.
+type s3RangeReader struct {
+	ctx       context.Context
+	queue     s3iface.S3API
+	bucket    string
+	key       string
+	size      int64
+	rangeSize int64
+	offset    int64
+	fetched   int64
+	body      io.ReadCloser
+}
+
+func (r *s3RangeReader) Read(b []byte) (int, error) {
+	for {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		if r.body == nil {
+			var end = r.offset + r.rangeSize
+			if end > r.size {
+				end = r.size
+			}
+			var result, e = r.queue.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+				Bucket: aws.String(r.bucket),
+				Key:    aws.String(r.key),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, end-1)),
+			})
+			if e != nil {
+				return 0, e
+			}
+			r.body = result.Body
+		}
+		var n, e = r.body.Read(b)
+		r.offset = r.offset + int64(n)
+		r.fetched = r.fetched + int64(n)
+		if e == io.EOF {
+			_ = r.body.Close()
+			r.body = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, e
+	}
+}
+
+func (r *s3RangeReader) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = r.offset + offset
+	case io.SeekEnd:
+		next = r.size + offset
+	default:
+		return r.offset, errors.New("invalid seek whence")
+	}
+	if next < 0 {
+		return r.offset, errors.New("seek before the start of the object")
+	}
+	if next != r.offset {
+		_ = r.Close()
+		r.offset = next
+	}
+	return r.offset, nil
+}
+
+func (r *s3RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	var e = r.body.Close()
+	r.body = nil
+	return e
+}
+
+// countingBody counts the bytes read from a response body.
+type countingBody struct {
+	io.ReadCloser
+	fetched int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	var n, e = b.ReadCloser.Read(p)
+	b.fetched = b.fetched + int64(n)
+	return n, e
+}
+
+// streamingFile is the decompressed content of an object along
+// with the response body from which it is read.
+type streamingFile struct {
+	io.Reader
+	body     io.Closer
+	logFile  LogFile
+	fetched  func() int64
+	opened   time.Time
+	size     int64
+	observer Observer
+	released bool
+}
+
+// StreamingFileManager implements the FileManager interface by
+// streaming the content of each object through decompression as it
+// is read rather than downloading it first. Only one object is open
+// at a time so memory use stays bounded regardless of object size,
+// at the cost of the read waiting on the network.
+//
+// By default each object is fetched with a single GetObject request.
+// If RangeSize is set then objects are instead fetched with a series
+// of ranged requests of that many bytes. Parquet files are always
+// fetched with ranged requests because they are not read in order.
+//
+// The download of a file is reported to the Observer once the file is
+// released with the bytes fetched and the time it was open. The open file
+// is reported as held, charged for the working memory of its decoder.
+type StreamingFileManager struct {
+	// Context, if set, is used for all requests made when Get is called.
+	Context        context.Context
+	Queue          s3iface.S3API
+	BucketIterator BucketIterator
+	RangeSize      int64
+	// Observer, if set, receives the outcome of each download and the
+	// file being read. If not set then the Observer of the context of
+	// Get, if any, is used.
+	Observer Observer
+
+	done    bool
+	current *streamingFile
+	acks    ackErrors
+}
+
+// Get opens the next object of the iterator. A nil reader is returned
+// once the iterator is exhausted.
+func (f *StreamingFileManager) Get() (io.Reader, error) {
+	var ctx = f.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return f.GetWithContext(ctx)
+}
+
+// GetWithContext is a variant of Get that makes all requests for the
+// object with the given context.
+func (f *StreamingFileManager) GetWithContext(ctx context.Context) (io.Reader, error) {
+	if e := f.acks.take(); e != nil {
+		return nil, e
+	}
+	if f.done {
+		return nil, nil
+	}
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	// Files of zero size don't have content to download so we drop
+	// them here if they made it.
+	var more = iterateWithContext(ctx, f.BucketIterator)
+	for more && f.BucketIterator.Current().Size == 0 {
+		more = iterateWithContext(ctx, f.BucketIterator)
+	}
+	if !more {
+		f.done = true
+		if e := f.BucketIterator.Close(); e != nil {
+			return nil, e
+		}
+		return nil, nil
+	}
+	var lf = f.BucketIterator.Current()
+	var observer = observerOf(f.Observer, ctx)
+	var start = time.Now()
+	var file, e = f.open(ctx, lf)
+	if e != nil {
+		observer.ObserveFetch(lf, 0, time.Since(start), e)
+		return nil, &LogFileError{LogFile: lf, Err: e}
+	}
+	file.opened = start
+	file.observer = observer
+	observer.ObserveBuffer(1, file.size)
+	f.current = file
+	return file, nil
+}
+
+func (f *StreamingFileManager) open(ctx context.Context, lf LogFile) (*streamingFile, error) {
+	var body io.ReadCloser
+	var fetched func() int64
+	var rangeSize = f.RangeSize
+	if rangeSize < 1 && isParquet(lf.Key) {
+		rangeSize = defaultParquetRangeSize
+	}
+	if rangeSize > 0 {
+		var ranged = &s3RangeReader{
+			ctx:       ctx,
+			queue:     f.Queue,
+			bucket:    lf.Bucket,
+			key:       lf.Key,
+			size:      lf.Size,
+			rangeSize: rangeSize,
+		}
+		body = ranged
+		fetched = func() int64 { return ranged.fetched }
+	} else {
+		var result, e = f.Queue.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(lf.Bucket),
+			Key:    aws.String(lf.Key),
+		})
+		if e != nil {
+			return nil, e
+		}
+		var counted = &countingBody{ReadCloser: result.Body}
+		body = counted
+		fetched = func() int64 { return counted.fetched }
+	}
+
+	var result io.Reader
+	var e error
+	if isParquet(lf.Key) {
+		result, e = NewParquetReader(body.(io.ReadSeeker))
+	} else {
+		result, e = gzip.NewReader(body)
+	}
+	if e != nil {
+		_ = body.Close()
+		return nil, e
+	}
+	// Nothing is downloaded ahead of the read so only the working memory
+	// of the decoder is held.
+	var size = readerSize(result, 0)
+	return &streamingFile{Reader: result, body: body, logFile: lf, fetched: fetched, size: size}, nil
+}
+
+// release closes a file and reports its download.
+func (f *StreamingFileManager) release(file *streamingFile) {
+	_ = file.body.Close()
+	if f.current == file {
+		f.current = nil
+	}
+	if file.released {
+		return
+	}
+	file.released = true
+	file.observer.ObserveFetch(file.logFile, file.fetched(), time.Since(file.opened), nil)
+	file.observer.ObserveBuffer(-1, -file.size)
+}
+
+// Source returns the LogFile from which a reader was opened.
+func (f *StreamingFileManager) Source(r io.Reader) (LogFile, bool) {
+	var file, ok = r.(*streamingFile)
+	if !ok {
+		return LogFile{}, false
+	}
+	return file.logFile, true
+}
+
+// Put closes an object that has been consumed. If the BucketIterator
+// is an Acknowledger then the file is acknowledged as consumed and an
+// error doing so is returned by the next Get.
+func (f *StreamingFileManager) Put(r io.Reader) {
+	var file, ok = r.(*streamingFile)
+	if !ok {
+		return
+	}
+	f.release(file)
+	f.acks.ack(f.BucketIterator, file.logFile)
+}
+
+// Close releases the object that is currently open, if any.
+func (f *StreamingFileManager) Close() error {
+	f.done = true
+	if f.current != nil {
+		f.release(f.current)
+	}
+	return nil
+}
+
+// NewStreamingPolicy implements the signature required for the
+// BucketIteratorReader.FetchPolicy by producing a FileManager that
+// streams objects as they are read. A rangeSize greater than zero
+// fetches objects with ranged requests of that many bytes.
+func NewStreamingPolicy(q s3iface.S3API, rangeSize int64) func(BucketIterator) FileManager {
+	return func(iter BucketIterator) FileManager {
+		return &StreamingFileManager{
+			Queue:          q,
+			BucketIterator: iter,
+			RangeSize:      rangeSize,
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package vpcflow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveObjects answers GetObject requests, including ranged requests,
+// from the given content and records the ranges requested.
+func serveObjects(queue *MockS3API, objects map[string][]byte, ranges *[]string) *gomock.Call {
+	return queue.EXPECT().GetObjectWithContext(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ aws.Context, input *s3.GetObjectInput, _ ...interface{}) (*s3.GetObjectOutput, error) {
+			var content, ok = objects[aws.StringValue(input.Key)]
+			if !ok {
+				return nil, errors.New(s3.ErrCodeNoSuchKey)
+			}
+			if input.Range != nil {
+				*ranges = append(*ranges, aws.StringValue(input.Range))
+				var start, end int
+				_, _ = fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end)
+				if end >= len(content) {
+					end = len(content) - 1
+				}
+				content = content[start : end+1]
+			}
+			return &s3.GetObjectOutput{
+				Body:          ioutil.NopCloser(bytes.NewReader(content)),
+				ContentLength: aws.Int64(int64(len(content))),
+			}, nil
+		},
+	)
+}
+
+func gzipString(s string) []byte {
+	var b bytes.Buffer
+	var gz = gzip.NewWriter(&b)
+	_, _ = gz.Write([]byte(s))
+	_ = gz.Close()
+	return b.Bytes()
+}
+
+func TestStreamingFileManager(t *testing.T) {
+	var content = strings.Repeat("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n", 100)
+	var compressed = gzipString(content)
+	var parquet = newTestParquetFile(t, testParquetRows...)
+	var objects = map[string][]byte{
+		"a.log.gz":      compressed,
+		"b.log.gz":      compressed,
+		"c.log.parquet": parquet,
+	}
+	tc := []struct {
+		Name           string
+		RangeSize      int64
+		ExpectedRanges int
+	}{
+		{Name: "whole", ExpectedRanges: 1},
+		{Name: "ranged", RangeSize: 100, ExpectedRanges: 1 + 2*((len(compressed)+99)/100)},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var ctrl = gomock.NewController(t)
+			defer ctrl.Finish()
+			var queue = NewMockS3API(ctrl)
+			var ranges []string
+			serveObjects(queue, objects, &ranges).AnyTimes()
+			var iter = NewMockBucketIterator(ctrl)
+			gomock.InOrder(
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a.log.gz", Size: int64(len(compressed))}).Times(2),
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "empty"}),
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "c.log.parquet", Size: int64(len(parquet))}).Times(2),
+				iter.EXPECT().Iterate().Return(true),
+				iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "b.log.gz", Size: int64(len(compressed))}).Times(2),
+				iter.EXPECT().Iterate().Return(false),
+				iter.EXPECT().Close().Return(nil),
+				iter.EXPECT().Close().Return(nil),
+			)
+
+			var r = &BucketIteratorReader{
+				BucketIterator: iter,
+				FetchPolicy:    NewStreamingPolicy(queue, tt.RangeSize),
+			}
+			var text, err = ioutil.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, content+testParquetText+content, string(text))
+			assert.Nil(t, r.Close())
+			if tt.RangeSize > 0 {
+				assert.Equal(t, fmt.Sprintf("bytes=0-%d", tt.RangeSize-1), ranges[0])
+			}
+			// Parquet content is always fetched with ranged reads.
+			assert.True(t, len(ranges) >= tt.ExpectedRanges, "%d ranges requested", len(ranges))
+		})
+	}
+}
+
+func TestStreamingFileManagerErrors(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var ranges []string
+	serveObjects(queue, map[string][]byte{"bad.log.gz": []byte("not gzip")}, &ranges).AnyTimes()
+	var iter = NewMockBucketIterator(ctrl)
+	var listErr = errors.New("")
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "missing.log.gz", Size: 10}).Times(2),
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "bad.log.gz", Size: 8}).Times(2),
+		iter.EXPECT().Iterate().Return(false),
+		iter.EXPECT().Close().Return(listErr),
+	)
+
+	var fm = NewStreamingPolicy(queue, 0)(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.NotNil(t, err, "missing object was not reported")
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.NotNil(t, err, "corrupt object was not reported")
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Equal(t, listErr, err)
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	r, err = (&StreamingFileManager{BucketIterator: iter}).GetWithContext(ctx)
+	assert.Nil(t, r)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestStreamingFileManagerParquetSize(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var parquet = newTestParquetFile(t, testParquetRows...)
+	var queue = NewMockS3API(ctrl)
+	var ranges []string
+	serveObjects(queue, map[string][]byte{"c.log.parquet": parquet}, &ranges).AnyTimes()
+	var iter = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		iter.EXPECT().Iterate().Return(true),
+		iter.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "c.log.parquet", Size: int64(len(parquet))}).Times(2),
+	)
+
+	var stats = &Stats{}
+	var fm = &StreamingFileManager{Queue: queue, BucketIterator: iter, Observer: stats}
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	// The decoded row groups are charged to the open file.
+	var size = r.(*streamingFile).Reader.(*parquetReader).rowGroupSize
+	assert.True(t, size > 0)
+	assert.Equal(t, size, stats.Snapshot().BufferedBytes)
+	fm.Put(r)
+	assert.Equal(t, int64(0), stats.Snapshot().BufferedBytes)
+}
+
+func TestStreamingFileManagerAckError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var content = gzipString("2 123456789010 eni-abc123de 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK\n")
+	var queue = NewMockS3API(ctrl)
+	var ranges []string
+	serveObjects(queue, map[string][]byte{"a.log.gz": content}, &ranges)
+	var mock = NewMockBucketIterator(ctrl)
+	gomock.InOrder(
+		mock.EXPECT().Iterate().Return(true),
+		mock.EXPECT().Current().Return(LogFile{Bucket: "bucket", Key: "a.log.gz", Size: int64(len(content))}).Times(2),
+		mock.EXPECT().Iterate().Return(false),
+		mock.EXPECT().Close().Return(nil),
+	)
+	var ackErr = errors.New("ack failed")
+	var iter = &ackingBucketIterator{BucketIterator: mock, err: ackErr}
+
+	var fm = NewStreamingPolicy(queue, 0)(iter)
+	var r, err = fm.Get()
+	assert.Nil(t, err)
+	fm.Put(r)
+	assert.Equal(t, []string{"a.log.gz"}, iter.acked)
+	// The failed acknowledgement is returned by the next Get.
+	_, err = fm.Get()
+	if assert.IsType(t, &AckError{}, err) {
+		assert.Equal(t, ackErr, err.(*AckError).Err)
+	}
+	r, err = fm.Get()
+	assert.Nil(t, r)
+	assert.Nil(t, err)
+}
+
+func TestS3RangeReaderSeek(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var queue = NewMockS3API(ctrl)
+	var ranges []string
+	serveObjects(queue, map[string][]byte{"key": []byte("0123456789")}, &ranges).AnyTimes()
+	var r = &s3RangeReader{ctx: context.Background(), queue: queue, bucket: "bucket", key: "key", size: 10, rangeSize: 4}
+
+	var b = make([]byte, 3)
+	var n, err = io.ReadFull(r, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "012", string(b[:n]))
+	offset, err := r.Seek(-2, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), offset)
+	rest, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "89", string(rest))
+	assert.Equal(t, []string{"bytes=0-3", "bytes=8-9"}, ranges)
+
+	offset, err = r.Seek(2, io.SeekStart)
+	assert.Nil(t, err)
+	offset, err = r.Seek(1, io.SeekCurrent)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), offset)
+	rest, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "3456789", string(rest))
+
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err)
+	_, err = r.Seek(0, 10)
+	assert.NotNil(t, err)
+	assert.Nil(t, r.Close())
+}
@@ -0,0 +1,95 @@
+package vpcflow
+
+import "time"
+
+const (
+	// DefaultTimeFilterBefore is the padding applied before the start of a
+	// FlowTimeFilter when selecting files. It matches the padding of a
+	// PrefixPlan.
+	DefaultTimeFilterBefore = DefaultPlanBefore
+	// DefaultTimeFilterAfter is the padding applied after the end of a
+	// FlowTimeFilter when selecting files. It matches the padding of a
+	// PrefixPlan.
+	DefaultTimeFilterAfter = DefaultPlanAfter
+)
+
+// TimeMatch determines which flow records belong to the time range of a
+// FlowTimeFilter.
+type TimeMatch int
+
+const (
+	// OverlapsTimeRange keeps records with any part of their start/end
+	// window within the range. This is the default.
+	OverlapsTimeRange TimeMatch = iota
+	// StartsInTimeRange keeps records whose start time is within the
+	// range. Consecutive ranges that do not overlap each other select each
+	// record exactly once.
+	StartsInTimeRange
+	// WithinTimeRange keeps records whose start and end times are both
+	// within the range.
+	WithinTimeRange
+)
+
+// FlowTimeFilter selects the flows of an inclusive time range in two
+// stages. As a LogFileFilter it compares the timestamp of the file name
+// against a range padded by Before and After so that every file that may
+// hold flows of the range is kept. As a RecordFilter it then trims the
+// records of those files on their start and end times so that exactly the
+// flows of the range remain. The same value is given to both stages:
+//
+//	filter := vpcflow.FlowTimeFilter{Start: start, End: end}
+//	files := &vpcflow.BucketFilter{BucketIterator: bucketIter, Filter: filter}
+//	d := &vpcflow.ReaderDigester{Reader: reader, Filter: filter}
+//
+// Records that have neither a start nor an end time, such as those of a
+// custom format without either field, cannot be trimmed and are kept.
+type FlowTimeFilter struct {
+	Start time.Time
+	End   time.Time
+	// Before widens the file-level range ahead of Start. If not set then
+	// DefaultTimeFilterBefore is used. A negative value disables the
+	// padding.
+	Before time.Duration
+	// After widens the file-level range beyond End. If not set then
+	// DefaultTimeFilterAfter is used. A negative value disables the
+	// padding.
+	After time.Duration
+	// Match determines which records belong to the range.
+	Match TimeMatch
+}
+
+// FileRange returns the padded range used to select files. A PrefixPlan
+// pads its own range in the same way so it is given Start and End rather
+// than this range.
+func (f FlowTimeFilter) FileRange() (time.Time, time.Time) {
+	return f.Start.Add(-padding(f.Before, DefaultTimeFilterBefore)),
+		f.End.Add(padding(f.After, DefaultTimeFilterAfter))
+}
+
+// FilterLogFile applies the padded time bound to the file name timestamp.
+func (f FlowTimeFilter) FilterLogFile(lf LogFile) bool {
+	var start, end = f.FileRange()
+	return LogFileTimeFilter{Start: start, End: end}.FilterLogFile(lf)
+}
+
+// FilterRecord applies the exact time bound to the record start and end.
+func (f FlowTimeFilter) FilterRecord(r FlowRecord) bool {
+	var start, end = r.Start, r.End
+	if start.IsZero() {
+		start = end
+	}
+	if end.IsZero() {
+		end = start
+	}
+	if start.IsZero() {
+		return true
+	}
+	switch f.Match {
+	case StartsInTimeRange:
+		return !start.Before(f.Start) && !start.After(f.End)
+	case WithinTimeRange:
+		return !start.Before(f.Start) && !end.After(f.End)
+	default:
+		return !end.Before(f.Start) && !start.After(f.End)
+	}
+}
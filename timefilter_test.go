@@ -0,0 +1,79 @@
+package vpcflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowTimeFilterLogFile(t *testing.T) {
+	var start = time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	var end = start.Add(time.Hour)
+	tc := []struct {
+		Name      string
+		Filter    FlowTimeFilter
+		Timestamp time.Time
+		Expected  bool
+	}{
+		{"inside", FlowTimeFilter{Start: start, End: end}, start.Add(time.Minute), true},
+		{"default before", FlowTimeFilter{Start: start, End: end}, start.Add(-DefaultTimeFilterBefore), true},
+		{"past default before", FlowTimeFilter{Start: start, End: end}, start.Add(-DefaultTimeFilterBefore - time.Minute), false},
+		{"default after", FlowTimeFilter{Start: start, End: end}, end.Add(DefaultTimeFilterAfter), true},
+		{"past default after", FlowTimeFilter{Start: start, End: end}, end.Add(DefaultTimeFilterAfter + time.Minute), false},
+		{"custom after", FlowTimeFilter{Start: start, End: end, After: time.Hour}, end.Add(time.Hour), true},
+		{"no before", FlowTimeFilter{Start: start, End: end, Before: -1}, start.Add(-time.Minute), false},
+		{"no after", FlowTimeFilter{Start: start, End: end, After: -1}, end.Add(time.Minute), false},
+		{"no padding at bound", FlowTimeFilter{Start: start, End: end, Before: -1, After: -1}, end, true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, tt.Filter.FilterLogFile(LogFile{Timestamp: tt.Timestamp}))
+		})
+	}
+}
+
+func TestFlowTimeFilterRecord(t *testing.T) {
+	var start = time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	var end = start.Add(time.Hour)
+	var at = func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	tc := []struct {
+		Name     string
+		Match    TimeMatch
+		Record   FlowRecord
+		Expected bool
+	}{
+		{"overlaps inside", OverlapsTimeRange, FlowRecord{Start: at(1), End: at(2)}, true},
+		{"overlaps start", OverlapsTimeRange, FlowRecord{Start: at(-5), End: at(1)}, true},
+		{"overlaps end", OverlapsTimeRange, FlowRecord{Start: at(59), End: at(65)}, true},
+		{"overlaps touching", OverlapsTimeRange, FlowRecord{Start: at(-5), End: start}, true},
+		{"overlaps before", OverlapsTimeRange, FlowRecord{Start: at(-5), End: at(-1)}, false},
+		{"overlaps after", OverlapsTimeRange, FlowRecord{Start: at(61), End: at(65)}, false},
+		{"starts inside", StartsInTimeRange, FlowRecord{Start: at(59), End: at(65)}, true},
+		{"starts before", StartsInTimeRange, FlowRecord{Start: at(-5), End: at(1)}, false},
+		{"starts at end", StartsInTimeRange, FlowRecord{Start: end, End: at(65)}, true},
+		{"within inside", WithinTimeRange, FlowRecord{Start: start, End: end}, true},
+		{"within past end", WithinTimeRange, FlowRecord{Start: at(59), End: at(61)}, false},
+		{"within before start", WithinTimeRange, FlowRecord{Start: at(-1), End: at(1)}, false},
+		{"only end", WithinTimeRange, FlowRecord{End: at(1)}, true},
+		{"only start", OverlapsTimeRange, FlowRecord{Start: at(61)}, false},
+		{"no times", WithinTimeRange, FlowRecord{}, true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.Name, func(t *testing.T) {
+			var f = FlowTimeFilter{Start: start, End: end, Match: tt.Match}
+			assert.Equal(t, tt.Expected, f.FilterRecord(tt.Record))
+		})
+	}
+}
+
+func TestFlowTimeFilterFileRange(t *testing.T) {
+	var start = time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	var end = start.Add(time.Hour)
+	var f = FlowTimeFilter{Start: start, End: end, Before: time.Minute}
+	var s, e = f.FileRange()
+	assert.Equal(t, start.Add(-time.Minute), s)
+	assert.Equal(t, end.Add(DefaultTimeFilterAfter), e)
+}